@@ -0,0 +1,123 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//audit trail of the generated files downloads
+package audit
+
+import (
+	"sync"
+	"time"
+)
+
+//Record is a single file download
+type Record struct {
+	UID      string    `json:"uid"`
+	Template string    `json:"template"`
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"clientIP"`
+	Bytes    int64     `json:"bytes"`
+}
+
+//Storage keeps the download records and returns the download statistics by uid
+//the statistics of the data which is gone are dropped by Forget
+type Storage interface {
+	Add(r Record) error
+	Stats(uid string) (downloads uint, firstAccess time.Time, lastAccess time.Time, err error)
+	Forget(uid string) error
+}
+
+//Summary aggregates the downloads of one uid
+type Summary struct {
+	Downloads   uint
+	Bytes       int64
+	FirstAccess time.Time
+	LastAccess  time.Time
+}
+
+//MemoryStorage keeps the download summaries by uid and the last maxRecords download records in the memory
+type MemoryStorage struct {
+	mu         sync.RWMutex
+	summaries  map[string]*Summary
+	records    []Record //the ring of the last records, next is the oldest one when it's full
+	next       int
+	maxRecords int
+}
+
+//the records aren't kept if maxRecords is 0
+func NewMemoryStorage(maxRecords uint) *MemoryStorage {
+	return &MemoryStorage{
+		summaries:  make(map[string]*Summary),
+		maxRecords: int(maxRecords),
+	}
+}
+
+//adds the download record to the summary of its uid, the oldest record is dropped if there are maxRecords ones
+func (s *MemoryStorage) Add(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxRecords > 0 {
+		if len(s.records) < s.maxRecords {
+			s.records = append(s.records, r)
+		} else {
+			s.records[s.next] = r
+		}
+		s.next = (s.next + 1) % s.maxRecords
+	}
+
+	sum, ok := s.summaries[r.UID]
+	if !ok {
+		sum = &Summary{FirstAccess: r.Time, LastAccess: r.Time}
+		s.summaries[r.UID] = sum
+	}
+	if r.Time.Before(sum.FirstAccess) {
+		sum.FirstAccess = r.Time
+	}
+	if r.Time.After(sum.LastAccess) {
+		sum.LastAccess = r.Time
+	}
+	sum.Downloads++
+	sum.Bytes += r.Bytes
+	return nil
+}
+
+//returns the download count, the first and the last access time for uid
+//zero values are returned if uid has never been downloaded
+func (s *MemoryStorage) Stats(uid string) (downloads uint, firstAccess time.Time, lastAccess time.Time, err error) {
+	sum := s.Summary(uid)
+	return sum.Downloads, sum.FirstAccess, sum.LastAccess, nil
+}
+
+//returns the kept download records of uid, the oldest first
+func (s *MemoryStorage) Records(uid string) (records []Record) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := 0
+	if len(s.records) == s.maxRecords {
+		start = s.next
+	}
+	for i := range s.records {
+		if r := s.records[(start+i)%len(s.records)]; r.UID == uid {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+//drops the download summary of uid, the records are kept until they are pushed out of the ring
+func (s *MemoryStorage) Forget(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.summaries, uid)
+	return nil
+}
+
+//returns the download summary of uid, the zero summary if uid has never been downloaded
+func (s *MemoryStorage) Summary(uid string) Summary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sum, ok := s.summaries[uid]; ok {
+		return *sum
+	}
+	return Summary{}
+}
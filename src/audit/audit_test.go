@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func CheckStats(s Storage) error {
+	const UID = "CHECK_STATS_TEST"
+	t1 := time.Now().Add(-time.Hour)
+	t2 := time.Now()
+
+	downloads, _, _, err := s.Stats(UID)
+	if err != nil || downloads != 0 {
+		return fmt.Errorf("no downloads are expected for unknown uid: %d, %v", downloads, err)
+	}
+
+	if err := s.Add(Record{UID: UID, Template: "default", Time: t2, ClientIP: "127.0.0.1", Bytes: 10}); err != nil {
+		return fmt.Errorf("error on Add: %v", err)
+	}
+	if err := s.Add(Record{UID: UID, Template: "default", Time: t1, ClientIP: "127.0.0.2", Bytes: 10}); err != nil {
+		return fmt.Errorf("error on Add: %v", err)
+	}
+
+	downloads, first, last, err := s.Stats(UID)
+	if err != nil {
+		return fmt.Errorf("error on Stats: %v", err)
+	}
+	if downloads != 2 {
+		return fmt.Errorf("wrong downloads count: %d", downloads)
+	}
+	if !first.Equal(t1) || !last.Equal(t2) {
+		return fmt.Errorf("wrong first or last access time")
+	}
+	if sum := s.(interface{ Summary(uid string) Summary }).Summary(UID); sum.Downloads != 2 || sum.Bytes != 20 {
+		return fmt.Errorf("wrong download summary: %+v", sum)
+	}
+	return nil
+}
+
+func TestMemoryStorage(t *testing.T) {
+	s := NewMemoryStorage(3)
+	if err := CheckStats(s); err != nil {
+		t.Errorf("Memory storage test: %v", err)
+	}
+
+	//the last records are kept in the ring
+	for i := 0; i < 3; i++ {
+		_ = s.Add(Record{UID: "other", Time: time.Now(), Bytes: int64(i)})
+	}
+	if records := s.Records("CHECK_STATS_TEST"); len(records) != 0 {
+		t.Errorf("the records haven't been pushed out of the ring: %+v", records)
+	}
+	records := s.Records("other")
+	if len(records) != 3 || records[0].Bytes != 0 || records[2].Bytes != 2 {
+		t.Errorf("wrong records have been kept: %+v", records)
+	}
+	_ = s.Add(Record{UID: "other", Time: time.Now(), Bytes: 3})
+	if records := s.Records("other"); len(records) != 3 || records[0].Bytes != 1 || records[2].Bytes != 3 {
+		t.Errorf("the oldest record hasn't been dropped: %+v", records)
+	}
+
+	if err := s.Forget("other"); err != nil {
+		t.Fatalf("can't forget the uid: %v", err)
+	}
+	if downloads, _, _, _ := s.Stats("other"); downloads != 0 {
+		t.Errorf("the summary hasn't been dropped: %d", downloads)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "audit.log")
+	s, err := NewFileStorage(filename)
+	if err != nil {
+		t.Fatalf("can't create file storage: %v", err)
+	}
+
+	if err := CheckStats(s); err != nil {
+		t.Errorf("File storage test: %v", err)
+	}
+	_ = s.Close()
+
+	//records should be loaded back from the file
+	s, err = NewFileStorage(filename)
+	if err != nil {
+		t.Fatalf("can't reopen file storage: %v", err)
+	}
+	defer func() { _ = s.Close() }()
+
+	downloads, _, _, err := s.Stats("CHECK_STATS_TEST")
+	if err != nil || downloads != 2 {
+		t.Errorf("records haven't been loaded from the file: %d, %v", downloads, err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+//FileStorage appends the download records to the file as JSON lines
+//the file is read line by line into the memory summaries on creation, so statistics survive restarts
+type FileStorage struct {
+	mu    sync.Mutex
+	f     *os.File
+	index *MemoryStorage
+}
+
+func NewFileStorage(filename string) (*FileStorage, error) {
+	//the records are kept in the file only
+	index := NewMemoryStorage(0)
+	if err := load(filename, index); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("can't open the audit file: %v", err)
+	}
+
+	return &FileStorage{
+		f:     f,
+		index: index,
+	}, nil
+}
+
+//appends the download record to the file
+func (s *FileStorage) Add(r Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("wrong audit record: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err = s.f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("can't write the audit record: %v", err)
+	}
+	return s.index.Add(r)
+}
+
+func (s *FileStorage) Stats(uid string) (downloads uint, firstAccess time.Time, lastAccess time.Time, err error) {
+	return s.index.Stats(uid)
+}
+
+func (s *FileStorage) Summary(uid string) Summary {
+	return s.index.Summary(uid)
+}
+
+//drops the download summary of uid, the records are kept in the file, so the summary is loaded again on restart
+func (s *FileStorage) Forget(uid string) error {
+	return s.index.Forget(uid)
+}
+
+func (s *FileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+//reads the records from the file into the summaries one by one, broken lines are skipped
+func load(filename string, index *MemoryStorage) error {
+	f, err := os.Open(filename) // #nosec G304
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't open the audit file: %v", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.UID == "" {
+			continue
+		}
+		_ = index.Add(r)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("can't read the audit file: %v", err)
+	}
+	return nil
+}
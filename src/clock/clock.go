@@ -0,0 +1,22 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//the source of the current time shared by the packages, it's replaced with a fake one in tests
+package clock
+
+import "time"
+
+//Clock returns the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+//System returns the real time
+var System Clock = systemClock{}
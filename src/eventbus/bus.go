@@ -0,0 +1,173 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//internal bus of the activity events published by the web api and the ftp server
+package eventbus
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//event types
+const (
+	Created     = "created"
+	Downloaded  = "downloaded"
+	RenderError = "renderError"
+	Deleted     = "deleted"
+	Expired     = "expired"
+)
+
+type Event struct {
+	ID        uint64    `json:"id"` //sequence number of the event since the start
+	Type      string    `json:"type"`
+	UID       string    `json:"uid"`
+	Time      time.Time `json:"time"`
+	Template  string    `json:"template,omitempty"`
+	ClientIP  string    `json:"clientIP,omitempty"`  //ip of the ftp client, the downloaded events only
+	Downloads uint      `json:"downloads,omitempty"` //number of the downloads of the data including this one, the downloaded events only
+	First     bool      `json:"first,omitempty"`     //the first download of the data, it's marked persistently, the downloaded events only
+	Error     string    `json:"error,omitempty"`     //why the file hasn't been rendered, the renderError events only
+}
+
+//Filter selects the events of the subscription, the empty fields match any event
+type Filter struct {
+	UID      string
+	Template string
+}
+
+func (f Filter) Match(e Event) bool {
+	return (f.UID == "" || f.UID == e.UID) && (f.Template == "" || f.Template == e.Template)
+}
+
+//Bus passes the published events to the handlers and the subscribers
+//the subscriber which doesn't read its events in time loses the events which don't fit its buffer
+type Bus struct {
+	size int
+
+	mu       sync.Mutex
+	id       uint64
+	handlers []func(Event)
+	subs     map[*Subscription]bool
+	closed   bool
+}
+
+//creates the bus, the subscribers buffer up to size events
+func New(size int) *Bus {
+	if size < 1 {
+		size = 1
+	}
+	return &Bus{
+		size: size,
+		subs: make(map[*Subscription]bool),
+	}
+}
+
+//adds the handler called with every published event, the handler must not block the publisher
+func (b *Bus) Handle(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+//numbers the event and passes it to the handlers and the subscribers, the time is set if it's zero
+//the publisher is never blocked by the subscribers
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.id++
+	e.ID = b.id
+	handlers := b.handlers
+	for sub := range b.subs {
+		if !sub.filter.Match(e) {
+			continue
+		}
+		select {
+		case sub.c <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+	b.mu.Unlock()
+
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+//subscribes to the events matching the filter, the subscription must be closed when it's no longer needed
+//the events channel of the subscription is closed when the bus is closed
+func (b *Bus) Subscribe(filter Filter) *Subscription {
+	sub := &Subscription{
+		bus:    b,
+		filter: filter,
+		c:      make(chan Event, b.size),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(sub.c)
+		return sub
+	}
+	b.subs[sub] = true
+	return sub
+}
+
+//returns the number of the subscribers
+func (b *Bus) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
+
+//closes the subscriptions, the events published after it are discarded
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for sub := range b.subs {
+		delete(b.subs, sub)
+		close(sub.c)
+	}
+}
+
+//Subscription receives the events of the bus matching its filter
+type Subscription struct {
+	bus     *Bus
+	filter  Filter
+	c       chan Event
+	dropped uint64
+}
+
+//returns the channel of the events, it's closed when the subscription or the bus is closed
+func (s *Subscription) Events() <-chan Event {
+	return s.c
+}
+
+//returns the number of the events which haven't fit the buffer since the previous call
+func (s *Subscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+//unsubscribes from the bus
+func (s *Subscription) Close() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subs[s] {
+		delete(b.subs, s)
+		close(s.c)
+	}
+}
@@ -0,0 +1,77 @@
+package eventbus
+
+import (
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	b := New(10)
+	var handled []Event
+	b.Handle(func(e Event) { handled = append(handled, e) })
+
+	all := b.Subscribe(Filter{})
+	byUID := b.Subscribe(Filter{UID: "uid1"})
+	byTemplate := b.Subscribe(Filter{Template: "invoice"})
+
+	b.Publish(Event{Type: Created, UID: "uid1"})
+	b.Publish(Event{Type: Downloaded, UID: "uid2", Template: "invoice"})
+	b.Publish(Event{Type: Downloaded, UID: "uid1", Template: "default"})
+
+	if len(handled) != 3 || handled[0].ID != 1 || handled[2].ID != 3 || handled[0].Time.IsZero() {
+		t.Errorf("the events haven't been numbered and passed to the handler: %+v", handled)
+	}
+	if n := len(all.Events()); n != 3 {
+		t.Errorf("the subscriber without filter has got %d events, 3 expected", n)
+	}
+	if n := len(byUID.Events()); n != 2 {
+		t.Errorf("the uid subscriber has got %d events, 2 expected", n)
+	}
+	if e := <-byTemplate.Events(); len(byTemplate.Events()) != 0 || e.UID != "uid2" {
+		t.Errorf("the template subscriber has got wrong events: %+v", e)
+	}
+
+	//the closed subscription doesn't get the events
+	byUID.Close()
+	byUID.Close()
+	for range byUID.Events() {
+	}
+	if b.Subscribers() != 2 {
+		t.Errorf("the closed subscription is still subscribed")
+	}
+
+	b.Close()
+	for range all.Events() {
+	}
+	if _, ok := <-b.Subscribe(Filter{}).Events(); ok {
+		t.Errorf("the subscription of the closed bus isn't closed")
+	}
+	b.Publish(Event{Type: Deleted, UID: "uid1"})
+	if len(handled) != 3 {
+		t.Errorf("the event has been published to the closed bus")
+	}
+}
+
+//the slow subscriber loses the events which don't fit its buffer, the publisher isn't blocked
+func TestBusSlowSubscriber(t *testing.T) {
+	b := New(2)
+	slow := b.Subscribe(Filter{})
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: Created, UID: "uid"})
+	}
+
+	if n := slow.Dropped(); n != 3 {
+		t.Errorf("%d dropped events have been counted, 3 expected", n)
+	}
+	if n := slow.Dropped(); n != 0 {
+		t.Errorf("the dropped events counter hasn't been reset: %d", n)
+	}
+	if e := <-slow.Events(); e.ID != 1 {
+		t.Errorf("the buffered events have been replaced: %+v", e)
+	}
+
+	b.Publish(Event{Type: Created, UID: "uid"})
+	<-slow.Events()
+	if e := <-slow.Events(); e.ID != 6 || slow.Dropped() != 0 {
+		t.Errorf("the event hasn't been delivered after the buffer has been read: %+v", e)
+	}
+}
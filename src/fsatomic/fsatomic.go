@@ -0,0 +1,93 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//atomic writes of the files, the temporary files left by the crashed writes are told by their names
+package fsatomic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//prefix of the temporary files, such files are left only if the process has crashed in the middle of a write
+const TmpFilePrefix = ".tmp-"
+
+//the temporary files younger than this can be written by another process at the moment, as by the process being upgraded,
+//so they aren't removed on start
+const StaleTmpFileAge = time.Hour
+
+//writes the data to the file atomically
+//the data is written to the temporary file, synced and renamed to the filename, then the directory is synced
+//so the file contains either the old or the new data after a crash, but never a part of it
+func WriteFile(filename string, data []byte, perm os.FileMode) (err error) {
+	dir, name := filepath.Split(filename)
+	f, err := ioutil.TempFile(dir, TmpFilePrefix+name+"-")
+	if err != nil {
+		return fmt.Errorf("can't create the temporary file: %v", err)
+	}
+
+	defer func() {
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+
+	if _, err = f.Write(data); err != nil {
+		return fmt.Errorf("can't write the data to file: %v", err)
+	}
+	if err = f.Chmod(perm); err != nil {
+		return fmt.Errorf("can't change the file mode: %v", err)
+	}
+	if err = f.Sync(); err != nil {
+		return fmt.Errorf("can't sync the file: %v", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("can't close the file: %v", err)
+	}
+	if err = os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("can't rename the temporary file: %v", err)
+	}
+	return SyncDir(dir)
+}
+
+//removes the file and syncs its directory
+func Remove(filename string) error {
+	if err := os.Remove(filename); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(filename))
+}
+
+//syncs the directory, so the renamed or removed directory entries are on the disk
+func SyncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir) // #nosec G304
+	if err != nil {
+		return fmt.Errorf("can't open the directory: %v", err)
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("can't sync the directory: %v", err)
+	}
+	return nil
+}
+
+//returns true if the file is a temporary file left by WriteFile
+func IsTmpFile(name string) bool {
+	return strings.HasPrefix(name, TmpFilePrefix)
+}
+
+//returns true if the temporary file is left by the crashed process and can be removed
+func IsStaleTmpFile(info os.FileInfo) bool {
+	return IsTmpFile(info.Name()) && time.Since(info.ModTime()) > StaleTmpFileAge
+}
@@ -0,0 +1,363 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"encoding/json"
+	"fmt"
+	"ftpdts/src/webhook"
+	"github.com/creasty/defaults"
+	"github.com/spf13/viper"
+	"github.com/starshiptroopers/uidgenerator"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	defConfigFile      = "./ftpdts.ini"
+	defConfigEnvPrefix = "FTPDTS"
+)
+
+//config file formats by the file extension
+var configTypes = map[string]string{
+	".ini":  "ini",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+	".json": "json",
+}
+
+//the value of the secret config fields printed instead of them
+const redacted = "<redacted>"
+
+type Config struct {
+	HTTP struct {
+		Port           uint    `default:"2001"`
+		Host           string  `default:"127.0.0.1"`
+		MaxRequestBody int64   `default:"1024"`
+		APIKeys        string  `secret:"true"`   //comma separated list of the API keys, passed by clients in the X-API-Key header
+		RateLimit      float64 `default:"0"`     //requests per second from one IP without API key, 0 - unlimited
+		RateBurst      uint    `default:"10"`    //maximum number of requests at once from one IP
+		KeyRateLimit   float64 `default:"0"`     //requests per second with one API key, 0 - unlimited
+		KeyRateBurst   uint    `default:"10"`    //maximum number of requests at once with one API key
+		DailyQuota     uint    `default:"0"`     //datasets created with one API key per day (UTC), 0 - unlimited
+		AuthRead       bool    `default:"false"` //GET /data, /data/stats and /data/link require a known API key
+		EventsBuffer   uint    `default:"100"`   //events buffered for each client of GET /events, the client which doesn't read them in time loses the newer events
+		TLSCert        string  //certificate file, the http server is started with https if it's set
+		TLSKey         string  //private key file of the certificate
+	}
+
+	Sign struct {
+		Secret   string `secret:"true"`   //HMAC secret of the signed ftp file names, the file names aren't signed if it's empty
+		Required bool   `default:"false"` //the unsigned ftp file names are rejected
+		LinkTTL  uint   `default:"0"`     //seconds the signed file names returned with the posted data are valid, 0 - never expire
+	}
+
+	FTP struct {
+		Port         uint   `default:"2000"`
+		Host         string `default:"127.0.0.1"`
+		PassivePorts string `default:"32000-32010"`
+		DebugMode    bool   `default:"false"`
+		PublicIP     string
+
+		MaxConnections      uint `default:"0"`   //total number of the connections, 0 - unlimited
+		MaxConnectionsPerIP uint `default:"0"`   //number of the connections from one IP, 0 - unlimited
+		RequestsPerMinute   uint `default:"0"`   //number of the new connections from one IP per minute, 0 - unlimited
+		IdleTimeout         uint `default:"300"` //seconds the connection is kept without commands, 0 - unlimited
+		TransferTimeout     uint `default:"60"`  //seconds the file transfer can take, 0 - unlimited
+		BanMisses           uint `default:"0"`   //failed downloads the client IP is banned after, 0 - never banned
+		BanWindow           uint `default:"60"`  //seconds the failed downloads are counted within
+		BanDuration         uint `default:"600"` //seconds the client IP is banned for
+	}
+
+	Templates struct {
+		Path string `default:"./tmpl"`
+	}
+
+	Data struct {
+		Backend       string `default:"fs"` //fs, bolt or sql
+		Path          string `default:"./data"`
+		BoltFile      string `default:"./data/ftpdts.db"`                   //database file, used by the bolt backend
+		SQLDriver     string `default:"sqlite"`                             //sqlite or postgres, used by the sql backend
+		SQLDSN        string `default:"./data/ftpdts.sqlite" secret:"true"` //database file for sqlite or connection string for postgres
+		PersistTTL    bool   `default:"false"`                              //store the data with ttl into the persistent storage too
+		SweepInterval uint   `default:"600"`                                //seconds between removals of the expired persistent data
+		ShardLevels   uint   `default:"0"`                                  //number of the shard folders levels, 0 - flat layout
+		ShardWidth    uint   `default:"2"`                                  //number of the uid chars used to name the shard folder
+	}
+
+	Logs struct {
+		FTP             string `default:"logs/ftp.log"`
+		FTPNoConsole    bool   `default:"false"`
+		HTTP            string `default:"logs/http.log"`
+		HTTPNoConsole   bool   `default:"false"`
+		Ftpdts          string `default:"logs/ftpdts.log"`
+		FtpdtsNoConsole bool   `default:"false"`
+	}
+
+	Shutdown struct {
+		DrainTimeout   uint `default:"30"` //seconds the ftp transfers and http requests in progress are waited for on shutdown
+		ReadinessDelay uint `default:"0"`  //seconds between the readiness endpoint starts failing and the servers stop accepting connections
+	}
+
+	Audit struct {
+		Backend    string `default:"memory"` //memory or file
+		Path       string `default:"logs/audit.log"`
+		MaxRecords uint   `default:"10000"` //the last download records kept by the memory backend
+	}
+
+	Webhook struct {
+		URL         string //the events are posted to the url, the webhooks are disabled if it's empty
+		Secret      string `secret:"true"`                                //HMAC secret of the request signature
+		Events      string `default:"created,downloaded,expired,deleted"` //the event types to send
+		QueuePath   string `default:"./webhooks"`                         //folder of the events which haven't been delivered yet
+		QueueSize   int    `default:"10000"`                              //maximum number of the queued events, the new ones are dropped when it's full
+		MaxAttempts int    `default:"10"`                                 //the event is dropped after this number of failed deliveries, 0 - never dropped
+		Backoff     uint   `default:"1"`                                  //seconds before the first retry, doubled for every next one
+		MaxBackoff  uint   `default:"300"`                                //maximum seconds between the retries
+		Timeout     uint   `default:"10"`                                 //seconds the webhook request can take
+	}
+
+	Cache struct {
+		DataTTL       uint   `default:"86400"`
+		Preload       bool   `default:"true"`   //load all persistent data into the cache on start, otherwise it's read on the first request
+		MaxEntries    int    `default:"0"`      //maximum number of the items in the memory cache, 0 - unlimited
+		MaxBytes      int64  `default:"0"`      //maximum size of the data in the memory cache, 0 - unlimited
+		SweepInterval uint   `default:"60"`     //seconds between removals of the expired data from the memory cache, 0 - on access only
+		Backend       string `default:"memory"` //memory or redis
+		Addr          string `default:"127.0.0.1:6379"`
+		Password      string `secret:"true"`
+		DB            int    `default:"0"`
+		Prefix        string `default:"ftpdts:"` //prefix of the redis keys
+	}
+
+	UID struct {
+		Chars           string `default:"1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"`
+		Format          string `default:"XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX"`
+		ValidatorRegexp string `default:"[0-9a-zA-Z]{32}"`
+	}
+}
+
+func viperConfig(cFile string, cType string, envPrefix string, config interface{}) (v *viper.Viper, err error) {
+	v = viper.New()
+	v.SetConfigFile(cFile)
+	v.SetConfigType(cType)
+	v.AutomaticEnv()
+	v.SetEnvPrefix(envPrefix)
+	//fill default config values
+	if reflect.TypeOf(config).Kind() == reflect.Ptr && reflect.ValueOf(config).Elem().Type().Kind() == reflect.Struct {
+		if err = defaults.Set(config); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//loads the config from the file, the default file is used if filename is empty
+//the file format is defined by the file extension: ini, yaml, toml or json
+func LoadConfig(filename string) (c *Config, err error) {
+	if filename == "" {
+		filename = defConfigFile
+	}
+	cType, ok := configTypes[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported config file format: %s", filename)
+	}
+
+	c = new(Config)
+	viperConfig, err := viperConfig(filename, cType, defConfigEnvPrefix, c)
+	if err != nil {
+		return
+	}
+
+	// Find and read the config file
+	if err := viperConfig.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("wrong config file: %v", err)
+	}
+
+	if err := viperConfig.Unmarshal(c); err != nil {
+		return nil, fmt.Errorf("unable to parse config file: %v", err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+//ConfigErrors is the list of the config problems, each one is prefixed with the config field name
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "wrong config:\n\t" + strings.Join(e, "\n\t")
+}
+
+//checks the config values and returns all problems found as ConfigErrors
+func (c *Config) Validate() error {
+	var errs ConfigErrors
+	add := func(field string, format string, a ...interface{}) {
+		errs = append(errs, field+": "+fmt.Sprintf(format, a...))
+	}
+
+	if c.HTTP.Port == 0 || c.HTTP.Port > 65535 {
+		add("http.port", "%d is out of the range 1-65535", c.HTTP.Port)
+	}
+	if c.FTP.Port == 0 || c.FTP.Port > 65535 {
+		add("ftp.port", "%d is out of the range 1-65535", c.FTP.Port)
+	}
+	if c.HTTP.Port == c.FTP.Port {
+		add("http.port", "%d is the same as ftp.port", c.HTTP.Port)
+	}
+	if c.FTP.PassivePorts != "" {
+		min, max, err := portRange(c.FTP.PassivePorts)
+		switch {
+		case err != nil:
+			add("ftp.passivePorts", "%v", err)
+		case c.FTP.Port >= min && c.FTP.Port <= max:
+			add("ftp.passivePorts", "%s includes ftp.port %d", c.FTP.PassivePorts, c.FTP.Port)
+		case c.HTTP.Port >= min && c.HTTP.Port <= max:
+			add("ftp.passivePorts", "%s includes http.port %d", c.FTP.PassivePorts, c.HTTP.Port)
+		}
+	}
+	if c.HTTP.AuthRead && len(splitList(c.HTTP.APIKeys)) == 0 {
+		add("http.authRead", "is set but http.apiKeys is empty, all reads would be rejected")
+	}
+	if (c.HTTP.TLSCert == "") != (c.HTTP.TLSKey == "") {
+		add("http.tlsCert", "http.tlsCert and http.tlsKey must be set together")
+	}
+	if c.HTTP.EventsBuffer == 0 {
+		add("http.eventsBuffer", "must be positive")
+	}
+	if c.Sign.Required && c.Sign.Secret == "" {
+		add("sign.required", "is set but sign.secret is empty")
+	}
+
+	if !oneOf(c.Data.Backend, "", "fs", "bolt", "sql") {
+		add("data.backend", "unknown backend %q, expected fs, bolt or sql", c.Data.Backend)
+	}
+	if c.Data.Backend == "sql" && !oneOf(c.Data.SQLDriver, "sqlite", "postgres") {
+		add("data.sqlDriver", "unknown driver %q, expected sqlite or postgres", c.Data.SQLDriver)
+	}
+	if !oneOf(c.Cache.Backend, "", "memory", "redis") {
+		add("cache.backend", "unknown backend %q, expected memory or redis", c.Cache.Backend)
+	}
+	if !oneOf(c.Audit.Backend, "", "memory", "file") {
+		add("audit.backend", "unknown backend %q, expected memory or file", c.Audit.Backend)
+	}
+
+	if c.Webhook.URL != "" {
+		if u, err := url.Parse(c.Webhook.URL); err != nil || !oneOf(u.Scheme, "http", "https") || u.Host == "" {
+			add("webhook.url", "%q isn't a http or https url", c.Webhook.URL)
+		}
+		if c.Webhook.Secret == "" {
+			add("webhook.secret", "is empty, the webhook requests can't be signed")
+		}
+		for _, e := range splitList(c.Webhook.Events) {
+			if !oneOf(e, webhook.Created, webhook.Downloaded, webhook.Expired, webhook.Deleted) {
+				add("webhook.events", "unknown event %q, expected created, downloaded, expired or deleted", e)
+			}
+		}
+		if c.Webhook.QueueSize <= 0 {
+			add("webhook.queueSize", "%d must be positive", c.Webhook.QueueSize)
+		}
+		if c.Webhook.MaxAttempts < 0 {
+			add("webhook.maxAttempts", "%d is negative", c.Webhook.MaxAttempts)
+		}
+		if c.Webhook.Backoff == 0 {
+			add("webhook.backoff", "must be positive")
+		}
+		if c.Webhook.MaxBackoff < c.Webhook.Backoff {
+			add("webhook.maxBackoff", "%d is less than webhook.backoff %d", c.Webhook.MaxBackoff, c.Webhook.Backoff)
+		}
+		if c.Webhook.Timeout == 0 {
+			add("webhook.timeout", "must be positive")
+		}
+	}
+
+	uidValid := true
+	if c.UID.Chars == "" {
+		add("uid.chars", "is empty")
+		uidValid = false
+	}
+	if !strings.Contains(c.UID.Format, "X") {
+		add("uid.format", "%q has no X placeholders, all uids would be the same", c.UID.Format)
+		uidValid = false
+	}
+	if _, err := regexp.Compile(c.UID.ValidatorRegexp); err != nil {
+		add("uid.validatorRegexp", "%v", err)
+		uidValid = false
+	}
+	if uidValid {
+		ug := uidgenerator.New(&uidgenerator.Cfg{
+			Alfa:      c.UID.Chars,
+			Format:    c.UID.Format,
+			Validator: c.UID.ValidatorRegexp,
+		})
+		if uid := ug.New(); !validUID(ug, uid) {
+			add("uid.validatorRegexp", "%q doesn't match the generated uid %q, check uid.format and uid.chars", c.UID.ValidatorRegexp, uid)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+//parses the passive ports range min-max
+func portRange(s string) (min uint, max uint, err error) {
+	r := strings.Split(s, "-")
+	if len(r) != 2 {
+		return 0, 0, fmt.Errorf("%q isn't a range min-max", s)
+	}
+	a, errMin := strconv.ParseUint(strings.TrimSpace(r[0]), 10, 16)
+	b, errMax := strconv.ParseUint(strings.TrimSpace(r[1]), 10, 16)
+	if errMin != nil || errMax != nil || a == 0 {
+		return 0, 0, fmt.Errorf("%q has wrong ports, expected numbers 1-65535", s)
+	}
+	if a >= b {
+		return 0, 0, fmt.Errorf("%q is empty, min port must be less than max port", s)
+	}
+	return uint(a), uint(b), nil
+}
+
+//the uid is valid if the validator finds the whole uid in it
+func validUID(ug *uidgenerator.UIDGenerator, uid string) bool {
+	found, err := ug.Validate(uid)
+	return err == nil && found == uid
+}
+
+func oneOf(s string, values ...string) bool {
+	for _, v := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the config in JSON with the secret fields redacted
+func (c *Config) Redacted() ([]byte, error) {
+	r := *c
+	redact(reflect.ValueOf(&r).Elem())
+	return json.MarshalIndent(&r, "", "  ")
+}
+
+//replaces the non-empty string fields tagged with secret:"true"
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Struct:
+			redact(f)
+		case f.Kind() == reflect.String && v.Type().Field(i).Tag.Get("secret") == "true" && f.String() != "":
+			f.SetString(redacted)
+		}
+	}
+}
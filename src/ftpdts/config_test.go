@@ -0,0 +1,135 @@
+package ftpdts
+
+import (
+	"encoding/json"
+	"github.com/creasty/defaults"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//the config format is defined by the file extension, unset values are filled with defaults
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	files := map[string]string{
+		"ftpdts.ini":  "[http]\nport = 3000\n[sign]\nsecret = s1\n",
+		"ftpdts.yaml": "http:\n  port: 3000\nsign:\n  secret: s1\n",
+		"ftpdts.toml": "[http]\nport = 3000\n[sign]\nsecret = \"s1\"\n",
+		"ftpdts.json": `{"http": {"port": 3000}, "sign": {"secret": "s1"}}`,
+	}
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("can't write the config file: %v", err)
+		}
+		c, err := LoadConfig(filename)
+		if err != nil {
+			t.Errorf("can't load %s: %v", name, err)
+			continue
+		}
+		if c.HTTP.Port != 3000 || c.Sign.Secret != "s1" || c.FTP.Port != 2000 {
+			t.Errorf("wrong config has been loaded from %s: %+v", name, c)
+		}
+	}
+
+	if _, err := LoadConfig(filepath.Join(dir, "ftpdts.conf")); err == nil {
+		t.Errorf("unsupported config format has been loaded")
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	c := new(Config)
+	c.Sign.Secret = "s1"
+	c.Cache.Password = "p1"
+	c.HTTP.Port = 3000
+
+	b, err := c.Redacted()
+	if err != nil {
+		t.Fatalf("can't print the config: %v", err)
+	}
+	if strings.Contains(string(b), "s1") || strings.Contains(string(b), "p1") {
+		t.Errorf("the secrets aren't redacted: %s", b)
+	}
+	if c.Sign.Secret != "s1" {
+		t.Errorf("the config has been changed")
+	}
+
+	var r Config
+	if err := json.Unmarshal(b, &r); err != nil || r.HTTP.Port != 3000 || r.Sign.Secret != redacted {
+		t.Errorf("wrong printed config: %v, %+v", err, r)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		c := new(Config)
+		if err := defaults.Set(c); err != nil {
+			t.Fatalf("can't set the config defaults: %v", err)
+		}
+		return c
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("the default config isn't valid: %v", err)
+	}
+
+	tests := []struct {
+		field  string
+		change func(c *Config)
+	}{
+		{"http.port", func(c *Config) { c.HTTP.Port = c.FTP.Port }},
+		{"ftp.port", func(c *Config) { c.FTP.Port = 70000 }},
+		{"ftp.passivePorts", func(c *Config) { c.FTP.PassivePorts = "32000" }},
+		{"ftp.passivePorts", func(c *Config) { c.FTP.PassivePorts = "32010-32000" }},
+		{"ftp.passivePorts", func(c *Config) { c.FTP.PassivePorts = "a-b" }},
+		{"ftp.passivePorts", func(c *Config) { c.FTP.PassivePorts = "1000-3000" }},
+		{"http.authRead", func(c *Config) { c.HTTP.AuthRead = true }},
+		{"http.eventsBuffer", func(c *Config) { c.HTTP.EventsBuffer = 0 }},
+		{"sign.required", func(c *Config) { c.Sign.Required = true }},
+		{"data.backend", func(c *Config) { c.Data.Backend = "mongo" }},
+		{"data.sqlDriver", func(c *Config) { c.Data.Backend, c.Data.SQLDriver = "sql", "mysql" }},
+		{"cache.backend", func(c *Config) { c.Cache.Backend = "memcached" }},
+		{"audit.backend", func(c *Config) { c.Audit.Backend = "db" }},
+		{"webhook.url", func(c *Config) { c.Webhook.URL, c.Webhook.Secret = "ftp://crm", "secret" }},
+		{"webhook.secret", func(c *Config) { c.Webhook.URL = "https://crm/hook" }},
+		{"webhook.events", func(c *Config) {
+			c.Webhook.URL, c.Webhook.Secret, c.Webhook.Events = "https://crm/hook", "secret", "created,updated"
+		}},
+		{"webhook.maxBackoff", func(c *Config) {
+			c.Webhook.URL, c.Webhook.Secret, c.Webhook.MaxBackoff = "https://crm/hook", "secret", 0
+		}},
+		{"uid.chars", func(c *Config) { c.UID.Chars = "" }},
+		{"uid.format", func(c *Config) { c.UID.Format = "uid" }},
+		{"uid.validatorRegexp", func(c *Config) { c.UID.ValidatorRegexp = "[0-9" }},
+		//the generated uid doesn't pass its own validator
+		{"uid.validatorRegexp", func(c *Config) { c.UID.ValidatorRegexp = "[0-9]{32}" }},
+		{"uid.validatorRegexp", func(c *Config) { c.UID.Format = "XXXX-XXXX" }},
+	}
+	for _, test := range tests {
+		c := valid()
+		test.change(c)
+		err := c.Validate()
+		if err == nil {
+			t.Errorf("the wrong %s hasn't been reported", test.field)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.field+": ") {
+			t.Errorf("the error doesn't name the field %s: %v", test.field, err)
+		}
+	}
+
+	//all problems are reported at once
+	c := valid()
+	c.HTTP.Port = c.FTP.Port
+	c.UID.ValidatorRegexp = "("
+	if errs, ok := c.Validate().(ConfigErrors); !ok || len(errs) != 2 {
+		t.Errorf("not all problems have been reported: %v", errs)
+	}
+}
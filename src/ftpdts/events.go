@@ -0,0 +1,79 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"fmt"
+	"ftpdts/src/audit"
+	"ftpdts/src/eventbus"
+	"ftpdts/src/webhook"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+//publishes the expiry of the data
+func (s *Server) expired(uid string) {
+	s.bus.Publish(eventbus.Event{Type: eventbus.Expired, UID: uid})
+}
+
+//publishes the render error if the ftp file of the existing data hasn't been produced
+//the ftpdt driver doesn't tell why, so the template is filled again to find the error, the missing data isn't an error
+func (s *Server) renderFailed(uid string, template string) {
+	payload, _, _, err := s.ds.Get(uid)
+	if err != nil {
+		return
+	}
+	t, err := s.templates.Template(template)
+	if err == nil {
+		err = t.Execute(ioutil.Discard, payload)
+	}
+	if err != nil {
+		s.bus.Publish(eventbus.Event{Type: eventbus.RenderError, UID: uid, Template: template, Error: err.Error()})
+	}
+}
+
+//drops the download statistics of the deleted and expired data from the audit storage
+func auditHandler(storage audit.Storage) func(e eventbus.Event) {
+	return func(e eventbus.Event) {
+		if e.Type == eventbus.Deleted || e.Type == eventbus.Expired {
+			_ = storage.Forget(e.UID)
+		}
+	}
+}
+
+//passes the data lifecycle events of the bus to the webhook sender, only the first download of the data is passed
+//the first download is marked in the rules storage, so it isn't passed again after the restart or by another instance
+func webhookHandler(sender *webhook.Sender) func(e eventbus.Event) {
+	return func(e eventbus.Event) {
+		switch {
+		case e.Type == eventbus.RenderError:
+			return
+		case e.Type == eventbus.Downloaded && !e.First:
+			return
+		}
+		sender.Notify(webhook.Event{Type: e.Type, UID: e.UID, Time: e.Time, Template: e.Template, ClientIP: e.ClientIP})
+	}
+}
+
+//creates the webhook sender configured in the [webhook] section
+func newWebhookSender(config Config, logger *log.Logger) (*webhook.Sender, error) {
+	c := config.Webhook
+	queue, err := webhook.NewQueue(c.QueuePath, c.QueueSize)
+	if err != nil {
+		return nil, fmt.Errorf("can't initialize the webhook queue: %v", err)
+	}
+	s := webhook.NewSender(c.URL, c.Secret, queue)
+	s.Events = make(map[string]bool)
+	for _, e := range splitList(c.Events) {
+		s.Events[e] = true
+	}
+	s.MaxAttempts = c.MaxAttempts
+	s.Backoff = time.Second * time.Duration(c.Backoff)
+	s.MaxBackoff = time.Second * time.Duration(c.MaxBackoff)
+	s.SetTimeout(time.Second * time.Duration(c.Timeout))
+	s.Logger = logger
+	return s, nil
+}
@@ -0,0 +1,662 @@
+package ftpdts
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"ftpdts/src/eventbus"
+	"ftpdts/src/webhook"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/creasty/defaults"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//testServer is the ftpdts server started on the ephemeral ports with the temporary template and data folders
+//the time of the server is driven by the test clock
+type testServer struct {
+	t        *testing.T
+	dir      string
+	config   Config
+	clock    *testClock
+	server   *Server
+	ftpAddr  string
+	httpAddr string
+}
+
+//testClock is the fake clock shared by the server goroutines and the test
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+//the config is changed by the options before the server is started
+func newTestServer(t *testing.T, opts ...func(c *Config)) *testServer {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	ts := &testServer{t: t, dir: dir, clock: &testClock{now: time.Now()}}
+
+	templates := map[string]string{
+		"default.tmpl": "<title>{{.Title}}</title>",
+		"test.tmpl":    "test: {{.Title}}",
+		"broken.tmpl":  "broken: {{.Title.Missing}}",
+	}
+	for _, folder := range []string{"tmpl", "data"} {
+		if err := os.MkdirAll(filepath.Join(dir, folder), 0700); err != nil {
+			t.Fatalf("can't create the folder: %v", err)
+		}
+	}
+	for name, content := range templates {
+		if err := ioutil.WriteFile(filepath.Join(dir, "tmpl", name), []byte(content), 0600); err != nil {
+			t.Fatalf("can't write the template: %v", err)
+		}
+	}
+
+	if err := defaults.Set(&ts.config); err != nil {
+		t.Fatalf("can't set the config defaults: %v", err)
+	}
+	ts.config.Templates.Path = filepath.Join(dir, "tmpl")
+	ts.config.Data.Path = filepath.Join(dir, "data")
+	//the passive data connections are accepted on any free port
+	ts.config.FTP.PassivePorts = ""
+	for _, opt := range opts {
+		opt(&ts.config)
+	}
+
+	ts.start()
+	return ts
+}
+
+//starts the server, it can be started again after stop with the same folders
+func (ts *testServer) start() {
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			ts.t.Fatalf("can't listen: %v", err)
+		}
+		return l
+	}
+	ftpListener, httpListener := listen(), listen()
+	ts.ftpAddr, ts.httpAddr = ftpListener.Addr().String(), httpListener.Addr().String()
+
+	s, err := New(ts.config, WithLogger(log.New(ioutil.Discard, "", 0)), WithListeners(ftpListener, httpListener), WithClock(ts.clock))
+	if err != nil {
+		ts.t.Fatalf("can't create the server: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		ts.t.Fatalf("can't start the server: %v", err)
+	}
+	ts.server = s
+}
+
+func (ts *testServer) stop() {
+	if err := ts.server.Stop(context.Background()); err != nil {
+		ts.t.Errorf("the server hasn't been stopped cleanly: %v", err)
+	}
+}
+
+func (ts *testServer) close() {
+	ts.stop()
+	_ = os.RemoveAll(ts.dir)
+}
+
+//posts the data to the web api and returns its uid
+func (ts *testServer) post(data string, query string) string {
+	res, err := http.Post("http://"+ts.httpAddr+"/data?"+query, "application/json", strings.NewReader(data))
+	if err != nil {
+		ts.t.Fatalf("can't post the data: %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	var r struct {
+		Code uint
+		UID  string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil || r.Code != 0 {
+		ts.t.Fatalf("the data hasn't been stored: %d, %v", res.StatusCode, err)
+	}
+	return r.UID
+}
+
+//sends the web api request, returns the response code of the body
+func (ts *testServer) request(method string, path string, apiKey string) uint {
+	req, err := http.NewRequest(method, "http://"+ts.httpAddr+path, nil)
+	if err != nil {
+		ts.t.Fatalf("can't create the request: %v", err)
+	}
+	req.Header.Set("X-API-Key", apiKey)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatalf("can't send the request: %v", err)
+	}
+	defer func() { _ = res.Body.Close() }()
+
+	var r struct {
+		Code uint
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		ts.t.Fatalf("wrong response: %d, %v", res.StatusCode, err)
+	}
+	return r.Code
+}
+
+//downloads the file with a new ftp session
+func (ts *testServer) download(path string) (string, error) {
+	c, err := dialFTP(ts.ftpAddr)
+	if err != nil {
+		return "", err
+	}
+	defer c.close()
+	b, err := c.retr(path)
+	return string(b), err
+}
+
+//ftpClient is the minimal ftp client: anonymous login and the passive mode downloads
+type ftpClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+//eventStream reads the server-sent events of the web api
+type eventStream struct {
+	res *http.Response
+	r   *bufio.Reader
+}
+
+//opens the event stream with the filter query
+func (ts *testServer) events(query string) *eventStream {
+	req, err := http.NewRequest(http.MethodGet, "http://"+ts.httpAddr+"/events?"+query, nil)
+	if err != nil {
+		ts.t.Fatalf("can't create the request: %v", err)
+	}
+	req.Header.Set("X-API-Key", "key")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatalf("can't open the event stream: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		ts.t.Fatalf("wrong event stream response: %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	return &eventStream{res, bufio.NewReader(res.Body)}
+}
+
+//reads the next event, the comments are skipped
+func (es *eventStream) next(t *testing.T) (event string, e eventbus.Event) {
+	done := make(chan error, 1)
+	go func() {
+		for {
+			line, err := es.r.ReadString('\n')
+			if err != nil {
+				done <- err
+				return
+			}
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case line == "" && event != "":
+				done <- nil
+				return
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					done <- err
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("can't read the event: %v", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the event hasn't been streamed")
+	}
+	return
+}
+
+func (es *eventStream) close() {
+	_ = es.res.Body.Close()
+}
+
+func dialFTP(addr string) (*ftpClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	c := &ftpClient{conn: conn, r: bufio.NewReader(conn)}
+
+	if _, err := c.reply(220); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, err := c.cmd(331, "USER anonymous"); err != nil {
+		c.close()
+		return nil, err
+	}
+	if _, err := c.cmd(230, "PASS anonymous"); err != nil {
+		c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+//sends the command and checks the reply code
+func (c *ftpClient) cmd(code int, command string) (string, error) {
+	if _, err := fmt.Fprintf(c.conn, "%s\r\n", command); err != nil {
+		return "", err
+	}
+	return c.reply(code)
+}
+
+//reads the reply, the multiline reply is joined
+func (c *ftpClient) reply(code int) (string, error) {
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+		if len(line) >= 4 && line[3] == ' ' && (len(lines) == 1 || line[:3] == lines[0][:3]) {
+			break
+		}
+	}
+	r := strings.Join(lines, "\n")
+	if n, _ := strconv.Atoi(r[:3]); n != code {
+		return r, fmt.Errorf("unexpected reply: %s", r)
+	}
+	return r, nil
+}
+
+//downloads the file in the passive mode
+func (c *ftpClient) retr(path string) ([]byte, error) {
+	if _, err := c.cmd(200, "TYPE I"); err != nil {
+		return nil, err
+	}
+	r, err := c.cmd(227, "PASV")
+	if err != nil {
+		return nil, err
+	}
+	addr, err := passiveAddr(r)
+	if err != nil {
+		return nil, err
+	}
+	data, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = data.Close() }()
+	_ = data.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := c.cmd(150, "RETR "+path); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.reply(226); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *ftpClient) close() {
+	_, _ = fmt.Fprintf(c.conn, "QUIT\r\n")
+	_ = c.conn.Close()
+}
+
+//parses the data connection address of the reply 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+func passiveAddr(reply string) (string, error) {
+	start, end := strings.IndexByte(reply, '('), strings.IndexByte(reply, ')')
+	if start < 0 || end < start {
+		return "", fmt.Errorf("wrong passive mode reply: %s", reply)
+	}
+	parts := strings.Split(reply[start+1:end], ",")
+	if len(parts) != 6 {
+		return "", fmt.Errorf("wrong passive mode reply: %s", reply)
+	}
+	p1, err1 := strconv.Atoi(parts[4])
+	p2, err2 := strconv.Atoi(parts[5])
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("wrong passive mode reply: %s", reply)
+	}
+	return net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(p1*256+p2)), nil
+}
+
+func TestIntegrationDownload(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	uid := ts.post(`{"Title": "Redirect page"}`, "")
+
+	//the default template is used in the root folder
+	if f, err := ts.download("/" + uid + ".html"); err != nil || f != "<title>Redirect page</title>" {
+		t.Errorf("wrong file of the default template: %q, %v", f, err)
+	}
+	//the template of the folder
+	if f, err := ts.download("/test/" + uid + ".html"); err != nil || f != "test: Redirect page" {
+		t.Errorf("wrong file of the test template: %q, %v", f, err)
+	}
+	if _, err := ts.download("/unknown/" + uid + ".html"); err == nil {
+		t.Errorf("the file of the unknown template has been downloaded")
+	}
+	if _, err := ts.download("/" + strings.Repeat("0", len(uid)) + ".html"); err == nil {
+		t.Errorf("the file of the unknown uid has been downloaded")
+	}
+}
+
+func TestIntegrationTTL(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	uid := ts.post(`{"Title": "Expiring"}`, "ttl=1")
+	if f, err := ts.download("/" + uid + ".html"); err != nil || f != "<title>Expiring</title>" {
+		t.Fatalf("wrong file: %q, %v", f, err)
+	}
+
+	ts.clock.Add(time.Second)
+	if _, err := ts.download("/" + uid + ".html"); err == nil {
+		t.Errorf("the expired file has been downloaded")
+	}
+}
+
+//the replicas sharing the redis cache enforce the same download limit
+func TestIntegrationReplicas(t *testing.T) {
+	srv := miniredis.RunT(t)
+	redisCache := func(c *Config) {
+		c.Cache.Backend = "redis"
+		c.Cache.Addr = srv.Addr()
+	}
+	a := newTestServer(t, redisCache)
+	defer a.close()
+	b := newTestServer(t, redisCache)
+	defer b.close()
+
+	uid := a.post(`{"Title": "Burn after reading"}`, "maxDownloads=1")
+	if f, err := b.download("/" + uid + ".html"); err != nil || f != "<title>Burn after reading</title>" {
+		t.Fatalf("the data hasn't been downloaded from another replica: %q, %v", f, err)
+	}
+	if _, err := a.download("/" + uid + ".html"); err == nil {
+		t.Errorf("the data has been downloaded twice")
+	}
+}
+
+//the replicas sharing the sql database enforce the same download rules with the memory cache
+func TestIntegrationSQLReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	sqlData := func(c *Config) {
+		c.Data.Backend = "sql"
+		c.Data.SQLDSN = filepath.Join(dir, "ftpdts.sqlite")
+	}
+	a := newTestServer(t, sqlData)
+	defer a.close()
+	b := newTestServer(t, sqlData)
+	defer b.close()
+
+	uid := a.post(`{"Title": "Burn after reading"}`, "ttl=0&maxDownloads=1")
+	if f, err := b.download("/" + uid + ".html"); err != nil || f != "<title>Burn after reading</title>" {
+		t.Fatalf("the data hasn't been downloaded from another replica: %q, %v", f, err)
+	}
+	if _, err := a.download("/" + uid + ".html"); err == nil {
+		t.Errorf("the data has been downloaded twice")
+	}
+
+	uid = a.post(`{"Title": "Not yet"}`, "ttl=0&notBefore="+time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	if _, err := b.download("/" + uid + ".html"); err == nil {
+		t.Errorf("the data has been downloaded before notBefore by another replica")
+	}
+}
+
+func TestIntegrationRestart(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	persistent := ts.post(`{"Title": "Persistent"}`, "ttl=0")
+	cached := ts.post(`{"Title": "Cached"}`, "")
+
+	ts.stop()
+	ts.start()
+
+	if f, err := ts.download("/" + persistent + ".html"); err != nil || f != "<title>Persistent</title>" {
+		t.Errorf("the persistent data hasn't survived the restart: %q, %v", f, err)
+	}
+	if _, err := ts.download("/" + cached + ".html"); err == nil {
+		t.Errorf("the data cached in the memory has survived the restart")
+	}
+}
+
+//the download statistics of the deleted and expired data are dropped from the audit storage
+func TestIntegrationAuditForget(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.HTTP.APIKeys = "key"
+	})
+	defer ts.close()
+
+	deleted, expired := ts.post(`{"Title": "Deleted"}`, ""), ts.post(`{"Title": "Expired"}`, "ttl=1")
+	for _, uid := range []string{deleted, expired} {
+		if _, err := ts.download("/" + uid + ".html"); err != nil {
+			t.Fatalf("can't download the file: %v", err)
+		}
+		if downloads, _, _, _ := ts.server.audit.Stats(uid); downloads != 1 {
+			t.Fatalf("the download hasn't been audited: %d", downloads)
+		}
+	}
+
+	if code := ts.request(http.MethodDelete, "/data?uid="+deleted, "key"); code != 0 {
+		t.Fatalf("the data hasn't been deleted: %d", code)
+	}
+	ts.clock.Add(time.Second)
+	if _, err := ts.download("/" + expired + ".html"); err == nil {
+		t.Fatalf("the expired file has been downloaded")
+	}
+	for _, uid := range []string{deleted, expired} {
+		if downloads, _, _, _ := ts.server.audit.Stats(uid); downloads != 0 {
+			t.Errorf("the download statistics of %s haven't been dropped: %d", uid, downloads)
+		}
+	}
+}
+
+//the idle ftp session is closed on stop
+func TestIntegrationStopSessions(t *testing.T) {
+	ts := newTestServer(t)
+	defer func() { _ = os.RemoveAll(ts.dir) }()
+
+	c, err := dialFTP(ts.ftpAddr)
+	if err != nil {
+		t.Fatalf("can't open the ftp session: %v", err)
+	}
+	defer c.close()
+	if _, err := c.cmd(200, "NOOP"); err != nil {
+		t.Fatalf("the session isn't alive: %v", err)
+	}
+
+	ts.stop()
+	_, _ = fmt.Fprintf(c.conn, "NOOP\r\n")
+	if r, err := c.reply(200); err == nil {
+		t.Errorf("the session is alive after stop: %s", r)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Errorf("the session hasn't been closed on stop: %v", err)
+	}
+}
+
+func TestIntegrationWebhook(t *testing.T) {
+	received := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(webhook.SignatureHeader) != "sha256="+webhook.Sign([]byte("secret"), req.Header.Get(webhook.TimestampHeader), body) {
+			res.WriteHeader(http.StatusForbidden)
+			return
+		}
+		var e webhook.Event
+		_ = json.Unmarshal(body, &e)
+		received <- e
+	}))
+	defer receiver.Close()
+
+	ts := newTestServer(t, func(c *Config) {
+		c.HTTP.APIKeys = "key"
+		c.Webhook.URL = receiver.URL
+		c.Webhook.Secret = "secret"
+		c.Webhook.QueuePath = filepath.Join(c.Data.Path, "..", "webhooks")
+	})
+	defer ts.close()
+
+	uid := ts.post(`{"Title": "Webhook"}`, "")
+	//only the first download is reported
+	for i := 0; i < 2; i++ {
+		if _, err := ts.download("/test/" + uid + ".html"); err != nil {
+			t.Fatalf("can't download the file: %v", err)
+		}
+	}
+	if code := ts.request(http.MethodDelete, "/data?uid="+uid, ""); code != 13 {
+		t.Errorf("the data has been deleted without the API key: %d", code)
+	}
+	if code := ts.request(http.MethodDelete, "/data?uid="+uid, "key"); code != 0 {
+		t.Errorf("the data hasn't been deleted: %d", code)
+	}
+	if _, err := ts.download("/" + uid + ".html"); err == nil {
+		t.Errorf("the deleted file has been downloaded")
+	}
+
+	expiring := ts.post(`{"Title": "Expiring"}`, "ttl=1")
+	ts.clock.Add(time.Second)
+	if _, err := ts.download("/" + expiring + ".html"); err == nil {
+		t.Errorf("the expired file has been downloaded")
+	}
+
+	//the first download of the persistent data isn't reported again after the restart, though the audit is in the memory
+	persistent := ts.post(`{"Title": "Persistent"}`, "ttl=0")
+	if _, err := ts.download("/" + persistent + ".html"); err != nil {
+		t.Fatalf("can't download the file: %v", err)
+	}
+	ts.stop()
+	ts.start()
+	if _, err := ts.download("/" + persistent + ".html"); err != nil {
+		t.Fatalf("can't download the file after the restart: %v", err)
+	}
+
+	expected := []webhook.Event{
+		{Type: webhook.Created, UID: uid},
+		{Type: webhook.Downloaded, UID: uid, Template: "test", ClientIP: "127.0.0.1"},
+		{Type: webhook.Deleted, UID: uid},
+		{Type: webhook.Created, UID: expiring},
+		{Type: webhook.Expired, UID: expiring},
+		{Type: webhook.Created, UID: persistent},
+		{Type: webhook.Downloaded, UID: persistent, Template: "default", ClientIP: "127.0.0.1"},
+	}
+	//the event delivered before the stop can be delivered again after the start, the repeated deliveries are skipped by the id
+	delivered := make(map[string]bool)
+	next := func(timeout time.Duration) (webhook.Event, bool) {
+		for {
+			select {
+			case e := <-received:
+				if !delivered[e.ID] {
+					delivered[e.ID] = true
+					return e, true
+				}
+			case <-time.After(timeout):
+				return webhook.Event{}, false
+			}
+		}
+	}
+	for _, ex := range expected {
+		e, ok := next(time.Second * 5)
+		if !ok {
+			t.Fatalf("the %s event hasn't been delivered", ex.Type)
+		}
+		if e.Type != ex.Type || e.UID != ex.UID || e.Template != ex.Template || e.ClientIP != ex.ClientIP {
+			t.Errorf("wrong event %+v, expected %+v", e, ex)
+		}
+	}
+	if e, ok := next(time.Millisecond * 200); ok {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestIntegrationEvents(t *testing.T) {
+	ts := newTestServer(t, func(c *Config) {
+		c.HTTP.APIKeys = "key"
+	})
+	defer ts.close()
+
+	if code := ts.request(http.MethodGet, "/events", ""); code != 13 {
+		t.Errorf("the event stream has been opened without the API key: %d", code)
+	}
+	all := ts.events("")
+	defer all.close()
+	byTemplate := ts.events("template=test")
+	defer byTemplate.close()
+
+	uid := ts.post(`{"Title": "Events"}`, "")
+	byUID := ts.events("uid=" + uid)
+	defer byUID.close()
+
+	if _, err := ts.download("/test/" + uid + ".html"); err != nil {
+		t.Fatalf("can't download the file: %v", err)
+	}
+	if _, err := ts.download("/broken/" + uid + ".html"); err == nil {
+		t.Errorf("the file of the broken template has been downloaded")
+	}
+	//the missing data isn't a render error
+	if _, err := ts.download("/broken/" + ts.server.ug.New() + ".html"); err == nil {
+		t.Errorf("the file of the missing data has been downloaded")
+	}
+	if _, err := ts.download("/test/" + uid + ".html"); err != nil {
+		t.Fatalf("can't download the file: %v", err)
+	}
+
+	expected := []eventbus.Event{
+		{Type: eventbus.Created, UID: uid},
+		{Type: eventbus.Downloaded, UID: uid, Template: "test", Downloads: 1},
+		{Type: eventbus.RenderError, UID: uid, Template: "broken"},
+		{Type: eventbus.Downloaded, UID: uid, Template: "test", Downloads: 2},
+	}
+	check := func(name string, es *eventStream, expected []eventbus.Event) {
+		for _, ex := range expected {
+			event, e := es.next(t)
+			if event != ex.Type || e.Type != ex.Type || e.UID != ex.UID || e.Template != ex.Template || e.Downloads != ex.Downloads {
+				t.Errorf("wrong event %s of the %s stream %+v, expected %+v", event, name, e, ex)
+			}
+			if e.Type == eventbus.RenderError && e.Error == "" {
+				t.Errorf("the render error hasn't been streamed: %+v", e)
+			}
+		}
+	}
+	check("unfiltered", all, expected)
+	check("uid", byUID, expected[1:])
+	check("template", byTemplate, []eventbus.Event{expected[1], expected[3]})
+}
@@ -0,0 +1,158 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//the first file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+	listenFDsStart = 3
+
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	//the pid of the process which is being upgraded, it's set instead of LISTEN_PID which isn't known before the start
+	envUpgradePID = "FTPDTS_UPGRADE_PID"
+	//the file descriptor the upgraded process reports the readiness to
+	envUpgradeReadyFD = "FTPDTS_UPGRADE_READY_FD"
+)
+
+//Inherited are the listeners passed to the process by systemd socket activation or by the process being upgraded
+type Inherited struct {
+	FTP  net.Listener //nil if it isn't passed
+	HTTP net.Listener
+	//the upgrading process waits for the readiness, nil if the process isn't an upgrade
+	ready *os.File
+	//the pid of the upgrading process, 0 if the process isn't an upgrade
+	upgrading int
+}
+
+//returns the listeners passed to the process, they are matched to the servers by the names (ftp or http) if systemd gives them
+//(FileDescriptorName= of the socket unit), otherwise by the ports of the config
+//the environment variables are cleared, so the child processes don't inherit them
+func Inherit(config Config) (*Inherited, error) {
+	n, names, readyFD := listenFDs(os.Getenv, os.Getpid(), os.Getppid())
+	for _, env := range []string{envListenPID, envListenFDs, envListenFDNames, envUpgradePID, envUpgradeReadyFD} {
+		_ = os.Unsetenv(env)
+	}
+
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "listener")
+	}
+	in, err := inherit(config, files, names)
+	if err != nil {
+		return nil, err
+	}
+	if readyFD > 0 {
+		in.ready = os.NewFile(uintptr(readyFD), "ready")
+		in.upgrading = os.Getppid()
+	}
+	return in, nil
+}
+
+//returns the channel closed when the upgrading process has exited, nil if the process isn't an upgrade
+//the upgrading process is the parent of this one, this one is reparented when it exits
+func (in *Inherited) UpgradingExited() <-chan struct{} {
+	if in.upgrading == 0 {
+		return nil
+	}
+	exited := make(chan struct{})
+	go func() {
+		for os.Getppid() == in.upgrading {
+			time.Sleep(time.Second)
+		}
+		close(exited)
+	}()
+	return exited
+}
+
+//tells the upgrading process that this one is serving, so the upgrading one can stop
+//does nothing if the process isn't an upgrade
+func (in *Inherited) Ready() error {
+	if in.ready == nil {
+		return nil
+	}
+	defer func() {
+		_ = in.ready.Close()
+		in.ready = nil
+	}()
+	if _, err := in.ready.Write([]byte{1}); err != nil {
+		return fmt.Errorf("can't report the readiness to the upgrading process: %v", err)
+	}
+	return nil
+}
+
+//returns the number of the passed listeners, their names and the readiness file descriptor of the upgrade
+//the listeners are passed to this process if LISTEN_PID is its pid or the upgrading process is its parent
+func listenFDs(getenv func(string) string, pid int, ppid int) (n int, names []string, readyFD int) {
+	n, err := strconv.Atoi(getenv(envListenFDs))
+	if err != nil || n <= 0 {
+		return 0, nil, 0
+	}
+	upgrade := getenv(envUpgradePID) != "" && getenv(envUpgradePID) == strconv.Itoa(ppid)
+	if getenv(envListenPID) != strconv.Itoa(pid) && !upgrade {
+		return 0, nil, 0
+	}
+	if v := getenv(envListenFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	if upgrade {
+		readyFD, _ = strconv.Atoi(getenv(envUpgradeReadyFD))
+	}
+	return n, names, readyFD
+}
+
+//makes the listeners from the files, the files are closed
+func inherit(config Config, files []*os.File, names []string) (in *Inherited, err error) {
+	in = &Inherited{}
+	var listeners []net.Listener
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+		}
+	}()
+
+	for i, f := range files {
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("can't use the inherited listener %d: %v", i, err)
+		}
+		listeners = append(listeners, l)
+
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		var port uint
+		if a, ok := l.Addr().(*net.TCPAddr); ok {
+			port = uint(a.Port)
+		}
+		var dst *net.Listener
+		switch {
+		case name == "ftp", name != "http" && port == config.FTP.Port:
+			dst, name = &in.FTP, "ftp"
+		case name == "http", port == config.HTTP.Port:
+			dst, name = &in.HTTP, "http"
+		default:
+			return nil, fmt.Errorf("the inherited listener %s matches neither the ftp nor the http port", l.Addr())
+		}
+		if *dst != nil {
+			return nil, fmt.Errorf("more than one %s listener has been inherited", name)
+		}
+		*dst = l
+	}
+	return in, nil
+}
@@ -0,0 +1,250 @@
+package ftpdts
+
+import (
+	"context"
+	"ftpdts/src/storage"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenFDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		n       int
+		names   []string
+		readyFD int
+	}{
+		{"none", map[string]string{}, 0, nil, 0},
+		{"systemd", map[string]string{envListenPID: "100", envListenFDs: "2", envListenFDNames: "ftp:http"}, 2, []string{"ftp", "http"}, 0},
+		{"other process", map[string]string{envListenPID: "101", envListenFDs: "2"}, 0, nil, 0},
+		{"upgrade", map[string]string{envUpgradePID: "99", envListenFDs: "2", envUpgradeReadyFD: "5"}, 2, nil, 5},
+		{"upgrade of other process", map[string]string{envUpgradePID: "98", envListenFDs: "2", envUpgradeReadyFD: "5"}, 0, nil, 0},
+		{"wrong number", map[string]string{envListenPID: "100", envListenFDs: "x"}, 0, nil, 0},
+	}
+	for _, test := range tests {
+		n, names, readyFD := listenFDs(func(k string) string { return test.env[k] }, 100, 99)
+		if n != test.n || len(names) != len(test.names) || readyFD != test.readyFD {
+			t.Errorf("%s: wrong result: %d %v %d", test.name, n, names, readyFD)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.names[i] {
+				t.Errorf("%s: wrong names: %v", test.name, names)
+			}
+		}
+	}
+}
+
+func TestInherit(t *testing.T) {
+	//the inherited file descriptors are simulated with the files of the listeners
+	files := func(n int) (files []*os.File, ports []uint) {
+		for i := 0; i < n; i++ {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("can't listen: %v", err)
+			}
+			f, err := l.(*net.TCPListener).File()
+			if err != nil {
+				t.Fatalf("can't get the listener file: %v", err)
+			}
+			_ = l.Close()
+			files = append(files, f)
+			ports = append(ports, uint(l.Addr().(*net.TCPAddr).Port))
+		}
+		return
+	}
+	port := func(l net.Listener) uint {
+		if l == nil {
+			return 0
+		}
+		return uint(l.Addr().(*net.TCPAddr).Port)
+	}
+	closeAll := func(in *Inherited) {
+		if in.FTP != nil {
+			_ = in.FTP.Close()
+		}
+		if in.HTTP != nil {
+			_ = in.HTTP.Close()
+		}
+	}
+
+	//matched by the ports of the config
+	f, ports := files(2)
+	config := Config{}
+	config.HTTP.Port, config.FTP.Port = ports[0], ports[1]
+	in, err := inherit(config, f, nil)
+	if err != nil {
+		t.Fatalf("can't inherit the listeners: %v", err)
+	}
+	if port(in.HTTP) != ports[0] || port(in.FTP) != ports[1] {
+		t.Errorf("the listeners are matched wrong: %d %d", port(in.HTTP), port(in.FTP))
+	}
+	closeAll(in)
+
+	//the names win over the ports
+	f, ports = files(2)
+	in, err = inherit(Config{}, f, []string{"http", "ftp"})
+	if err != nil {
+		t.Fatalf("can't inherit the listeners: %v", err)
+	}
+	if port(in.HTTP) != ports[0] || port(in.FTP) != ports[1] {
+		t.Errorf("the listeners are matched wrong: %d %d", port(in.HTTP), port(in.FTP))
+	}
+	//the inherited listener accepts the connections
+	addr := in.FTP.Addr().String()
+	go func() {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			_ = c.Close()
+		}
+	}()
+	if c, err := in.FTP.Accept(); err != nil {
+		t.Errorf("the inherited listener doesn't accept: %v", err)
+	} else {
+		_ = c.Close()
+	}
+	closeAll(in)
+
+	//only one of the listeners is inherited
+	f, ports = files(1)
+	config.FTP.Port = ports[0]
+	in, err = inherit(config, f, []string{"unknown"})
+	if err != nil || port(in.FTP) != ports[0] || in.HTTP != nil {
+		t.Errorf("the ftp listener hasn't been inherited: %v", err)
+	}
+	closeAll(in)
+
+	f, _ = files(1)
+	if _, err = inherit(Config{}, f, nil); err == nil {
+		t.Errorf("the listener of the unknown port has been inherited")
+	}
+	f, _ = files(2)
+	if _, err = inherit(Config{}, f, []string{"ftp", "ftp"}); err == nil {
+		t.Errorf("two ftp listeners have been inherited")
+	}
+}
+
+const envTestUpgrade = "FTPDTS_TEST_UPGRADE"
+
+//the new process of the upgrade test, it serves one connection of the inherited http listener
+func TestUpgradeProcess(t *testing.T) {
+	mode := os.Getenv(envTestUpgrade)
+	if mode == "" {
+		t.Skip("it's the process started by TestUpgrade")
+	}
+	if mode == "fail" {
+		os.Exit(1)
+	}
+	in, err := Inherit(Config{})
+	if err != nil || in.FTP == nil || in.HTTP == nil || os.Getenv(envListenFDs) != "" {
+		os.Exit(2)
+	}
+	if err := in.Ready(); err != nil {
+		os.Exit(3)
+	}
+	c, err := in.HTTP.Accept()
+	if err != nil {
+		os.Exit(4)
+	}
+	_, _ = c.Write([]byte("upgraded"))
+	_ = c.Close()
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("can't listen: %v", err)
+		}
+		return l
+	}
+	s := &Server{ftpListener: listen(), httpListener: listen(), logger: log.New(ioutil.Discard, "", 0)}
+	defer func() {
+		_ = s.ftpListener.Close()
+		_ = s.httpListener.Close()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	args := []string{"-test.run=^TestUpgradeProcess$"}
+
+	//the new process which fails isn't the upgrade
+	_ = os.Setenv(envTestUpgrade, "fail")
+	if err := s.upgrade(ctx, os.Args[0], args); err == nil {
+		t.Errorf("the failed process has been reported as ready")
+	}
+
+	_ = os.Setenv(envTestUpgrade, "serve")
+	defer func() { _ = os.Unsetenv(envTestUpgrade) }()
+	if err := s.upgrade(ctx, os.Args[0], args); err != nil {
+		t.Fatalf("can't upgrade: %v", err)
+	}
+
+	//the old process stops accepting, the new one serves the same port
+	addr := s.httpListener.Addr().String()
+	_ = s.httpListener.Close()
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("the port isn't served after the upgrade: %v", err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(time.Second * 5))
+	b, err := ioutil.ReadAll(c)
+	if err != nil || string(b) != "upgraded" {
+		t.Errorf("the connection hasn't been served by the new process: %q, %v", b, err)
+	}
+}
+
+//the upgrade is refused if the new process can't share the data with this one
+func TestUpgradeRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	bolt, err := storage.NewBoltDataStorage(filepath.Join(dir, "ftpdts.db"))
+	if err != nil {
+		t.Fatalf("can't open the bolt storage: %v", err)
+	}
+	defer func() { _ = bolt.Close() }()
+	s := &Server{persistent: bolt, logger: log.New(ioutil.Discard, "", 0)}
+	s.config.Data.PersistTTL = true
+	if err := s.Upgrade(context.Background()); err == nil || !strings.Contains(err.Error(), "bolt") {
+		t.Errorf("the upgrade with the bolt backend hasn't been refused: %v", err)
+	}
+
+	s = &Server{cache: storage.NewMemoryDataStorage(0, 0), logger: log.New(ioutil.Discard, "", 0)}
+	if err := s.upgradable(); err == nil {
+		t.Errorf("the upgrade with the data stored with ttl only in the memory hasn't been refused")
+	}
+	s.config.Data.PersistTTL = true
+	if err := s.upgradable(); err != nil {
+		t.Errorf("the upgrade with the persistent ttl data has been refused: %v", err)
+	}
+}
+
+//the exit of the upgrading process is noticed by the change of the parent
+func TestUpgradingExited(t *testing.T) {
+	if exited := (&Inherited{}).UpgradingExited(); exited != nil {
+		t.Errorf("the exit is watched without the upgrade")
+	}
+
+	select {
+	case <-(&Inherited{upgrading: os.Getppid()}).UpgradingExited():
+		t.Errorf("the running parent has been reported as exited")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	select {
+	case <-(&Inherited{upgrading: os.Getppid() + 1}).UpgradingExited():
+	case <-time.After(time.Second * 5):
+		t.Errorf("the exit of the upgrading process hasn't been reported")
+	}
+}
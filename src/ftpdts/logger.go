@@ -0,0 +1,79 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+//logOutput is the log writer which can be switched to another file while the logger is used
+type logOutput struct {
+	mu sync.Mutex
+	wr io.Writer
+	f  *os.File
+}
+
+func (o *logOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.wr.Write(p)
+}
+
+func logInit(filename string, console bool) *log.Logger {
+	var f *os.File
+	var err error
+
+	if filename != "" {
+		f, err = openLog(filename)
+		if err != nil {
+			fmt.Printf("Can't open the log file: %v\n", err)
+			console = true
+		}
+	}
+
+	return log.New(&logOutput{wr: logWriter(f, console), f: f}, "", log.LstdFlags)
+}
+
+//reopens the log file of the logger created with logInit, the file can be moved away by logrotate or changed in the config
+//the logger keeps writing into the old file if the new one can't be opened
+func logReopen(l *log.Logger, filename string, console bool) error {
+	o, ok := l.Writer().(*logOutput)
+	if !ok {
+		return fmt.Errorf("the logger can't be reopened")
+	}
+
+	var f *os.File
+	if filename != "" {
+		var err error
+		if f, err = openLog(filename); err != nil {
+			return fmt.Errorf("can't open the log file: %v", err)
+		}
+	}
+
+	o.mu.Lock()
+	old := o.f
+	o.wr, o.f = logWriter(f, console), f
+	o.mu.Unlock()
+
+	if old != nil {
+		_ = old.Close()
+	}
+	return nil
+}
+
+func openLog(filename string) (*os.File, error) {
+	return os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm) // #nosec G304
+}
+
+func logWriter(f *os.File, console bool) io.Writer {
+	if console {
+		return io.MultiWriter(os.Stdout, f)
+	}
+	return f
+}
@@ -0,0 +1,203 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"ftpdts/src/clock"
+	"ftpdts/src/ratelimit"
+	"ftpdts/src/webserver"
+	"github.com/starshiptroopers/ftpdt/tmplstorage"
+	"html/template"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//config fields applied while the server is running, changes of other fields need restart
+var reloadable = map[string]bool{
+	"logs.ftp":                true,
+	"logs.ftpNoConsole":       true,
+	"logs.http":               true,
+	"logs.httpNoConsole":      true,
+	"logs.ftpdts":             true,
+	"logs.ftpdtsNoConsole":    true,
+	"ftp.debugMode":           true,
+	"cache.dataTTL":           true,
+	"http.apiKeys":            true,
+	"http.authRead":           true,
+	"http.rateLimit":          true,
+	"http.rateBurst":          true,
+	"http.keyRateLimit":       true,
+	"http.keyRateBurst":       true,
+	"http.dailyQuota":         true,
+	"http.tlsCert":            true,
+	"http.tlsKey":             true,
+	"templates.path":          true,
+	"shutdown.drainTimeout":   true,
+	"shutdown.readinessDelay": true,
+}
+
+//templates is the template storage which can be switched to another folder while the server is running
+type templates struct {
+	mu   sync.RWMutex
+	ts   *tmplstorage.TemplateStorage
+	path string
+}
+
+func newTemplates(path string) *templates {
+	return &templates{ts: tmplstorage.New(path), path: path}
+}
+
+func (t *templates) Template(id string) (*template.Template, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ts.Template(id)
+}
+
+//switches to the templates at path, the templates are read from the files again
+func (t *templates) SetPath(path string) {
+	ts := tmplstorage.New(path)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ts, t.path = ts, path
+}
+
+func (t *templates) Path() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.path
+}
+
+//applies the config to the running server, the running config is kept if the config is wrong
+//the reloadable settings are applied live, returns the changed settings which need restart
+func (s *Server) Reload(c Config) (restart []string, err error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//http can't be switched between http and https without restart
+	if (c.HTTP.TLSCert == "") != (s.config.HTTP.TLSCert == "") {
+		restart = append(restart, "http.tlsCert")
+		c.HTTP.TLSCert, c.HTTP.TLSKey = s.config.HTTP.TLSCert, s.config.HTTP.TLSKey
+	}
+	diffConfig(&s.config, &c, func(name string, running reflect.Value, loaded reflect.Value) {
+		if reloadable[name] {
+			running.Set(loaded)
+		} else {
+			restart = append(restart, name)
+		}
+	})
+
+	s.apply()
+	return restart, nil
+}
+
+//applies the reloadable settings of the running config
+//the log files and the certificate are reopened even if they aren't changed, so they can be rotated or renewed
+func (s *Server) apply() {
+	c := s.config
+
+	if s.ownLogs {
+		logs := []struct {
+			logger   *log.Logger
+			filename string
+			console  bool
+		}{
+			{s.logger, c.Logs.Ftpdts, !c.Logs.FtpdtsNoConsole},
+			{s.loggerFTP, c.Logs.FTP, !c.Logs.FTPNoConsole},
+			{s.loggerHTTP, c.Logs.HTTP, !c.Logs.HTTPNoConsole},
+		}
+		for _, l := range logs {
+			if err := logReopen(l.logger, l.filename, l.console); err != nil {
+				s.logger.Printf("Can't reopen the log %s: %v", l.filename, err)
+			}
+		}
+	}
+	s.ftpDebug.SetDebug(c.FTP.DebugMode)
+
+	if s.fileTemplates != nil && s.fileTemplates.Path() != c.Templates.Path {
+		s.fileTemplates.SetPath(c.Templates.Path)
+	}
+
+	s.web.SetDefaultTTL(time.Second * time.Duration(c.Cache.DataTTL))
+	s.web.SetAPIKeys(splitList(c.HTTP.APIKeys), c.HTTP.AuthRead)
+	s.web.SetLimiters(s.limiters())
+	if c.HTTP.TLSCert != "" {
+		if err := s.web.LoadCertificate(c.HTTP.TLSCert, c.HTTP.TLSKey); err != nil {
+			s.logger.Printf("Can't reload the certificate, the previous one is used: %v", err)
+		}
+	}
+}
+
+//returns the web api rate limiters of the running config, nil means unlimited
+//the existing limiters are changed, so the clients keep their buckets
+func (s *Server) limiters() (ipLimiter webserver.Limiter, keyLimiter webserver.Limiter, keyQuota webserver.Limiter) {
+	c := s.config.HTTP
+
+	s.ipLimiter = setLimiter(s.ipLimiter, c.RateLimit, c.RateBurst, s.clock)
+	if s.ipLimiter != nil {
+		ipLimiter = s.ipLimiter
+	}
+	s.keyLimiter = setLimiter(s.keyLimiter, c.KeyRateLimit, c.KeyRateBurst, s.clock)
+	if s.keyLimiter != nil {
+		keyLimiter = s.keyLimiter
+	}
+
+	switch {
+	case c.DailyQuota == 0:
+		s.keyQuota = nil
+	case s.keyQuota == nil:
+		s.keyQuota = ratelimit.NewQuota(c.DailyQuota, s.clock)
+	default:
+		s.keyQuota.SetLimit(c.DailyQuota)
+	}
+	if s.keyQuota != nil {
+		keyQuota = s.keyQuota
+	}
+	return
+}
+
+func setLimiter(l *ratelimit.Limiter, rate float64, burst uint, clock clock.Clock) *ratelimit.Limiter {
+	switch {
+	case rate <= 0:
+		return nil
+	case l == nil:
+		return ratelimit.NewLimiter(rate, burst, clock)
+	}
+	l.SetRate(rate, burst)
+	return l
+}
+
+//calls f for every config field which differs in the running and the loaded configs
+//the field is named as in the config file: section.field
+func diffConfig(running *Config, loaded *Config, f func(name string, running reflect.Value, loaded reflect.Value)) {
+	rv, lv := reflect.ValueOf(running).Elem(), reflect.ValueOf(loaded).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		section := configName(rv.Type().Field(i).Name)
+		rs, ls := rv.Field(i), lv.Field(i)
+		for j := 0; j < rs.NumField(); j++ {
+			if !reflect.DeepEqual(rs.Field(j).Interface(), ls.Field(j).Interface()) {
+				f(section+"."+configName(rs.Type().Field(j).Name), rs.Field(j), ls.Field(j))
+			}
+		}
+	}
+}
+
+//returns the config file name of the field: HTTP - http, APIKeys - apiKeys, FTPNoConsole - ftpNoConsole
+func configName(field string) string {
+	r := []rune(field)
+	for i := range r {
+		if !unicode.IsUpper(r[i]) || (i > 0 && i+1 < len(r) && unicode.IsLower(r[i+1])) {
+			break
+		}
+		r[i] = unicode.ToLower(r[i])
+	}
+	return string(r)
+}
@@ -0,0 +1,92 @@
+package ftpdts
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	filename := filepath.Join(dir, "ftpdts.ini")
+	load := func(content string) *Config {
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatalf("can't write the config file: %v", err)
+		}
+		c, err := LoadConfig(filename)
+		if err != nil {
+			t.Fatalf("can't load the config: %v", err)
+		}
+		return c
+	}
+	common := "[data]\npath = " + dir + "\n[templates]\npath = " + dir + "\n"
+
+	s, err := New(*load(common + "[logs]\nftpdts = " + filepath.Join(dir, "1.log") + "\nftpdtsNoConsole = true\n" +
+		"ftp = \nftpNoConsole = true\nhttp = \nhttpNoConsole = true\n[ftp]\nport = 2100\n"))
+	if err != nil {
+		t.Fatalf("can't create the server: %v", err)
+	}
+	defer func() { _ = s.Stop(context.Background()) }()
+
+	restart, err := s.Reload(*load("[logs]\nftpdts = " + filepath.Join(dir, "2.log") + "\nftpdtsNoConsole = true\n" +
+		"ftp = \nftpNoConsole = true\nhttp = \nhttpNoConsole = true\n[ftp]\nport = 2200\n" +
+		"[http]\nrateLimit = 5\napiKeys = k1\n[cache]\ndataTTL = 60\n[templates]\npath = ./other\n[data]\npath = " + dir + "\n"))
+	if err != nil {
+		t.Fatalf("can't reload the config: %v", err)
+	}
+	if len(restart) != 1 || restart[0] != "ftp.port" {
+		t.Errorf("wrong settings need restart: %v", restart)
+	}
+	config := s.Config()
+	if config.FTP.Port != 2100 {
+		t.Errorf("the setting which needs restart has been applied")
+	}
+	if config.HTTP.RateLimit != 5 || config.HTTP.APIKeys != "k1" || config.Cache.DataTTL != 60 {
+		t.Errorf("the reloadable settings haven't been applied: %+v", config.HTTP)
+	}
+	if s.ipLimiter == nil {
+		t.Errorf("the rate limiter hasn't been created")
+	}
+	if s.fileTemplates.Path() != "./other" {
+		t.Errorf("the template path hasn't been changed: %s", s.fileTemplates.Path())
+	}
+
+	s.Logger().Printf("after reload")
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "2.log")); !strings.Contains(string(b), "after reload") {
+		t.Errorf("the log hasn't been reopened: %q", b)
+	}
+
+	//the running config is kept if the config is wrong
+	wrong := config
+	wrong.HTTP.Port, wrong.HTTP.RateLimit = wrong.FTP.Port, 1
+	if _, err := s.Reload(wrong); err == nil {
+		t.Errorf("the wrong config has been applied")
+	}
+	if s.Config().HTTP.RateLimit != 5 {
+		t.Errorf("the running config has been changed")
+	}
+}
+
+func TestConfigName(t *testing.T) {
+	names := map[string]string{
+		"HTTP":         "http",
+		"APIKeys":      "apiKeys",
+		"FTPNoConsole": "ftpNoConsole",
+		"DataTTL":      "dataTTL",
+		"Port":         "port",
+	}
+	for field, name := range names {
+		if n := configName(field); n != name {
+			t.Errorf("wrong config name of %s: %s", field, n)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//ftpdts server which can be embedded into another service: the ftp server producing the files from the templates filled with the data
+//and the web api to store the data
+//
+//	usage example:
+//
+//		config, err := ftpdts.LoadConfig("ftpdts.ini")
+//		...
+//		s, err := ftpdts.New(*config, ftpdts.WithLogger(logger))
+//		...
+//		if err := s.Start(ctx); err != nil {
+//			...
+//		}
+//		defer s.Stop(ctx)
+//		select {
+//		case <-s.Done(): //the ftp or the web server has failed, s.Err() tells why
+//		case <-ctx.Done():
+//		}
+package ftpdts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ftpdts/src/audit"
+	"ftpdts/src/clock"
+	"ftpdts/src/eventbus"
+	"ftpdts/src/ftpserver"
+	"ftpdts/src/ratelimit"
+	"ftpdts/src/signer"
+	"ftpdts/src/storage"
+	"ftpdts/src/webhook"
+	"ftpdts/src/webserver"
+	"github.com/starshiptroopers/ftpdt"
+	"github.com/starshiptroopers/ftpdt/ftp"
+	"github.com/starshiptroopers/uidgenerator"
+	"goftp.io/server/core"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Option changes the default parts of the server created from the config
+type Option func(s *Server)
+
+//all logs are written to the logger instead of the log files of the config
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger, s.loggerFTP, s.loggerHTTP = logger, logger, logger
+	}
+}
+
+//the data cache is used instead of the [cache] backend, it isn't closed by the server
+func WithCacheStorage(cache storage.Storage) Option {
+	return func(s *Server) {
+		s.cache = cache
+	}
+}
+
+//the persistent data storage is used instead of the [data] backend, it isn't closed by the server
+func WithPersistentStorage(persistent storage.PersistentStorage) Option {
+	return func(s *Server) {
+		s.persistent = persistent
+	}
+}
+
+//the download audit storage is used instead of the [audit] backend, it isn't closed by the server
+func WithAuditStorage(audit audit.Storage) Option {
+	return func(s *Server) {
+		s.audit = audit
+	}
+}
+
+//the templates are taken from the source instead of the [templates] folder
+func WithTemplates(templates ftp.TemplateStorage) Option {
+	return func(s *Server) {
+		s.templates = templates
+	}
+}
+
+//the clock of the rate limits, quotas, bans and the expiry of the data in the memory cache
+func WithClock(clock clock.Clock) Option {
+	return func(s *Server) {
+		s.clock = clock
+	}
+}
+
+//the servers accept the connections from the listeners instead of listening to the ports of the config
+//the listeners are closed on stop, nil listener means the port of the config is listened to
+func WithListeners(ftp net.Listener, http net.Listener) Option {
+	return func(s *Server) {
+		s.ftpListener, s.httpListener = ftp, http
+	}
+}
+
+//Server is the ftp server and the web api sharing the data storage
+type Server struct {
+	mu     sync.Mutex
+	config Config
+
+	logger     *log.Logger
+	loggerFTP  *log.Logger
+	loggerHTTP *log.Logger
+	ownLogs    bool //the loggers are created from the config, they are reopened on reload
+
+	templates     ftp.TemplateStorage
+	fileTemplates *templates //the templates of the config folder, nil if the templates are injected
+	cache         storage.Storage
+	persistent    storage.PersistentStorage
+	audit         audit.Storage
+	closers       []io.Closer //the storages created by the server
+	clock         clock.Clock
+
+	ug        *uidgenerator.UIDGenerator
+	rules     rulesStorage
+	ds        *storage.DataStorage
+	ftpd      *ftpdt.Ftpdt
+	ftpDebug  *ftpserver.DebugLogger
+	ftpLimits ftpserver.Limits
+	bans      *ftpserver.BanList
+	transfers *ftpserver.Transfers
+	web       *webserver.WebServer
+	bus       *eventbus.Bus
+	webhook   *webhook.Sender //nil if the webhooks are disabled
+
+	ftpListener  net.Listener //injected or bound on start, they are passed to the upgraded process
+	httpListener net.Listener
+	ftpServing   *ftpserver.Listener //the listener the ftp server accepts from, it's closed on stop with the open sessions
+
+	stopping int32         //the serve errors are expected while stopping
+	done     chan struct{} //closed when one of the servers has failed
+	err      error         //the failure, guarded by mu
+
+	ipLimiter  *ratelimit.Limiter
+	keyLimiter *ratelimit.Limiter
+	keyQuota   *ratelimit.Quota
+
+	stopSweeper chan struct{}
+	sweeperDone chan struct{}
+}
+
+//creates the server from the config, the parts which aren't given with the options are created as the config says
+func New(config Config, opts ...Option) (s *Server, err error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	s = &Server{config: config, clock: clock.System, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(s)
+	}
+	defer func() {
+		if err != nil {
+			s.close()
+		}
+	}()
+
+	if s.logger == nil {
+		s.logger = logInit(config.Logs.Ftpdts, !config.Logs.FtpdtsNoConsole)
+		s.loggerFTP = logInit(config.Logs.FTP, !config.Logs.FTPNoConsole)
+		s.loggerHTTP = logInit(config.Logs.HTTP, !config.Logs.HTTPNoConsole)
+		s.ownLogs = true
+	}
+
+	s.ug = newUIDGenerator(config)
+	cacheTTL := time.Second * time.Duration(config.Cache.DataTTL)
+
+	s.bus = eventbus.New(int(config.HTTP.EventsBuffer))
+	if config.Webhook.URL != "" {
+		if s.webhook, err = newWebhookSender(config, s.logger); err != nil {
+			return nil, err
+		}
+		s.own(s.webhook)
+		s.bus.Handle(webhookHandler(s.webhook))
+	}
+
+	if s.templates == nil {
+		s.fileTemplates = newTemplates(config.Templates.Path)
+		s.templates = s.fileTemplates
+	}
+	if s.cache == nil {
+		if s.cache, err = newCacheStorage(config, s.clock, s.logger); err != nil {
+			return nil, fmt.Errorf("can't initialize the data cache storage: %v", err)
+		}
+		if mds, ok := s.cache.(*storage.MemoryDataStorage); ok {
+			mds.Expired = s.expired
+		}
+		s.own(s.cache)
+	}
+	if s.persistent == nil {
+		if s.persistent, err = newPersistentStorage(config, config.Data.Backend, s.ug, s.logger); err != nil {
+			return nil, fmt.Errorf("can't initialize the data persistent storage: %v", err)
+		}
+		s.own(s.persistent)
+	}
+	if s.audit == nil {
+		if s.audit, err = newAuditStorage(config); err != nil {
+			return nil, fmt.Errorf("can't initialize the audit storage: %v", err)
+		}
+		s.own(s.audit)
+	}
+	s.bus.Handle(auditHandler(s.audit))
+
+	if s.rules, err = newRulesStorage(config, s.persistent, s.ug); err != nil {
+		return nil, fmt.Errorf("can't initialize the download rules storage: %v", err)
+	}
+	s.own(s.rules)
+
+	//the data missed in the cache is read from the persistent storage
+	s.ds = storage.NewDataStorage(s.cache, s.persistent)
+	s.ds.PersistTTL = config.Data.PersistTTL
+	s.ds.DefaultTTL = cacheTTL
+
+	s.newFTPServer()
+	s.newWebServer()
+	return s, nil
+}
+
+func (s *Server) newFTPServer() {
+	config := s.config
+
+	ftpOpts := &core.ServerOpts{
+		Port:         int(config.FTP.Port),
+		Hostname:     config.FTP.Host,
+		PassivePorts: config.FTP.PassivePorts,
+		PublicIP:     config.FTP.PublicIP,
+	}
+	//the ftp commands are logged in the debug mode, it can be switched with the config reload
+	s.ftpDebug = ftpserver.NewDebugLogger(ftp.NewDefaultFTPLogger(s.loggerFTP.Writer()), config.FTP.DebugMode)
+	ftpOpts.Logger = s.ftpDebug
+	driverFactory := ftpserver.NewDriverFactory(
+		ftp.NewDriverFactory(s.templates, s.ds, s.ug, s.loggerFTP),
+		s.ug,
+		s.rules,
+		s.loggerFTP,
+	)
+	driverFactory.TransferTimeout = time.Second * time.Duration(config.FTP.TransferTimeout)
+	s.transfers = ftpserver.NewTransfers()
+	driverFactory.Transfers = s.transfers
+	driverFactory.Failed = s.renderFailed
+	if config.Sign.Secret != "" {
+		driverFactory.Signer = signer.New(config.Sign.Secret)
+		driverFactory.RequireSignature = config.Sign.Required
+	}
+	ftpOpts.Factory = driverFactory
+
+	s.ftpd = ftpdt.New(
+		&ftpdt.Opts{
+			FtpOpts:         ftpOpts,
+			TemplateStorage: s.templates,
+			DataStorage:     s.ds,
+			UidGenerator:    s.ug,
+			LogWriter:       s.loggerFTP.Writer(),
+			LogFtpDebug:     config.FTP.DebugMode,
+		},
+	)
+
+	if config.FTP.BanMisses > 0 {
+		s.bans = ftpserver.NewBanList(
+			config.FTP.BanMisses,
+			time.Second*time.Duration(config.FTP.BanWindow),
+			time.Second*time.Duration(config.FTP.BanDuration),
+			s.clock,
+		)
+		s.bans.Logger = s.loggerFTP
+		s.ftpd.RegisterNotifer(ftpserver.NewBanNotifier(s.bans))
+	}
+	s.ftpLimits = ftpserver.Limits{
+		MaxConnections:      config.FTP.MaxConnections,
+		MaxConnectionsPerIP: config.FTP.MaxConnectionsPerIP,
+		RequestsPerMinute:   config.FTP.RequestsPerMinute,
+		IdleTimeout:         time.Second * time.Duration(config.FTP.IdleTimeout),
+	}
+
+	s.ftpd.RegisterNotifer(ftpserver.NewDownloadNotifier(s.ug, func(d ftpserver.Download) {
+		err := s.audit.Add(audit.Record{
+			UID:      d.UID,
+			Template: d.Template,
+			Time:     d.Time,
+			ClientIP: d.ClientIP,
+			Bytes:    d.Bytes,
+		})
+		if err != nil {
+			s.logger.Printf("Can't store the download audit record for uid %s: %v", d.UID, err)
+			return
+		}
+		//the downloads are counted by the audit storage,
+		//the first download is marked in the rules storage, so it's the first one after the restart and for all instances too
+		downloads, _, _, _ := s.audit.Stats(d.UID)
+		first, err := s.rules.MarkDownloaded(d.UID, s.remainingTTL(d.UID))
+		if err != nil {
+			s.logger.Printf("Can't mark the first download of uid %s: %v", d.UID, err)
+		}
+		s.bus.Publish(eventbus.Event{
+			Type:      eventbus.Downloaded,
+			UID:       d.UID,
+			Time:      d.Time,
+			Template:  d.Template,
+			ClientIP:  d.ClientIP,
+			Downloads: downloads,
+			First:     first,
+		})
+	}))
+}
+
+//returns the time the data with uid is kept for, zero ttl for the persistent data, nil if the data isn't found
+func (s *Server) remainingTTL(uid string) *time.Duration {
+	_, createdAt, ttl, err := s.ds.Get(uid)
+	if err != nil {
+		return nil
+	}
+	if ttl != 0 {
+		if ttl = time.Until(createdAt.Add(ttl)); ttl <= 0 {
+			return nil
+		}
+	}
+	return &ttl
+}
+
+func (s *Server) newWebServer() {
+	config := s.config
+
+	var metrics []webserver.Metrics
+	if m, ok := s.cache.(webserver.Metrics); ok {
+		metrics = append(metrics, m)
+	}
+
+	webOpts := webserver.Opts{
+		Port:           config.HTTP.Port,
+		Host:           config.HTTP.Host,
+		DataStorage:    s.ds,
+		RulesStorage:   s.rules,
+		AuditStorage:   s.audit,
+		Metrics:        metrics,
+		APIKeys:        splitList(config.HTTP.APIKeys),
+		AuthRead:       config.HTTP.AuthRead,
+		LinkTTL:        time.Second * time.Duration(config.Sign.LinkTTL),
+		DefaultTTL:     time.Second * time.Duration(config.Cache.DataTTL),
+		TLSCert:        config.HTTP.TLSCert,
+		TLSKey:         config.HTTP.TLSKey,
+		Events:         s.bus,
+		Logger:         s.loggerHTTP,
+		UIDGenerator:   s.ug,
+		MaxRequestBody: config.HTTP.MaxRequestBody,
+	}
+	if config.Sign.Secret != "" {
+		webOpts.Signer = signer.New(config.Sign.Secret)
+	}
+	webOpts.IPLimiter, webOpts.KeyLimiter, webOpts.KeyQuota = s.limiters()
+	s.web = webserver.New(webOpts)
+}
+
+//loads the persistent data into the cache if it's configured and starts the ftp and the web servers
+//the ports are bound before serving, so the bind errors are returned, ctx bounds the preload
+//the later failures of the servers are reported with Done and Err
+func (s *Server) Start(ctx context.Context) error {
+	config := s.Config()
+
+	//Load data from the persistent storage, otherwise it's read on the first request
+	if config.Cache.Preload {
+		cnt, err := preload(ctx, s.ds, s.persistent, s.rules)
+		if err != nil {
+			return fmt.Errorf("can't initialize the data persistent storage: %v", err)
+		}
+		s.logger.Printf("%d persistent data records has been loaded into the data memory cache", cnt)
+	}
+
+	if s.webhook != nil {
+		s.webhook.Start()
+	}
+
+	s.stopSweeper, s.sweeperDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		sweeper(s.persistent, s.rules, time.Second*time.Duration(config.Data.SweepInterval), s.stopSweeper, s.expired, s.logger)
+		close(s.sweeperDone)
+	}()
+
+	//the listeners are bound before serving, so the bind problems are reported right away
+	if config.HTTP.TLSCert != "" {
+		if err := s.web.LoadCertificate(config.HTTP.TLSCert, config.HTTP.TLSKey); err != nil {
+			return fmt.Errorf("can't start web server: %v", err)
+		}
+	}
+	ftpListener, err := listen(s.ftpListener, config.FTP.Host, config.FTP.Port)
+	if err != nil {
+		return fmt.Errorf("can't start ftp server: %v", err)
+	}
+	httpListener, err := listen(s.httpListener, config.HTTP.Host, config.HTTP.Port)
+	if err != nil {
+		_ = ftpListener.Close()
+		return fmt.Errorf("can't start web server: %v", err)
+	}
+
+	s.ftpListener, s.httpListener = ftpListener, httpListener
+
+	s.ftpServing = ftpserver.NewListener(ftpListener, s.ftpLimits, s.bans, s.clock, s.loggerFTP)
+	s.loggerFTP.Printf("FTP server has been started at %s", ftpListener.Addr())
+	s.serve("ftp", func() error {
+		return s.ftpd.Serve(s.ftpServing)
+	})
+	s.serve("web", func() error {
+		return s.web.Serve(httpListener)
+	})
+	return nil
+}
+
+//returns the channel which is closed when the ftp or the web server has failed after the start, the server should be stopped then
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
+//returns the failure of the ftp or the web server, nil if both are running
+func (s *Server) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+//runs the server function, the error it returns while the server isn't stopping is the failure
+func (s *Server) serve(name string, f func() error) {
+	go func() {
+		err := f()
+		if atomic.LoadInt32(&s.stopping) == 1 {
+			return
+		}
+		if err == nil {
+			err = errors.New("the server has been stopped unexpectedly")
+		}
+		s.logger.Printf("ERROR %s server has failed: %v", name, err)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err == nil {
+			s.err = fmt.Errorf("%s server has failed: %v", name, err)
+			close(s.done)
+		}
+	}()
+}
+
+//returns the injected listener or binds the address
+func listen(l net.Listener, host string, port uint) (net.Listener, error) {
+	if l != nil {
+		return l, nil
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+}
+
+//stops the servers gracefully and closes the storages created by the server
+//the readiness endpoint fails first, so the load balancer stops sending the clients before the servers stop accepting them,
+//then the ftp transfers and the http requests in progress are waited for until ctx is done
+//returns the error if the shutdown isn't clean
+func (s *Server) Stop(ctx context.Context) error {
+	var errs []error
+
+	atomic.StoreInt32(&s.stopping, 1)
+	s.web.SetReady(false)
+	select {
+	case <-time.After(time.Second * time.Duration(s.Config().Shutdown.ReadinessDelay)):
+	case <-ctx.Done():
+	}
+
+	webDone := make(chan error, 1)
+	go func() {
+		webDone <- s.web.Shutdown(ctx)
+	}()
+	//the ftp server stops accepting when its listener is closed,
+	//goftp Shutdown isn't used, it races with Serve which sets the listener of the ftp server
+	if s.ftpServing != nil {
+		if err := s.ftpServing.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("can't stop the ftp server: %v", err))
+		}
+	}
+	if err := s.transfers.Drain(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("can't finish the ftp transfers: %v", err))
+	}
+	//the idle sessions would be kept open by the clients, they are closed when the transfers are finished or the time is over
+	if s.ftpServing != nil {
+		s.ftpServing.CloseConnections()
+	}
+	if err := <-webDone; err != nil {
+		errs = append(errs, fmt.Errorf("can't finish the http requests: %v", err))
+	}
+
+	//the storages are closed when nothing writes into them anymore, so the pending writes are flushed
+	if s.stopSweeper != nil {
+		close(s.stopSweeper)
+		<-s.sweeperDone
+	}
+	//nothing publishes the events anymore, the webhook sender keeps the queued ones
+	s.bus.Close()
+	errs = append(errs, s.close()...)
+
+	for _, err := range errs {
+		s.logger.Printf("%v", err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the server has been shut down with %d errors, the first one: %v", len(errs), errs[0])
+	}
+	s.logger.Printf("The server has been shut down")
+	return nil
+}
+
+//returns the running config
+func (s *Server) Config() Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config
+}
+
+//returns the logger of the server messages
+func (s *Server) Logger() *log.Logger {
+	return s.logger
+}
+
+//the storage is closed on stop
+func (s *Server) own(st interface{}) {
+	if c, ok := st.(io.Closer); ok {
+		s.closers = append(s.closers, c)
+	}
+}
+
+//closes the storages created by the server
+func (s *Server) close() (errs []error) {
+	for _, c := range s.closers {
+		if err := c.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("can't close the storage: %v", err))
+		}
+	}
+	s.closers = nil
+	return
+}
+
+func newUIDGenerator(config Config) *uidgenerator.UIDGenerator {
+	return uidgenerator.New(
+		&uidgenerator.Cfg{
+			Alfa:      config.UID.Chars,
+			Format:    config.UID.Format,
+			Validator: config.UID.ValidatorRegexp,
+		},
+	)
+}
@@ -0,0 +1,150 @@
+package ftpdts
+
+import (
+	"bytes"
+	"context"
+	"ftpdts/src/audit"
+	"ftpdts/src/storage"
+	"github.com/creasty/defaults"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var config Config
+	if err := defaults.Set(&config); err != nil {
+		t.Fatalf("can't set the config defaults: %v", err)
+	}
+	config.Data.Path = dir
+
+	wrong := config
+	wrong.HTTP.Port = wrong.FTP.Port
+	if _, err := New(wrong); err == nil {
+		t.Errorf("the server has been created with the wrong config")
+	}
+
+	persistent, err := storage.NewBoltDataStorage(filepath.Join(dir, "ftpdts.db"))
+	if err != nil {
+		t.Fatalf("can't create the persistent storage: %v", err)
+	}
+	defer func() { _ = persistent.Close() }()
+	cache := storage.NewMemoryDataStorage(0, 0)
+	auditStorage := audit.NewMemoryStorage(0)
+	var out bytes.Buffer
+
+	s, err := New(config,
+		WithLogger(log.New(&out, "", 0)),
+		WithCacheStorage(cache),
+		WithPersistentStorage(persistent),
+		WithAuditStorage(auditStorage),
+	)
+	if err != nil {
+		t.Fatalf("can't create the server: %v", err)
+	}
+	if s.cache != cache || s.persistent != persistent || s.audit != auditStorage || s.ownLogs {
+		t.Errorf("the injected parts haven't been used")
+	}
+	if len(s.closers) != 0 {
+		t.Errorf("the injected storages are closed by the server")
+	}
+
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("the server hasn't been stopped cleanly: %v", err)
+	}
+	if out.Len() == 0 {
+		t.Errorf("the server hasn't written to the injected logger")
+	}
+	//the injected storage is still open
+	if err := persistent.Put("uid", "data", nil); err != nil {
+		t.Errorf("the injected storage has been closed: %v", err)
+	}
+}
+
+func TestStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var config Config
+	if err := defaults.Set(&config); err != nil {
+		t.Fatalf("can't set the config defaults: %v", err)
+	}
+	config.Data.Path = dir
+	config.FTP.PassivePorts = ""
+
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("can't listen: %v", err)
+		}
+		return l
+	}
+
+	//the busy port is reported by start
+	busy := listen()
+	defer func() { _ = busy.Close() }()
+	config.FTP.Host = "127.0.0.1"
+	config.FTP.Port = uint(busy.Addr().(*net.TCPAddr).Port)
+	s, err := New(config, WithLogger(log.New(ioutil.Discard, "", 0)), WithListeners(nil, listen()))
+	if err != nil {
+		t.Fatalf("can't create the server: %v", err)
+	}
+	if err := s.Start(context.Background()); err == nil {
+		t.Errorf("the server has been started on the busy port")
+	}
+	_ = s.Stop(context.Background())
+
+	//the failure of the web server is reported with Done
+	httpListener := listen()
+	s, err = New(config, WithLogger(log.New(ioutil.Discard, "", 0)), WithListeners(listen(), httpListener))
+	if err != nil {
+		t.Fatalf("can't create the server: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("can't start the server: %v", err)
+	}
+	if s.Err() != nil {
+		t.Errorf("the running server has the failure: %v", s.Err())
+	}
+	_ = httpListener.Close()
+	select {
+	case <-s.Done():
+		if s.Err() == nil {
+			t.Errorf("the failure hasn't been reported")
+		}
+	case <-time.After(time.Second * 5):
+		t.Errorf("the failure of the web server hasn't been reported")
+	}
+	_ = s.Stop(context.Background())
+
+	//the servers stopped by Stop aren't failures
+	s, err = New(config, WithLogger(log.New(ioutil.Discard, "", 0)), WithListeners(listen(), listen()))
+	if err != nil {
+		t.Fatalf("can't create the server: %v", err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatalf("can't start the server: %v", err)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("the server hasn't been stopped cleanly: %v", err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if s.Err() != nil {
+		t.Errorf("the stop is reported as the failure: %v", s.Err())
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"context"
+	"fmt"
+	"ftpdts/src/audit"
+	"ftpdts/src/clock"
+	"ftpdts/src/storage"
+	"github.com/redis/go-redis/v9"
+	"github.com/starshiptroopers/uidgenerator"
+	"io"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//rewrites the persistent data files of the fs backend into the current format and layout
+//returns the number of the migrated records, the files which can't be migrated are reported to the logger
+func Migrate(config Config, logger *log.Logger) (int, error) {
+	persistentDs, err := newPersistentStorage(config, config.Data.Backend, newUIDGenerator(config), logger)
+	if err != nil {
+		return 0, fmt.Errorf("can't initialize the data persistent storage: %v", err)
+	}
+	defer closeStorage(persistentDs)
+
+	fsDs, ok := persistentDs.(*storage.FsDataStorage)
+	if !ok {
+		return 0, fmt.Errorf("migration is supported by the fs backend only")
+	}
+	n, err := fsDs.Migrate()
+	if err != nil {
+		return n, fmt.Errorf("can't migrate the persistent data: %v", err)
+	}
+	return n, nil
+}
+
+//copies the persistent data from the backend into the configured one
+//returns the number of the converted records
+func Convert(config Config, from string, logger *log.Logger) (int, error) {
+	if from == config.Data.Backend {
+		return 0, fmt.Errorf("can't convert the persistent data into the same backend: %s", from)
+	}
+	ug := newUIDGenerator(config)
+
+	to, err := newPersistentStorage(config, config.Data.Backend, ug, logger)
+	if err != nil {
+		return 0, fmt.Errorf("can't initialize the data persistent storage: %v", err)
+	}
+	defer closeStorage(to)
+	fromDs, err := newPersistentStorage(config, from, ug, logger)
+	if err != nil {
+		return 0, fmt.Errorf("can't initialize the data persistent storage: %v", err)
+	}
+	defer closeStorage(fromDs)
+
+	n, err := storage.Convert(fromDs, to)
+	if err != nil {
+		return n, fmt.Errorf("can't convert the persistent data: %v", err)
+	}
+	return n, nil
+}
+
+//removes the expired data from the persistent storage every interval until stop is closed
+//expired is called with the uids of the persistent data removed, the memory cache is swept and reports its expired data itself
+func sweeper(persistentDs storage.PersistentStorage, rules rulesStorage, interval time.Duration, stop chan struct{}, expired func(uid string), logger *log.Logger) {
+	if interval == 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		removed, err := persistentDs.Sweep()
+		if err != nil {
+			logger.Printf("Can't remove the expired persistent data: %v", err)
+		}
+
+		expiredRules, err := rules.Sweep()
+		if err != nil {
+			logger.Printf("Can't remove the expired download rules: %v", err)
+		}
+		for _, uid := range expiredRules {
+			if err := persistentDs.Delete(uid); err != nil {
+				logger.Printf("Can't remove the expired persistent data with uid %s: %v", uid, err)
+				continue
+			}
+			removed = append(removed, uid)
+		}
+
+		if len(removed) > 0 {
+			logger.Printf("%d expired persistent data records has been removed", len(removed))
+		}
+		for _, uid := range removed {
+			expired(uid)
+		}
+	}
+}
+
+//creates the persistent data storage of the backend configured in the [data] section
+func newPersistentStorage(config Config, backend string, ug *uidgenerator.UIDGenerator, logger *log.Logger) (storage.PersistentStorage, error) {
+	switch backend {
+	case "", "fs":
+		fsDs := storage.NewFsDataStorage(config.Data.Path, ug)
+		fsDs.Logger = logger
+		fsDs.ShardLevels = config.Data.ShardLevels
+		fsDs.ShardWidth = config.Data.ShardWidth
+		return fsDs, nil
+	case "bolt":
+		return storage.NewBoltDataStorage(config.Data.BoltFile)
+	case "sql":
+		return storage.NewSQLDataStorage(config.Data.SQLDriver, config.Data.SQLDSN)
+	}
+	return nil, fmt.Errorf("unknown data backend: %s", backend)
+}
+
+//loads all data from the persistent storage into the cache, returns the number of the loaded records
+//the preload is aborted when ctx is done
+func preload(ctx context.Context, ds *storage.DataStorage, persistentDs storage.PersistentStorage, rules rulesStorage) (cnt int, err error) {
+	err = persistentDs.Pass(func(uid string, createdAt time.Time, ttl time.Duration, data interface{}) {
+		if err != nil {
+			return
+		}
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		//the data with the expiry time is kept in the memory until it expires
+		if r, ok := rules.Get(uid); ok && !r.ExpiresAt.IsZero() {
+			if until := time.Until(r.ExpiresAt); ttl == 0 || until < ttl {
+				ttl = until
+			}
+			if ttl <= 0 {
+				return
+			}
+		}
+		if err = ds.Cache(uid, data, &ttl); err != nil {
+			err = fmt.Errorf("something wrong with loading persistent data into the memory cache: %v", err)
+			return
+		}
+		cnt++
+	})
+	return
+}
+
+//closes the storage if it holds a database file or a connection
+func closeStorage(s storage.Storage) {
+	if c, ok := s.(io.Closer); ok {
+		_ = c.Close()
+	}
+}
+
+//parses the comma separated list, such as the API keys
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+//rulesStorage keeps the download rules in the local files or in the redis server shared by the instances
+type rulesStorage interface {
+	Set(uid string, r storage.Rules, ttl *time.Duration) error
+	Get(uid string) (r storage.Rules, ok bool)
+	Check(uid string) error
+	Acquire(uid string) error
+	MarkDownloaded(uid string, ttl *time.Duration) (first bool, err error)
+	Delete(uid string) error
+	Sweep() (expired []string, err error)
+}
+
+//creates the download rules storage, the rules are kept in the redis server with the redis cache backend
+//or in the database with the sql data backend, so all instances sharing them enforce the same download limits
+func newRulesStorage(config Config, persistent storage.PersistentStorage, ug *uidgenerator.UIDGenerator) (rulesStorage, error) {
+	ttl := time.Second * time.Duration(config.Cache.DataTTL)
+	if config.Cache.Backend == "redis" {
+		rs := storage.NewRedisRulesStorage(&redis.Options{
+			Addr:     config.Cache.Addr,
+			Password: config.Cache.Password,
+			DB:       config.Cache.DB,
+		}, config.Cache.Prefix)
+		rs.DefaultTTL = ttl
+		return rs, nil
+	}
+	if sds, ok := persistent.(*storage.SQLDataStorage); ok {
+		rs := storage.NewSQLRulesStorage(sds)
+		rs.DefaultTTL = ttl
+		return rs, nil
+	}
+	rs := storage.NewRulesStorage(filepath.Join(config.Data.Path, ".rules"), ug)
+	rs.DefaultTTL = ttl
+	if err := rs.Load(); err != nil {
+		return nil, fmt.Errorf("can't load the download rules: %v", err)
+	}
+	return rs, nil
+}
+
+//creates the data cache storage of the backend configured in the [cache] section
+func newCacheStorage(config Config, clock clock.Clock, logger *log.Logger) (storage.Storage, error) {
+	switch config.Cache.Backend {
+	case "", "memory":
+		mds := storage.NewMemoryDataStorage(config.Cache.MaxEntries, config.Cache.MaxBytes)
+		mds.DefaultTTL = time.Second * time.Duration(config.Cache.DataTTL)
+		//the persistent data evicted from the cache is read again from the persistent storage
+		mds.Backed = true
+		mds.Logger = logger
+		mds.Clock = clock
+		mds.SweepEvery(time.Second * time.Duration(config.Cache.SweepInterval))
+		return mds, nil
+	case "redis":
+		rds := storage.NewRedisDataStorage(&redis.Options{
+			Addr:     config.Cache.Addr,
+			Password: config.Cache.Password,
+			DB:       config.Cache.DB,
+		}, config.Cache.Prefix)
+		rds.DefaultTTL = time.Second * time.Duration(config.Cache.DataTTL)
+		if err := rds.Ping(); err != nil {
+			_ = rds.Close()
+			return nil, err
+		}
+		return rds, nil
+	}
+	return nil, fmt.Errorf("unknown cache backend: %s", config.Cache.Backend)
+}
+
+//creates the download audit storage configured in the [audit] section
+func newAuditStorage(config Config) (audit.Storage, error) {
+	switch config.Audit.Backend {
+	case "", "memory":
+		return audit.NewMemoryStorage(config.Audit.MaxRecords), nil
+	case "file":
+		return audit.NewFileStorage(config.Audit.Path)
+	}
+	return nil, fmt.Errorf("unknown audit backend: %s", config.Audit.Backend)
+}
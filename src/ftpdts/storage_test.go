@@ -0,0 +1,62 @@
+package ftpdts
+
+import (
+	"ftpdts/src/storage"
+	"github.com/starshiptroopers/uidgenerator"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the persistent data expired by its download rules is removed by the sweeper and reported as expired
+func TestSweeperRulesExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ug := uidgenerator.New(nil)
+	persistentDs := storage.NewFsDataStorage(filepath.Join(dir, "data"), ug)
+	rules := storage.NewRulesStorage(filepath.Join(dir, "rules"), ug)
+	uidExpired, uidAlive := ug.New(), ug.New()
+
+	forever := time.Duration(0)
+	for uid, expiresAt := range map[string]time.Time{uidExpired: time.Now().Add(-time.Second), uidAlive: time.Now().Add(time.Hour)} {
+		if err := persistentDs.Put(uid, map[string]interface{}{"Title": uid}, &forever); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+		if err := rules.Set(uid, storage.Rules{ExpiresAt: expiresAt}, &forever); err != nil {
+			t.Fatalf("can't set the rules: %v", err)
+		}
+	}
+
+	expired := make(chan string, 2)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		sweeper(persistentDs, rules, time.Millisecond*10, stop, func(uid string) { expired <- uid }, log.New(ioutil.Discard, "", 0))
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	select {
+	case uid := <-expired:
+		if uid != uidExpired {
+			t.Errorf("wrong expired data: %s", uid)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the data expired by the rules hasn't been reported")
+	}
+	if _, _, _, err := persistentDs.Get(uidExpired); err == nil {
+		t.Errorf("the data expired by the rules hasn't been removed")
+	}
+	if _, _, _, err := persistentDs.Get(uidAlive); err != nil {
+		t.Errorf("the alive data has been removed: %v", err)
+	}
+}
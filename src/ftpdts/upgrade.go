@@ -0,0 +1,126 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpdts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ftpdts/src/storage"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+//starts the new process of the executable with the same arguments and passes the ftp and the http listeners to it,
+//returns when the new process is serving (see Inherited.Ready), so this server can be stopped gracefully
+//the new process is killed if it isn't ready until ctx is done
+//the upgrade is refused if the new process can't share the storages with this one, see upgradable
+func (s *Server) Upgrade(ctx context.Context) error {
+	if err := s.upgradable(); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("can't find the executable: %v", err)
+	}
+	return s.upgrade(ctx, exe, os.Args[1:])
+}
+
+//returns the error if the data can't be handed over to the new process:
+//the bolt database is locked by this process, the data stored with ttl only in the memory cache would be lost
+func (s *Server) upgradable() error {
+	if _, ok := s.persistent.(*storage.BoltDataStorage); ok {
+		return errors.New("the bolt database can't be opened by two processes at once, use the fs or sql data backend to upgrade")
+	}
+	if _, ok := s.cache.(*storage.MemoryDataStorage); ok && !s.Config().Data.PersistTTL {
+		return errors.New("the data stored with ttl is kept only in the memory cache of this process, " +
+			"turn persistTTL on in the [data] section or use the redis cache backend to upgrade")
+	}
+	return nil
+}
+
+//loads the download rules kept in the local files again, the upgrading process counts the downloads into them until it exits
+//the rules kept in the redis server or in the database are shared by the processes, they aren't reloaded
+func (s *Server) ReloadRules() error {
+	if rs, ok := s.rules.(*storage.RulesStorage); ok {
+		return rs.Load()
+	}
+	return nil
+}
+
+func (s *Server) upgrade(ctx context.Context, exe string, args []string) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, l := range []net.Listener{s.ftpListener, s.httpListener} {
+		f, err := listenerFile(l)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("can't create the readiness pipe: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envListenFDNames+"=ftp:http",
+		envUpgradePID+"="+strconv.Itoa(os.Getpid()),
+		envUpgradeReadyFD+"="+strconv.Itoa(listenFDsStart+len(files)),
+	)
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return fmt.Errorf("can't start the new process: %v", err)
+	}
+	s.logger.Printf("The new process %d has been started, waiting for it to be ready", cmd.Process.Pid)
+
+	//the pipe is closed without the readiness byte if the new process exits
+	ready := make(chan bool, 1)
+	go func() {
+		b := make([]byte, 1)
+		n, _ := r.Read(b)
+		ready <- n == 1
+	}()
+
+	select {
+	case ok := <-ready:
+		if ok {
+			_ = cmd.Process.Release()
+			return nil
+		}
+		_ = cmd.Wait()
+		return fmt.Errorf("the new process has exited before it's ready: %v", cmd.ProcessState)
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("the new process isn't ready: %v", ctx.Err())
+	}
+}
+
+//returns the duplicate of the listener file descriptor
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("the listener %v can't be passed to the new process", l)
+	}
+	f, err := fl.File()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the listener file: %v", err)
+	}
+	return f, nil
+}
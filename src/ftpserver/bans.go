@@ -0,0 +1,115 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"errors"
+	"ftpdts/src/clock"
+	"goftp.io/server/core"
+	"log"
+	"sync"
+	"time"
+)
+
+//BanList temporarily bans the client IPs which request unknown files too often
+//the client is banned for BanDuration after MaxMisses failed downloads within Window
+type BanList struct {
+	mu          sync.Mutex
+	clock       clock.Clock
+	misses      map[string]*misses
+	banned      map[string]time.Time //ip -> ban end
+	MaxMisses   uint
+	Window      time.Duration
+	BanDuration time.Duration
+	Logger      *log.Logger //bans are logged if it's set
+}
+
+type misses struct {
+	count uint
+	start time.Time
+}
+
+func NewBanList(maxMisses uint, window time.Duration, banDuration time.Duration, clock clock.Clock) *BanList {
+	return &BanList{
+		clock:       clock,
+		misses:      make(map[string]*misses),
+		banned:      make(map[string]time.Time),
+		MaxMisses:   maxMisses,
+		Window:      window,
+		BanDuration: banDuration,
+	}
+}
+
+//counts the failed download of the client, returns true if the client has been banned
+func (b *BanList) Miss(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	b.cleanup(now)
+
+	m, ok := b.misses[ip]
+	if !ok || now.Sub(m.start) >= b.Window {
+		m = &misses{start: now}
+		b.misses[ip] = m
+	}
+	if m.count++; m.count < b.MaxMisses {
+		return false
+	}
+
+	delete(b.misses, ip)
+	b.banned[ip] = now.Add(b.BanDuration)
+	if b.Logger != nil {
+		b.Logger.Printf("FTPDTS WARN %s has been banned for %v after %d failed downloads", ip, b.BanDuration, m.count)
+	}
+	return true
+}
+
+//returns true if the client is banned now
+func (b *BanList) Banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until, ok := b.banned[ip]
+	if ok && !b.clock.Now().Before(until) {
+		delete(b.banned, ip)
+		return false
+	}
+	return ok
+}
+
+//removes the expired bans and misses
+func (b *BanList) cleanup(now time.Time) {
+	for ip, until := range b.banned {
+		if !now.Before(until) {
+			delete(b.banned, ip)
+		}
+	}
+	for ip, m := range b.misses {
+		if now.Sub(m.start) >= b.Window {
+			delete(b.misses, ip)
+		}
+	}
+}
+
+//BanNotifier implements goftp core.Notifier and counts the failed downloads in the ban list
+//only the files which the driver hasn't produced are counted: unknown ones or with a wrong signature
+//the files the guard doesn't allow to download aren't counted, they are requested by real users,
+//the failed transfers (timeouts, dropped data connections) aren't counted too
+type BanNotifier struct {
+	core.NullNotifier
+	bans *BanList
+}
+
+func NewBanNotifier(bans *BanList) *BanNotifier {
+	return &BanNotifier{bans: bans}
+}
+
+func (n *BanNotifier) AfterFileDownloaded(conn *core.Conn, dstPath string, size int64, err error) {
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrShuttingDown) {
+		return
+	}
+	n.bans.Miss(ClientIP(conn.RemoteAddr()))
+}
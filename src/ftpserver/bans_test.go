@@ -0,0 +1,125 @@
+package ftpserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/starshiptroopers/uidgenerator"
+	"goftp.io/server/core"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//the wrapped driver which serves the endless file
+type endlessDriver struct {
+	core.Driver
+	uid string
+}
+
+func (d endlessDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	if !strings.Contains(path, d.uid) {
+		return 0, nil, errors.New("file unavailable")
+	}
+	return 1 << 40, ioutil.NopCloser(endlessReader{}), nil
+}
+
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+type endlessDriverFactory struct {
+	uid string
+}
+
+func (f endlessDriverFactory) NewDriver() (core.Driver, error) {
+	return endlessDriver{uid: f.uid}, nil
+}
+
+//the transfer timeout isn't counted as a miss, the unknown file is
+//the client stops reading the data in the middle of the transfer, so the transfer is blocked by the data connection
+func TestBanNotifier(t *testing.T) {
+	ug := uidgenerator.New(nil)
+	uid := ug.New()
+	factory := NewDriverFactory(endlessDriverFactory{uid}, ug, openGuard{}, log.New(ioutil.Discard, "", 0))
+	factory.TransferTimeout = time.Millisecond * 50
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	ftpd := core.NewServer(&core.ServerOpts{
+		Factory:  factory,
+		Auth:     &core.SimpleAuth{Name: "anonymous", Password: "anonymous"},
+		Hostname: "127.0.0.1",
+		Logger:   &core.DiscardLogger{},
+	})
+	bans := NewBanList(1, time.Minute, time.Hour, &fakeClock{time.Now()})
+	ftpd.RegisterNotifer(NewBanNotifier(bans))
+	served := make(chan struct{})
+	go func() {
+		_ = ftpd.Serve(l)
+		close(served)
+	}()
+	defer func() {
+		_ = l.Close()
+		<-served
+	}()
+
+	conn, err := net.DialTimeout("tcp", l.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("can't connect: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+	cmd := func(code string, command string) string {
+		if command != "" {
+			_, _ = fmt.Fprintf(conn, "%s\r\n", command)
+		}
+		reply, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(reply, code+" ") {
+			t.Fatalf("unexpected reply to %q: %q, %v", command, reply, err)
+		}
+		return reply
+	}
+	cmd("220", "")
+	cmd("331", "USER anonymous")
+	cmd("230", "PASS anonymous")
+
+	reply := cmd("227", "PASV")
+	parts := strings.Split(reply[strings.IndexByte(reply, '(')+1:strings.IndexByte(reply, ')')], ",")
+	p1, _ := strconv.Atoi(parts[4])
+	p2, _ := strconv.Atoi(parts[5])
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(strings.Join(parts[:4], "."), strconv.Itoa(p1*256+p2)), time.Second)
+	if err != nil {
+		t.Fatalf("can't open the data connection: %v", err)
+	}
+	defer func() { _ = data.Close() }()
+	_ = data.SetDeadline(time.Now().Add(time.Second * 5))
+
+	//the transfer is aborted by the timeout, the notifier is called before the reply
+	cmd("150", "RETR /"+uid+".html")
+	if _, err := io.ReadFull(data, make([]byte, transferChunk)); err != nil {
+		t.Fatalf("can't read the data: %v", err)
+	}
+	cmd("551", "")
+	if bans.Banned("127.0.0.1") {
+		t.Errorf("the client has been banned for the transfer timeout")
+	}
+
+	cmd("551", "RETR /"+ug.New()+".html")
+	if !bans.Banned("127.0.0.1") {
+		t.Errorf("the client hasn't been banned for the unknown file")
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"errors"
+	"goftp.io/server/core"
+	"io"
+	"log"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var (
+	ErrUnavailable     = errors.New("file unavailable")
+	ErrTransferTimeout = errors.New("transfer timeout")
+	ErrUnsigned        = errors.New("file name isn't signed")
+	ErrShuttingDown    = errors.New("server is shutting down")
+)
+
+//the file is read in chunks of this size, so the transfer timeout is checked while the file is sent
+const transferChunk = 32 * 1024
+
+//Guard decides whether the file with uid can be downloaded
+type Guard interface {
+	//checks the file can be downloaded
+	Check(uid string) error
+	//checks the file can be downloaded and counts the download
+	Acquire(uid string) error
+}
+
+//Signer verifies the signature of the ftp file name
+type Signer interface {
+	Verify(uid string, template string, signature string, now time.Time) error
+}
+
+//Driver wraps the ftpdt driver and hides the files the guard doesn't allow to download
+type Driver struct {
+	core.Driver
+	uidValidator     UID
+	guard            Guard
+	logger           *log.Logger
+	transferTimeout  time.Duration
+	signer           Signer
+	requireSignature bool
+	transfers        *Transfers
+	failed           func(uid string, template string)
+}
+
+//Stat hides the files the guard doesn't allow to download
+func (d *Driver) Stat(path string) (core.FileInfo, error) {
+	path, err := d.unsign(path)
+	if err != nil {
+		d.logger.Printf("FTPDTS WARN %s %v", path, err)
+		return nil, err
+	}
+	uid, _, err := ParsePath(path, d.uidValidator)
+	if err == nil {
+		if err := d.guard.Check(uid); err != nil {
+			d.logger.Printf("FTPDTS WARN %s %v", path, err)
+			return nil, ErrUnavailable
+		}
+	}
+	return d.Driver.Stat(path)
+}
+
+//GetFile produces the file with the wrapped driver and counts the download
+//the file isn't exposed if the guard doesn't allow to download it
+//the errors are wrapped into FileError, so the notifiers tell them apart from the data transfer errors
+func (d *Driver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	if d.transfers == nil {
+		return d.timeout(fileError(d.getFile(path, offset)))
+	}
+	if !d.transfers.begin() {
+		return fileError(0, nil, ErrShuttingDown)
+	}
+	size, rc, err := d.getFile(path, offset)
+	if err != nil {
+		d.transfers.end()
+		return fileError(size, rc, err)
+	}
+	return d.timeout(size, &transferReader{ReadCloser: rc, transfers: d.transfers}, nil)
+}
+
+//the produced file is wrapped last, so goftp copies it into the data connection with timeoutReader.WriteTo
+func (d *Driver) timeout(size int64, rc io.ReadCloser, err error) (int64, io.ReadCloser, error) {
+	if err == nil && d.transferTimeout > 0 {
+		rc = &timeoutReader{rc, time.Now().Add(d.transferTimeout)}
+	}
+	return size, rc, err
+}
+
+//FileError is the error of the file request, the file hasn't been produced
+type FileError struct {
+	Err error
+}
+
+func (e *FileError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+func fileError(size int64, rc io.ReadCloser, err error) (int64, io.ReadCloser, error) {
+	if err != nil {
+		err = &FileError{err}
+	}
+	return size, rc, err
+}
+
+func (d *Driver) getFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	path, err := d.unsign(path)
+	if err != nil {
+		d.logger.Printf("FTPDTS WARN %s %v", path, err)
+		return 0, nil, err
+	}
+	uid, template, err := ParsePath(path, d.uidValidator)
+	if err != nil {
+		return d.Driver.GetFile(path, offset)
+	}
+
+	if err := d.guard.Check(uid); err != nil {
+		d.logger.Printf("FTPDTS WARN %s %v", path, err)
+		return 0, nil, ErrUnavailable
+	}
+
+	size, rc, err := d.Driver.GetFile(path, offset)
+	if err != nil {
+		if d.failed != nil {
+			d.failed(uid, template)
+		}
+		return size, rc, err
+	}
+
+	//the download is counted only when the file has been produced
+	if err := d.guard.Acquire(uid); err != nil {
+		_ = rc.Close()
+		d.logger.Printf("FTPDTS WARN %s %v", path, err)
+		return 0, nil, ErrUnavailable
+	}
+	return size, rc, nil
+}
+
+//verifies the signature of the file name <uid>.<signature>.<ext> and returns the path with the unsigned file name <uid>.<ext>
+//the unsigned file names are rejected if the signature is required
+func (d *Driver) unsign(path string) (string, error) {
+	uid, template, err := ParsePath(path, d.uidValidator)
+	if err != nil || d.signer == nil {
+		return path, nil
+	}
+
+	dir, name := filepath.Split(path)
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) == 3 && parts[0] == uid {
+		if err := d.signer.Verify(uid, template, parts[1], time.Now()); err != nil {
+			return path, err
+		}
+		return dir + uid + "." + parts[2], nil
+	}
+	if d.requireSignature {
+		return path, ErrUnsigned
+	}
+	return path, nil
+}
+
+//aborts the transfer which takes longer than the transfer timeout
+//the deadline is checked before every chunk is read and set on the data connection, so the client which stops reading is dropped too
+type timeoutReader struct {
+	io.ReadCloser
+	deadline time.Time
+}
+
+//WriteTo is used by io.Copy of goftp to send the file into the data socket
+func (r *timeoutReader) WriteTo(w io.Writer) (n int64, err error) {
+	//the empty write waits for the passive data connection to be accepted, the connection isn't changed afterwards
+	if _, err := w.Write(nil); err != nil {
+		return 0, err
+	}
+	if conn := dataConn(w); conn != nil {
+		if err := conn.SetWriteDeadline(r.deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, transferChunk)
+	for {
+		nr, err := r.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			var ne net.Error
+			if errors.As(werr, &ne) && ne.Timeout() {
+				return n, ErrTransferTimeout
+			}
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	if !time.Now().Before(r.deadline) {
+		return 0, ErrTransferTimeout
+	}
+	if len(p) > transferChunk {
+		p = p[:transferChunk]
+	}
+	return r.ReadCloser.Read(p)
+}
+
+//DriverFactory wraps the drivers created by the ftpdt driver factory
+type DriverFactory struct {
+	factory          core.DriverFactory
+	uidValidator     UID
+	guard            Guard
+	logger           *log.Logger
+	TransferTimeout  time.Duration //maximum duration of the file transfer, 0 - unlimited
+	Signer           Signer        //verifies the signed file names if it's set
+	RequireSignature bool          //the unsigned file names are rejected, used with Signer only
+	Transfers        *Transfers    //counts the transfers in progress if it's set
+	//is called when the wrapped driver hasn't produced the file of the allowed uid, the data may be missing or the template may fail
+	Failed func(uid string, template string)
+}
+
+func NewDriverFactory(factory core.DriverFactory, uidValidator UID, guard Guard, logger *log.Logger) *DriverFactory {
+	return &DriverFactory{
+		factory:      factory,
+		uidValidator: uidValidator,
+		guard:        guard,
+		logger:       logger,
+	}
+}
+
+//Create Driver instance for each ftp client connection
+func (f *DriverFactory) NewDriver() (core.Driver, error) {
+	d, err := f.factory.NewDriver()
+	if err != nil {
+		return nil, err
+	}
+	return &Driver{
+		d,
+		f.uidValidator,
+		f.guard,
+		f.logger,
+		f.TransferTimeout,
+		f.Signer,
+		f.RequireSignature,
+		f.Transfers,
+		f.Failed,
+	}, nil
+}
+
+//returns the network connection of the goftp data socket or nil if it isn't found
+//goftp doesn't expose the connection, it's read from the conn field of its active and passive sockets
+func dataConn(w io.Writer) net.Conn {
+	v := reflect.ValueOf(w)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	f := v.Elem().FieldByName("conn")
+	if !f.IsValid() || (f.Kind() != reflect.Interface && f.Kind() != reflect.Ptr) || f.IsNil() {
+		return nil
+	}
+	conn, _ := reflect.NewAt(f.Type(), unsafe.Pointer(f.UnsafeAddr())).Elem().Interface().(net.Conn) // #nosec G103
+	return conn
+}
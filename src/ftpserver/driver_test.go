@@ -0,0 +1,124 @@
+package ftpserver
+
+import (
+	"context"
+	"errors"
+	"ftpdts/src/signer"
+	"github.com/starshiptroopers/uidgenerator"
+	"goftp.io/server/core"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDriverSignature(t *testing.T) {
+	ug := uidgenerator.New(nil)
+	s := signer.New("secret")
+	d := &Driver{uidValidator: ug, signer: s}
+	uid := ug.New()
+
+	signed := s.FileName(uid, "test", time.Time{})
+	path, err := d.unsign(signed)
+	if err != nil || path != "/test/"+uid+".html" {
+		t.Errorf("the signed file name hasn't been verified: %s, %v", path, err)
+	}
+
+	if _, err := d.unsign(strings.Replace(signed, "/test/", "/another/", 1)); err != signer.ErrWrongSignature {
+		t.Errorf("the file name signed for another template has been verified: %v", err)
+	}
+	if _, err := d.unsign(s.FileName(uid, "", time.Now().Add(-time.Second))); err != signer.ErrLinkExpired {
+		t.Errorf("the expired file name has been verified: %v", err)
+	}
+
+	if path, err := d.unsign("/" + uid + ".html"); err != nil || path != "/"+uid+".html" {
+		t.Errorf("the unsigned file name should be accepted: %s, %v", path, err)
+	}
+	d.requireSignature = true
+	if _, err := d.unsign("/" + uid + ".html"); err != ErrUnsigned {
+		t.Errorf("the unsigned file name should be rejected: %v", err)
+	}
+}
+
+//the wrapped driver which serves any file
+type fileDriver struct {
+	core.Driver
+}
+
+func (fileDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return 4, ioutil.NopCloser(strings.NewReader("file")), nil
+}
+
+func TestDriverTransfers(t *testing.T) {
+	transfers := NewTransfers()
+	d := &Driver{Driver: fileDriver{}, uidValidator: uidgenerator.New(nil), transfers: transfers}
+
+	_, rc, err := d.GetFile("/readme.txt", 0)
+	if err != nil {
+		t.Fatalf("can't get the file: %v", err)
+	}
+	if transfers.Active() != 1 {
+		t.Fatalf("the transfer hasn't been counted")
+	}
+
+	//the drain waits for the transfer in progress
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := transfers.Drain(ctx); err == nil {
+		t.Errorf("the transfer in progress hasn't been waited for")
+	}
+	if _, _, err := d.GetFile("/readme.txt", 0); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("the new transfer hasn't been refused while draining: %v", err)
+	}
+
+	drained := make(chan error)
+	go func() { drained <- transfers.Drain(context.Background()) }()
+	_ = rc.Close()
+	_ = rc.Close()
+	select {
+	case err := <-drained:
+		if err != nil {
+			t.Errorf("the transfers haven't been drained: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the drain hasn't been finished after the transfer")
+	}
+	if transfers.Active() != 0 {
+		t.Errorf("wrong number of the transfers: %d", transfers.Active())
+	}
+}
+
+//the wrapped driver which can't produce any file
+type failingDriver struct {
+	core.Driver
+}
+
+func (failingDriver) GetFile(path string, offset int64) (int64, io.ReadCloser, error) {
+	return 0, nil, ErrUnavailable
+}
+
+//the guard which allows all downloads
+type openGuard struct{}
+
+func (openGuard) Check(uid string) error   { return nil }
+func (openGuard) Acquire(uid string) error { return nil }
+
+func TestDriverFailed(t *testing.T) {
+	ug := uidgenerator.New(nil)
+	var failed []string
+	d := &Driver{Driver: failingDriver{}, uidValidator: ug, guard: openGuard{}, failed: func(uid string, template string) {
+		failed = append(failed, uid+" "+template)
+	}}
+	uid := ug.New()
+
+	if _, _, err := d.GetFile("/invoice/"+uid+".html", 0); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("the error of the wrapped driver hasn't been returned: %v", err)
+	}
+	if _, _, err := d.GetFile("/readme.txt", 0); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("the error of the wrapped driver hasn't been returned: %v", err)
+	}
+	if len(failed) != 1 || failed[0] != uid+" invoice" {
+		t.Errorf("the failed files have been reported wrong: %v", failed)
+	}
+}
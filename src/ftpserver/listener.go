@@ -0,0 +1,179 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"errors"
+	"ftpdts/src/clock"
+	"ftpdts/src/ratelimit"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var errBanned = errors.New("client is banned")
+
+//Limits of the ftp control connections, zero values mean unlimited
+type Limits struct {
+	MaxConnections      uint          //total number of the connections
+	MaxConnectionsPerIP uint          //number of the connections from one IP
+	RequestsPerMinute   uint          //number of the new connections from one IP per minute
+	IdleTimeout         time.Duration //the connection is closed if the client doesn't send commands for this time
+}
+
+//Listener wraps the ftp server listener and rejects the connections over the limits and from the banned clients
+//the rejected client gets the 421 reply and the connection is closed
+//the accepted connections are tracked, so the sessions left open on shutdown are closed by CloseConnections
+type Listener struct {
+	net.Listener
+	mu       sync.Mutex
+	limits   Limits
+	conns    uint
+	perIP    map[string]uint
+	sessions map[*limitedConn]struct{}
+	closed   bool
+	limiter  *ratelimit.Limiter
+	bans     *BanList
+	logger   *log.Logger
+}
+
+//bans can be nil if the clients are never banned
+func NewListener(l net.Listener, limits Limits, bans *BanList, clock clock.Clock, logger *log.Logger) *Listener {
+	t := &Listener{
+		Listener: l,
+		limits:   limits,
+		perIP:    make(map[string]uint),
+		sessions: make(map[*limitedConn]struct{}),
+		bans:     bans,
+		logger:   logger,
+	}
+	if limits.RequestsPerMinute > 0 {
+		t.limiter = ratelimit.NewLimiter(float64(limits.RequestsPerMinute)/60, limits.RequestsPerMinute, clock)
+	}
+	return t
+}
+
+//Accept waits for the next connection within the limits
+func (t *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := t.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := ClientIP(c.RemoteAddr())
+		if reason := t.admit(ip); reason != "" {
+			t.logger.Printf("FTPDTS WARN connection from %s has been rejected: %s", ip, reason)
+			_ = c.SetWriteDeadline(time.Now().Add(time.Second))
+			_, _ = c.Write([]byte("421 " + reason + "\r\n"))
+			_ = c.Close()
+			continue
+		}
+		lc := &limitedConn{Conn: c, listener: t, ip: ip}
+		if !t.track(lc) {
+			_ = lc.Close()
+			return nil, net.ErrClosed
+		}
+		return lc, nil
+	}
+}
+
+//closes the open connections, the connections accepted afterwards are closed at once
+//the listener itself is closed by Close, it's done first, so the new sessions aren't started
+func (t *Listener) CloseConnections() {
+	t.mu.Lock()
+	t.closed = true
+	sessions := make([]*limitedConn, 0, len(t.sessions))
+	for c := range t.sessions {
+		sessions = append(sessions, c)
+	}
+	t.mu.Unlock()
+
+	for _, c := range sessions {
+		_ = c.Close()
+	}
+}
+
+//adds the connection to the open ones, returns false if the connections have been closed
+func (t *Listener) track(c *limitedConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.sessions[c] = struct{}{}
+	return true
+}
+
+//returns the reason the connection is rejected for or an empty string if it's accepted
+func (t *Listener) admit(ip string) string {
+	if t.bans != nil && t.bans.Banned(ip) {
+		return "You are temporarily banned"
+	}
+	if t.limiter != nil {
+		if ok, _ := t.limiter.Allow(ip); !ok {
+			return "Too many connections per minute"
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limits.MaxConnections > 0 && t.conns >= t.limits.MaxConnections {
+		return "Too many connections"
+	}
+	if t.limits.MaxConnectionsPerIP > 0 && t.perIP[ip] >= t.limits.MaxConnectionsPerIP {
+		return "Too many connections from your IP"
+	}
+	t.conns++
+	t.perIP[ip]++
+	return ""
+}
+
+func (t *Listener) release(c *limitedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.sessions, c)
+	ip := c.ip
+	t.conns--
+	if t.perIP[ip]--; t.perIP[ip] == 0 {
+		delete(t.perIP, ip)
+	}
+}
+
+//returns the number of the open connections
+func (t *Listener) Connections() uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.conns
+}
+
+//the control connection counted by the listener
+type limitedConn struct {
+	net.Conn
+	listener *Listener
+	ip       string
+	once     sync.Once
+}
+
+//Read waits for the next command no longer than the idle timeout
+//the session of the client banned in the middle of it is finished at the next command
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if c.listener.bans != nil && c.listener.bans.Banned(c.ip) {
+		return 0, errBanned
+	}
+	if c.listener.limits.IdleTimeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(c.listener.limits.IdleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		c.listener.release(c)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,117 @@
+package ftpserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestBanList(t *testing.T) {
+	clock := &fakeClock{time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)}
+	bans := NewBanList(3, time.Minute, time.Hour, clock)
+
+	//misses out of the window aren't counted
+	bans.Miss("10.0.0.1")
+	bans.Miss("10.0.0.1")
+	clock.now = clock.now.Add(time.Minute)
+	if bans.Miss("10.0.0.1") || bans.Banned("10.0.0.1") {
+		t.Fatalf("the client has been banned for the misses out of the window")
+	}
+
+	bans.Miss("10.0.0.1")
+	if !bans.Miss("10.0.0.1") || !bans.Banned("10.0.0.1") {
+		t.Fatalf("the client hasn't been banned")
+	}
+	if bans.Banned("10.0.0.2") {
+		t.Errorf("another client has been banned")
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	if bans.Banned("10.0.0.1") {
+		t.Errorf("the ban hasn't expired")
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("can't listen: %v", err)
+	}
+	clock := &fakeClock{time.Now()}
+	bans := NewBanList(1, time.Minute, time.Hour, clock)
+	limited := NewListener(l, Limits{MaxConnectionsPerIP: 1, IdleTimeout: time.Millisecond * 50}, bans, clock, log.New(ioutil.Discard, "", 0))
+	defer func() { _ = limited.Close() }()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("can't connect: %v", err)
+		}
+		return c
+	}
+	reply := func(c net.Conn) string {
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		s, _ := bufio.NewReader(c).ReadString('\n')
+		return s
+	}
+
+	c1 := dial()
+	defer func() { _ = c1.Close() }()
+	s1 := <-accepted
+
+	//the second connection from the same IP is rejected
+	c2 := dial()
+	if r := reply(c2); !strings.HasPrefix(r, "421 ") {
+		t.Errorf("the connection over the limit hasn't been rejected: %q", r)
+	}
+	_ = c2.Close()
+
+	//the idle connection is closed by the server and the slot is released
+	if _, err := s1.Read(make([]byte, 1)); err == nil {
+		t.Errorf("the idle timeout hasn't been applied")
+	}
+	_ = s1.Close()
+	if limited.Connections() != 0 {
+		t.Errorf("the connection hasn't been released: %d", limited.Connections())
+	}
+
+	c3 := dial()
+	defer func() { _ = c3.Close() }()
+	select {
+	case s3 := <-accepted:
+		_ = s3.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("the connection within the limits hasn't been accepted")
+	}
+
+	//the banned client is rejected
+	bans.Miss("127.0.0.1")
+	c4 := dial()
+	defer func() { _ = c4.Close() }()
+	if r := reply(c4); !strings.HasPrefix(r, "421 ") {
+		t.Errorf("the banned client hasn't been rejected: %q", r)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"goftp.io/server/core"
+	"sync/atomic"
+)
+
+//DebugLogger passes the ftp commands and responses to the logger only while the debug mode is on
+//the mode can be switched while the server is running
+type DebugLogger struct {
+	logger core.Logger
+	debug  int32
+}
+
+func NewDebugLogger(logger core.Logger, debug bool) *DebugLogger {
+	l := &DebugLogger{logger: logger}
+	l.SetDebug(debug)
+	return l
+}
+
+//turns the debug mode on or off
+func (l *DebugLogger) SetDebug(debug bool) {
+	var v int32
+	if debug {
+		v = 1
+	}
+	atomic.StoreInt32(&l.debug, v)
+}
+
+func (l *DebugLogger) enabled() bool {
+	return atomic.LoadInt32(&l.debug) == 1
+}
+
+func (l *DebugLogger) Print(sessionID string, message interface{}) {
+	if l.enabled() {
+		l.logger.Print(sessionID, message)
+	}
+}
+
+func (l *DebugLogger) Printf(sessionID string, format string, v ...interface{}) {
+	if l.enabled() {
+		l.logger.Printf(sessionID, format, v...)
+	}
+}
+
+func (l *DebugLogger) PrintCommand(sessionID string, command string, params string) {
+	if l.enabled() {
+		l.logger.PrintCommand(sessionID, command, params)
+	}
+}
+
+func (l *DebugLogger) PrintResponse(sessionID string, code int, message string) {
+	if l.enabled() {
+		l.logger.PrintResponse(sessionID, code, message)
+	}
+}
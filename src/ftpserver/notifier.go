@@ -0,0 +1,53 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"goftp.io/server/core"
+	"time"
+)
+
+//Download describes the completed RETR of a generated file
+type Download struct {
+	UID      string
+	Template string
+	Path     string
+	ClientIP string
+	Bytes    int64
+	Time     time.Time
+}
+
+//DownloadNotifier implements goftp core.Notifier and calls the callback function on every successful file download
+//register it with the ftp server by RegisterNotifer
+type DownloadNotifier struct {
+	core.NullNotifier
+	uidValidator UID
+	callback     func(d Download)
+}
+
+func NewDownloadNotifier(uidValidator UID, callback func(d Download)) *DownloadNotifier {
+	return &DownloadNotifier{
+		uidValidator: uidValidator,
+		callback:     callback,
+	}
+}
+
+func (n *DownloadNotifier) AfterFileDownloaded(conn *core.Conn, dstPath string, size int64, err error) {
+	if err != nil {
+		return
+	}
+	uid, template, err := ParsePath(dstPath, n.uidValidator)
+	if err != nil {
+		return
+	}
+	n.callback(Download{
+		UID:      uid,
+		Template: template,
+		Path:     dstPath,
+		ClientIP: ClientIP(conn.RemoteAddr()),
+		Bytes:    size,
+		Time:     time.Now(),
+	})
+}
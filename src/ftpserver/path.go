@@ -0,0 +1,66 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//ftp server helpers used to observe and control the ftpdt file downloads
+package ftpserver
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+//the template name used when the file is requested from the root folder
+const DefaultTemplate = "default"
+
+var ErrWrongPath = errors.New("wrong path")
+
+//UID validator
+type UID interface {
+	//searching the UID in the string
+	Validate(string) (string, error)
+}
+
+//parse the ftp file path and invoke the uid and the template name the same way ftpdt does it
+//the root folder is reported as DefaultTemplate
+func ParsePath(path string, uidValidator UID) (uid string, template string, err error) {
+	paths := strings.Split(path, string(filepath.Separator))
+
+	//relative paths isn't supported
+	if paths[0] == "." || paths[0] == ".." {
+		if len(paths) == 1 {
+			return "", "", ErrWrongPath
+		}
+		paths = paths[1:]
+	}
+
+	filename := paths[len(paths)-1]
+	if filename == "" {
+		return "", "", ErrWrongPath
+	}
+
+	uid, err = uidValidator.Validate(filename)
+	if err != nil {
+		return "", "", ErrWrongPath
+	}
+
+	template = filepath.Join(paths[:len(paths)-1]...)
+	if template == "" || template == string(filepath.Separator) {
+		template = DefaultTemplate
+	}
+	return
+}
+
+//returns the client ip address without port
+func ClientIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
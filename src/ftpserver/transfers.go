@@ -0,0 +1,85 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ftpserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//Transfers counts the file transfers in progress, so the server can wait for them on shutdown
+type Transfers struct {
+	mu       sync.Mutex
+	active   int
+	draining bool
+	idle     chan struct{} //closed when the last transfer is finished while draining
+}
+
+func NewTransfers() *Transfers {
+	return &Transfers{}
+}
+
+//returns the number of the transfers in progress
+func (t *Transfers) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+//refuses the new transfers and waits for the transfers in progress until ctx is done
+func (t *Transfers) Drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.active == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d transfers haven't been finished: %v", t.Active(), ctx.Err())
+	}
+}
+
+//counts the new transfer, returns false if the transfers are drained
+func (t *Transfers) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	t.active++
+	return true
+}
+
+func (t *Transfers) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active--; t.active == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+//the file of the transfer in progress, the transfer is finished when the file is closed
+type transferReader struct {
+	io.ReadCloser
+	transfers *Transfers
+	once      sync.Once
+}
+
+func (r *transferReader) Close() error {
+	r.once.Do(r.transfers.end)
+	return r.ReadCloser.Close()
+}
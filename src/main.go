@@ -9,10 +9,28 @@
 // Opening a ftp link in a webkit lead to starting the Safari. At the moment of developing this library it was the only way to escape from Facebook browser to ios default browser.
 //
 // Configuration:
-// Server read the configuration from in ftpdts.ini file
+// Server read the configuration from in ftpdts.ini file, another file is given with -config, its format (ini, yaml, toml, json) is defined by the extension
+// -print-config prints the effective configuration with the secrets redacted, -check-config validates the configuration and exits
+// The configuration is validated on start, all problems are reported at once with the field names
+// SIGHUP re-reads the configuration: logs, ftp debug mode, cache ttl, api keys, rate limits, https certificate and templates path are applied live,
+// changes of other settings are logged as the ones which need restart
+// SIGTERM and SIGINT shut the server down gracefully: GET /ready fails first, then the transfers and requests in progress are waited for drainTimeout,
+// the exit code is non-zero if the shutdown isn't clean
+// The ports are bound before serving, so the start fails right away if a port is busy. If the ftp or the web server fails later,
+// the whole server is shut down the same way and the exit code is non-zero
+// The ftp and http listeners can be passed by systemd socket activation (LISTEN_FDS), they are matched by the names ftp and http or by the ports.
+// SIGUSR2 upgrades the server without closing the ports: the new process of the binary gets the listeners,
+// and when it is serving this one is shut down gracefully as on SIGTERM, the upgrade is refused with the bolt backend and the memory-only ttl data
+// The server can be embedded into another service with the ftpdts/src/ftpdts package, this binary is a thin wrapper around it
 // Ftp server is listening at 2001 port, http server (rest api endpoints) is listening at 2000 default port
 // Templates is stored at ./tmpl folder by default
-// Persistent data storage is at ./data folder
+// FTP connections are limited in total, per client IP and per minute, clients requesting unknown files too often are banned for a while, see the [ftp] section
+// Data cache is kept in the process memory by default, set the redis cache backend to share it between several ftpdts instances
+// Persistent data storage is at ./data folder, the data can be stored in separate files (fs backend) or in the embedded database file (bolt backend)
+// or in the SQL database, SQLite or Postgres (sql backend), several ftpdts instances can share the same Postgres database
+// Run "ftpdts -convert-from fs" once to copy the data into the configured backend after it is changed
+// Data files written by the previous versions are readable, run "ftpdts -migrate" once to rewrite them into the current format
+// Data files can be spread over the shard folders named by the uid prefix, run "ftpdts -migrate" once after the layout is changed
 //
 // Templates:
 // default.tmpl is the default template file. It is used when the ftp client requests the file from the root folder, for example with url: ftp://server/UID.html
@@ -25,8 +43,10 @@
 //
 // WebAPI endpoints:
 // POST:
-//  url: /data?ttl=n
+//  url: /data?ttl=n&maxDownloads=n&notBefore=time&expiresAt=time
 //  ttl = time to live in seconds the data will be stored in the memory storage, if ttl = 0 data will be stored into the persistent storage, if ttl is not defined data will be stored into the memory storage with default ttl
+//  maxDownloads = the file can be downloaded via FTP at most n times, then it isn't available anymore (1 is a burn-after-reading link), unlimited by default
+//  notBefore, expiresAt = RFC 3339 time window the file can be downloaded via FTP in, for example 2021-03-01T10:00:00Z. If ttl is not defined, the data is kept in the memory storage until expiresAt
 //  body: data to fill into the template in JSON format
 //  response:
 //  	{
@@ -45,9 +65,58 @@
 //				....
 //			},
 //    		"createdAt": datetime,
-//    		"ttl": 0
+//    		"ttl": 0,
+//    		"maxDownloads": 1,		// download limit, omitted if unlimited
+//    		"downloads": 0,			// number of the FTP downloads, as /data/stats reports
+//    		"notBefore": datetime,	// omitted if not defined
+//    		"expiresAt": datetime	// omitted if not defined
 //		}
 //
+// DELETE:
+//  url: /data?uid=xxxxxxx...xx
+//  requires a known API key in the X-API-Key header
+//  response: {"code": 0, "message": "OK"} or {"code": 10, "message": "Not found"}
+//
+// GET:
+//  url: /data/stats?uid=xxxxxxx...xx
+//  response:
+//  	{
+//		    "code": 0,
+//		    "message": "OK",
+//		    "uid": "xxxxxxx...xx",
+//		    "downloads": 2,				// number of the FTP downloads
+//		    "firstAccess": datetime,	// null if the file has never been downloaded
+//		    "lastAccess": datetime
+//		}
+//
+// GET:
+//  url: /events?uid=xxxxxxx...xx&template=name
+//  requires a known API key in the X-API-Key header
+//  response: the server-sent event stream of the created, downloaded, renderError, deleted and expired events, filtered by uid and template if they're set
+//
+// Requests are rate limited by the client IP or by the API key passed in the X-API-Key header, see the [http] section
+// Limited requests are answered with 429 status, Retry-After header and {"code": 11, "message": "Too many requests"}
+// Datasets created with one API key per day are limited with dailyQuota, {"code": 12, "message": "Daily quota exceeded"} is returned then
+//
+// FTP file names can be signed <uid>.<signature>.html, see the [sign] section, the POST response contains the signed "file" path then
+// GET:
+//  url: /data/link?uid=xxxxxxx...xx&template=name&ttl=n
+//  response: {"code": 0, "message": "OK", "uid": "xxxxxxx...xx", "file": "/name/xxxxxxx...xx.signature.html", "expiresAt": datetime}
+// With authRead on, GET /data, /data/stats and /data/link require a known API key in the X-API-Key header
+//
+// GET:
+//  url: /metrics
+//  response: memory cache metrics (entries, bytes, evictions) in the prometheus text format
+//
+// GET:
+//  url: /ready
+//  response: 200 {"code": 0, "message": "OK"} or 503 {"code": 14, "message": "Service is shutting down"} on shutdown
+//
+// Webhooks:
+// The created, first downloaded, expired and deleted events are posted to the url of the [webhook] section as the JSON signed with HMAC-SHA256
+// in the X-Ftpdts-Signature header, the events are queued on the disk and retried with the exponential backoff
+// The data expired by the native ttl of the redis cache isn't reported, turn persistTTL on to get the expired events of the data with ttl
+//
 // Usage example
 //    1. Start the service: docker-compose up
 //    2. Do the POST request to http://localhost:2000/data with curl
@@ -67,146 +136,172 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	"ftpdts/src/storage"
-	"ftpdts/src/webserver"
-	"github.com/starshiptroopers/ftpdt"
-	"github.com/starshiptroopers/ftpdt/datastorage"
-	"github.com/starshiptroopers/ftpdt/tmplstorage"
-	"github.com/starshiptroopers/uidgenerator"
-	"goftp.io/server/core"
+	"ftpdts/src/ftpdts"
+	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var gitTag, gitCommit, gitBranch string
 
-func main() {
+var (
+	configFile  = flag.String("config", "", "config file path, the format is defined by the extension: ini, yaml, toml or json (default ./ftpdts.ini)")
+	printConfig = flag.Bool("print-config", false, "print the effective config with the secrets redacted and exit")
+	checkConfig = flag.Bool("check-config", false, "check the config and exit")
+	migrate     = flag.Bool("migrate", false, "rewrite the persistent data files into the current format and layout and exit")
+	convertFrom = flag.String("convert-from", "", "copy the persistent data from the given backend (fs, bolt or sql) into the configured one and exit")
+)
 
-	if gitTag != "" {
-		fmt.Printf("Ftpdts service version %s (%s, %s)\n", gitTag, gitBranch, gitCommit)
-	}
+func main() {
+	flag.Parse()
 
-	config, err := LoadConfig()
+	config, err := ftpdts.LoadConfig(*configFile)
 	if err != nil {
-		panic(err)
+		fatal(err)
+	}
+	if *printConfig {
+		b, err := config.Redacted()
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Println(string(b))
+		return
+	}
+	if *checkConfig {
+		fmt.Println("config is valid")
+		return
 	}
 
-	loggerFTP := logInit(config.Logs.FTP, !config.Logs.FTPNoConsole)
-	loggerHTTP := logInit(config.Logs.HTTP, !config.Logs.HTTPNoConsole)
-	logger := logInit(config.Logs.Ftpdts, !config.Logs.FtpdtsNoConsole)
-
-	ug := uidgenerator.New(
-		&uidgenerator.Cfg{
-			Alfa:      config.UID.Chars,
-			Format:    config.UID.Format,
-			Validator: config.UID.ValidatorRegexp,
-		},
-	)
-
-	ts := tmplstorage.New(config.Templates.Path)
-
-	datastorage.DefaultCacheTTL = time.Second * time.Duration(config.Cache.DataTTL)
-	memoryDs := datastorage.NewMemoryDataStorage()
-	fsDs := storage.NewFsDataStorage(config.Data.Path, ug)
-
-	var forever = time.Duration(0)
+	if gitTag != "" {
+		fmt.Printf("Ftpdts service version %s (%s, %s)\n", gitTag, gitBranch, gitCommit)
+	}
 
-	//Load data from the persistent storage
-	var cnt = 0
-	err = fsDs.Pass(func(uid string, createdAt time.Time, data interface{}) {
-		if err := memoryDs.Put(uid, data, &forever); err != nil {
-			panic(fmt.Errorf("something wrong with loading persistent data into the memory cache: %v", err))
+	if *migrate {
+		n, err := ftpdts.Migrate(*config, log.New(os.Stdout, "", log.LstdFlags))
+		if err != nil {
+			fatal(err)
 		}
-		cnt++
-	})
-	if err != nil {
-		panic(fmt.Errorf("can't initialize the data persistent storage: %v", err))
+		log.Printf("%d persistent data records has been migrated", n)
+		return
 	}
-	logger.Printf("%d persistent data records has been loaded into the data memory cache", cnt)
-
-	ftpOpts := &core.ServerOpts{
-		Port:         int(config.FTP.Port),
-		Hostname:     config.FTP.Host,
-		PassivePorts: config.FTP.PassivePorts,
-		PublicIP:     config.FTP.PublicIP,
+	if *convertFrom != "" {
+		n, err := ftpdts.Convert(*config, *convertFrom, log.New(os.Stdout, "", log.LstdFlags))
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("%d persistent data records has been converted from %s to %s", n, *convertFrom, config.Data.Backend)
+		return
 	}
 
-	ftpd := ftpdt.New(
-		&ftpdt.Opts{
-			FtpOpts:         ftpOpts,
-			TemplateStorage: ts,
-			DataStorage:     memoryDs,
-			UidGenerator:    ug,
-			LogWriter:       loggerFTP.Writer(),
-			LogFtpDebug:     config.FTP.DebugMode,
-		},
-	)
-
-	webServer := webserver.New(webserver.Opts{
-		Port:           config.HTTP.Port,
-		Host:           config.HTTP.Host,
-		DataStorage:    storage.NewDataStorage(memoryDs, fsDs),
-		Logger:         loggerHTTP,
-		UIDGenerator:   ug,
-		MaxRequestBody: config.HTTP.MaxRequestBody,
-	})
-
-	err = ServiceStartup(ftpd.ListenAndServe, time.Millisecond*500)
+	//the listeners passed by systemd socket activation or by the upgrading process are used instead of listening to the ports
+	inherited, err := ftpdts.Inherit(*config)
 	if err != nil {
-		panic(fmt.Errorf("can't start ftp server: %v", err))
+		fatal(err)
 	}
-
-	err = ServiceStartup(webServer.Run, time.Millisecond*500)
+	server, err := ftpdts.New(*config, ftpdts.WithListeners(inherited.FTP, inherited.HTTP))
 	if err != nil {
-		panic(fmt.Errorf("can't start web server: %v", err))
+		fatal(err)
+	}
+	logger := server.Logger()
+	if err := server.Start(context.Background()); err != nil {
+		logger.Printf("Can't start the server: %v", err)
+		_ = server.Stop(context.Background())
+		os.Exit(1)
+	}
+	if err := inherited.Ready(); err != nil {
+		logger.Printf("%v", err)
+	}
+	//the upgrading process serves the transfers in progress until it exits, the download rules it has changed are loaded then
+	if exited := inherited.UpgradingExited(); exited != nil {
+		go func() {
+			<-exited
+			if err := server.ReloadRules(); err != nil {
+				logger.Printf("Can't reload the download rules after the upgrade: %v", err)
+				return
+			}
+			logger.Printf("The previous process has exited, the download rules have been reloaded")
+		}()
 	}
 
-	//test data
-	/*
-			uid := ug.New()
-			_ = memoryDs.Put(uid,
-				&struct {
-					Title   string
-					Caption string
-					Url     string
-				}{"Title", "Caption", "https://starshiptroopers.dev"},
-				nil,
-			)
-
-			logger.Printf("Data has been stored into the storage with uid: %s", uid)
-		/*
-
-	*/
-	//waiting for the stop signal
+	//waiting for the stop signal or the failure of the servers, the config is reloaded on SIGHUP,
+	//the upgrade signal starts the new process with the listeners and this one is stopped when the new one is serving
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-
-	<-ch
-	_ = ftpd.Shutdown()
-	webServer.Shutdown()
-	fmt.Printf("\nThe server is shut down")
-
-}
+	signal.Notify(ch, append([]os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
 
-//starts the service (f func) as a gorutine and wait waitTimeout to service became ready
-//returns err if service returns err in waitTimeout time
-func ServiceStartup(f func() error, waitTimeout time.Duration) error {
-	closeCh := make(chan error)
+	failed := false
+wait:
+	for {
+		select {
+		case <-server.Done():
+			logger.Printf("%v, shutting down", server.Err())
+			failed = true
+			break wait
+		case sig := <-ch:
+			if isUpgradeSignal(sig) {
+				if err := upgrade(server); err != nil {
+					logger.Printf("Can't upgrade, this process keeps serving: %v", err)
+					continue
+				}
+				logger.Printf("The new process is serving, shutting down")
+				break wait
+			}
+			if sig != syscall.SIGHUP {
+				logger.Printf("%v signal has been received, shutting down", sig)
+				break wait
+			}
+			restart, err := reload(server)
+			if err != nil {
+				logger.Printf("Can't reload the config, the running one is kept: %v", err)
+				continue
+			}
+			logger.Printf("The config has been reloaded")
+			if len(restart) > 0 {
+				logger.Printf("The changes of %s need restart", strings.Join(restart, ", "))
+			}
+		}
+	}
+	//the second stop signal doesn't wait for the drain
 	go func() {
-		err := f()
-		if err != nil {
-			closeCh <- err
+		for sig := range ch {
+			if sig != syscall.SIGHUP && !isUpgradeSignal(sig) {
+				logger.Printf("%v signal has been received again, exiting immediately", sig)
+				os.Exit(1)
+			}
 		}
-		close(closeCh)
 	}()
 
-	select {
-	case err := <-closeCh:
-		return fmt.Errorf("Can't start a service: %v", err)
-	case <-time.After(waitTimeout):
+	//the ftp transfers and the http requests in progress are waited for drainTimeout after the readiness delay
+	c := server.Config().Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(c.ReadinessDelay+c.DrainTimeout))
+	defer cancel()
+	if err := server.Stop(ctx); err != nil || failed {
+		os.Exit(1)
+	}
+}
 
+//reads the config file again and applies it to the server
+func reload(server *ftpdts.Server) ([]string, error) {
+	config, err := ftpdts.LoadConfig(*configFile)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return server.Reload(*config)
+}
+
+//starts the new process of the binary with the listeners, the new binary can be put in place of the running one before
+func upgrade(server *ftpdts.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+	defer cancel()
+	return server.Upgrade(ctx)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
@@ -0,0 +1,137 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//rate limits and quotas of the clients identified by a key, for example the client IP or the API key
+package ratelimit
+
+import (
+	"ftpdts/src/clock"
+	"math"
+	"sync"
+	"time"
+)
+
+//number of Allow calls between removals of the idle buckets
+const cleanupInterval = 1024
+
+//Limiter is the token bucket rate limiter, every key has its own bucket
+//the bucket holds up to burst tokens and is refilled with rate tokens per second, every request takes one token
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clock   clock.Clock
+	buckets map[string]*bucket
+	calls   uint
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+//rate is the number of requests per second, burst is the maximum number of requests at once
+func NewLimiter(rate float64, burst uint, clock clock.Clock) *Limiter {
+	if burst == 0 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+//takes a token from the bucket of the key
+//returns false and the time to wait for the next token if the bucket is empty
+func (l *Limiter) Allow(key string) (ok bool, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.cleanup(now)
+
+	b, found := l.buckets[key]
+	if !found {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	if l.rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+//changes the limits, the current buckets are kept
+func (l *Limiter) SetRate(rate float64, burst uint) {
+	if burst == 0 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+}
+
+//removes the buckets which are full again, they are the same as the new ones
+func (l *Limiter) cleanup(now time.Time) {
+	if l.calls++; l.calls < cleanupInterval {
+		return
+	}
+	l.calls = 0
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+//Quota limits the number of requests of every key per day (UTC)
+type Quota struct {
+	mu    sync.Mutex
+	limit uint
+	clock clock.Clock
+	day   time.Time
+	used  map[string]uint
+}
+
+func NewQuota(limit uint, clock clock.Clock) *Quota {
+	return &Quota{
+		limit: limit,
+		clock: clock,
+		used:  make(map[string]uint),
+	}
+}
+
+//takes one request from the daily quota of the key
+//returns false and the time until the quota is reset if the quota is exhausted
+func (q *Quota) Allow(key string) (ok bool, retryAfter time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now().UTC()
+	if day := now.Truncate(time.Hour * 24); !day.Equal(q.day) {
+		q.day = day
+		q.used = make(map[string]uint)
+	}
+	if q.used[key] >= q.limit {
+		return false, q.day.Add(time.Hour * 24).Sub(now)
+	}
+	q.used[key]++
+	return true, 0
+}
+
+//changes the daily limit
+func (q *Quota) SetLimit(limit uint) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = limit
+}
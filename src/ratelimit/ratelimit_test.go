@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Add(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestLimiter(t *testing.T) {
+	clock := &fakeClock{time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)}
+	l := NewLimiter(2, 3, clock)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("client1"); !ok {
+			t.Fatalf("the request %d within the burst has been limited", i)
+		}
+	}
+	ok, retryAfter := l.Allow("client1")
+	if ok {
+		t.Fatalf("the request over the burst hasn't been limited")
+	}
+	if retryAfter != time.Millisecond*500 {
+		t.Errorf("wrong retry after: %v", retryAfter)
+	}
+	if ok, _ := l.Allow("client2"); !ok {
+		t.Errorf("the request of another client has been limited")
+	}
+
+	clock.Add(time.Millisecond * 500)
+	if ok, _ := l.Allow("client1"); !ok {
+		t.Errorf("the bucket hasn't been refilled")
+	}
+	if ok, _ := l.Allow("client1"); ok {
+		t.Errorf("the bucket has been refilled too much")
+	}
+
+	//the bucket isn't refilled over the burst
+	clock.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		l.Allow("client1")
+	}
+	if ok, _ := l.Allow("client1"); ok {
+		t.Errorf("the bucket has been refilled over the burst")
+	}
+
+	l.SetRate(1, 5)
+	clock.Add(time.Second * 5)
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("client1"); !ok {
+			t.Fatalf("the new burst hasn't been applied")
+		}
+	}
+}
+
+func TestQuota(t *testing.T) {
+	clock := &fakeClock{time.Date(2021, 3, 1, 23, 0, 0, 0, time.UTC)}
+	q := NewQuota(2, clock)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := q.Allow("key1"); !ok {
+			t.Fatalf("the request %d within the quota has been limited", i)
+		}
+	}
+	ok, retryAfter := q.Allow("key1")
+	if ok {
+		t.Fatalf("the request over the quota hasn't been limited")
+	}
+	if retryAfter != time.Hour {
+		t.Errorf("the quota should be reset at midnight: %v", retryAfter)
+	}
+	if ok, _ := q.Allow("key2"); !ok {
+		t.Errorf("the request of another key has been limited")
+	}
+
+	clock.Add(time.Hour)
+	if ok, _ := q.Allow("key1"); !ok {
+		t.Errorf("the quota hasn't been reset the next day")
+	}
+}
@@ -0,0 +1,23 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+//the signal starting the upgrade to the new process
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+//the time the new process has to start serving, the upgrade is canceled after it
+const upgradeTimeout = time.Minute
+
+func isUpgradeSignal(sig os.Signal) bool {
+	return sig == syscall.SIGUSR2
+}
@@ -0,0 +1,19 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+//the upgrade isn't supported on windows, the listeners can't be passed to the new process
+var upgradeSignals []os.Signal
+
+const upgradeTimeout = time.Minute
+
+func isUpgradeSignal(os.Signal) bool {
+	return false
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//signed ftp file names, the file name <uid>.<signature>.html can't be made up by the one who knows the uid only
+package signer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWrongSignature = errors.New("wrong signature")
+	ErrLinkExpired    = errors.New("link expired")
+)
+
+//the template name of the files in the root folder
+const defaultTemplate = "default"
+
+//length of the signature mac in bytes
+const macSize = 16
+
+//Signer signs the uid and the template name with the HMAC-SHA256 of the secret
+//the signature of the link with the expiry time is prefixed with the expiry unix time in base36: <expiry>-<mac>
+type Signer struct {
+	secret []byte
+}
+
+func New(secret string) *Signer {
+	return &Signer{[]byte(secret)}
+}
+
+//returns the signature of the uid and the template, the signature never expires if expiresAt is zero
+func (s *Signer) Sign(uid string, template string, expiresAt time.Time) string {
+	var expiry string
+	if !expiresAt.IsZero() {
+		expiry = strconv.FormatInt(expiresAt.Unix(), 36)
+	}
+	mac := hex.EncodeToString(s.mac(uid, template, expiry))
+	if expiry == "" {
+		return mac
+	}
+	return expiry + "-" + mac
+}
+
+//checks the signature of the uid and the template
+func (s *Signer) Verify(uid string, template string, signature string, now time.Time) error {
+	var expiry string
+	mac := signature
+	if i := strings.IndexByte(signature, '-'); i >= 0 {
+		expiry, mac = signature[:i], signature[i+1:]
+	}
+
+	b, err := hex.DecodeString(mac)
+	if err != nil || !hmac.Equal(b, s.mac(uid, template, expiry)) {
+		return ErrWrongSignature
+	}
+
+	if expiry != "" {
+		t, err := strconv.ParseInt(expiry, 36, 64)
+		if err != nil {
+			return ErrWrongSignature
+		}
+		if !now.Before(time.Unix(t, 0)) {
+			return ErrLinkExpired
+		}
+	}
+	return nil
+}
+
+//returns the signed ftp file path, the file of the default template is in the root folder
+func (s *Signer) FileName(uid string, template string, expiresAt time.Time) string {
+	if template == "" {
+		template = defaultTemplate
+	}
+	name := uid + "." + s.Sign(uid, template, expiresAt) + ".html"
+	if template == defaultTemplate {
+		return "/" + name
+	}
+	return "/" + template + "/" + name
+}
+
+func (s *Signer) mac(uid string, template string, expiry string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	_, _ = h.Write([]byte(uid + "\n" + template + "\n" + expiry))
+	return h.Sum(nil)[:macSize]
+}
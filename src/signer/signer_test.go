@@ -0,0 +1,49 @@
+package signer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSigner(t *testing.T) {
+	s := New("secret")
+	now := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+
+	sig := s.Sign("uid1", "default", time.Time{})
+	if err := s.Verify("uid1", "default", sig, now); err != nil {
+		t.Errorf("the valid signature hasn't been verified: %v", err)
+	}
+	if err := s.Verify("uid2", "default", sig, now); err != ErrWrongSignature {
+		t.Errorf("the signature of another uid has been verified: %v", err)
+	}
+	if err := s.Verify("uid1", "test", sig, now); err != ErrWrongSignature {
+		t.Errorf("the signature of another template has been verified: %v", err)
+	}
+	if err := New("another").Verify("uid1", "default", sig, now); err != ErrWrongSignature {
+		t.Errorf("the signature of another secret has been verified: %v", err)
+	}
+	if err := s.Verify("uid1", "default", "garbage", now); err != ErrWrongSignature {
+		t.Errorf("the garbage signature has been verified: %v", err)
+	}
+
+	expiring := s.Sign("uid1", "default", now.Add(time.Hour))
+	if err := s.Verify("uid1", "default", expiring, now); err != nil {
+		t.Errorf("the valid expiring signature hasn't been verified: %v", err)
+	}
+	if err := s.Verify("uid1", "default", expiring, now.Add(time.Hour)); err != ErrLinkExpired {
+		t.Errorf("the expired signature has been verified: %v", err)
+	}
+	//the expiry time is covered by the mac
+	forged := strings.Replace(expiring, expiring[:strings.IndexByte(expiring, '-')], "zzzzzz", 1)
+	if err := s.Verify("uid1", "default", forged, now); err != ErrWrongSignature {
+		t.Errorf("the signature with the forged expiry time has been verified: %v", err)
+	}
+
+	if f := s.FileName("uid1", "", time.Time{}); f != "/uid1."+sig+".html" {
+		t.Errorf("wrong file name of the default template: %s", f)
+	}
+	if f := s.FileName("uid1", "test", time.Time{}); f != "/test/uid1."+s.Sign("uid1", "test", time.Time{})+".html" {
+		t.Errorf("wrong file name of the template: %s", f)
+	}
+}
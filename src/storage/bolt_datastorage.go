@@ -0,0 +1,206 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+var (
+	boltDataBucket   = []byte("data")
+	boltExpiryBucket = []byte("expiry")
+)
+
+//BoltDataStorage is the persistent data storage in the embedded key-value database file (bbolt)
+//records are stored in the same envelope as FsDataStorage uses (see Record)
+//the expiry index keeps keys ordered by the expiry time, so the expired data is removed without a full scan
+type BoltDataStorage struct {
+	db *bolt.DB
+}
+
+func NewBoltDataStorage(filename string) (*BoltDataStorage, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("can't open the database file: %v", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltDataBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltExpiryBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("can't create the database buckets: %v", err)
+	}
+	return &BoltDataStorage{db}, nil
+}
+
+//returns the stored data by its UID
+//ttl is the remaining time to live, 0 if the data is stored forever
+func (t *BoltDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	r, err := t.GetRecord(uid)
+	if err != nil {
+		return
+	}
+	return r.Data, r.CreatedAt, r.TTL(time.Now()), nil
+}
+
+//stores the data with uid, the data is stored forever if ttl is nil or 0
+func (t *BoltDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	r := &Record{
+		UID:       uid,
+		CreatedAt: time.Now(),
+		Data:      payload,
+	}
+	if ttl != nil && *ttl > 0 {
+		expiresAt := r.CreatedAt.Add(*ttl)
+		r.ExpiresAt = &expiresAt
+	}
+	return t.PutRecord(r)
+}
+
+//returns the stored record by its UID, ErrExpired is returned for the expired record
+func (t *BoltDataStorage) GetRecord(uid string) (r *Record, err error) {
+	err = t.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDataBucket).Get([]byte(uid))
+		if b == nil {
+			return errors.New("uid not found")
+		}
+		r, err = decodeBoltRecord(uid, b)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return r, nil
+}
+
+//stores the record with the record uid
+func (t *BoltDataStorage) PutRecord(r *Record) error {
+	if r.UID == "" {
+		return errors.New("wrong uid")
+	}
+
+	r.Version = RecordVersion
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("wrong json data: %v", err)
+	}
+
+	return t.db.Update(func(tx *bolt.Tx) error {
+		if err := t.deleteTx(tx, r.UID); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltDataBucket).Put([]byte(r.UID), b); err != nil {
+			return fmt.Errorf("can't store the data: %v", err)
+		}
+		if r.ExpiresAt != nil {
+			if err := tx.Bucket(boltExpiryBucket).Put(boltExpiryKey(*r.ExpiresAt, r.UID), nil); err != nil {
+				return fmt.Errorf("can't store the expiry index: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+//Pass all stored items and call a callback function
+//expired items are skipped, ttl is the remaining time to live
+func (t *BoltDataStorage) Pass(callback func(uid string, createdAt time.Time, ttl time.Duration, data interface{})) error {
+	return t.PassRecords(func(r *Record) error {
+		callback(r.UID, r.CreatedAt, r.TTL(time.Now()), r.Data)
+		return nil
+	})
+}
+
+//Pass all stored records except expired ones and call a callback function
+func (t *BoltDataStorage) PassRecords(callback func(r *Record) error) error {
+	return t.db.View(func(tx *bolt.Tx) error {
+		now := time.Now()
+		return tx.Bucket(boltDataBucket).ForEach(func(k, v []byte) error {
+			r, err := decodeBoltRecord(string(k), v)
+			if err != nil || r.Expired(now) {
+				return nil
+			}
+			return callback(r)
+		})
+	})
+}
+
+//removes the data with uid from the storage
+func (t *BoltDataStorage) Delete(uid string) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		return t.deleteTx(tx, uid)
+	})
+}
+
+//removes all expired data from the storage, returns uids of the removed data
+func (t *BoltDataStorage) Sweep() (removed []string, err error) {
+	now := boltExpiryKey(time.Now(), "")
+	err = t.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltExpiryBucket).Cursor()
+		var expired [][]byte
+		for k, _ := c.First(); k != nil && bytes.Compare(k[:8], now[:8]) <= 0; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			uid := string(k[8:])
+			if err := t.deleteTx(tx, uid); err != nil {
+				return err
+			}
+			removed = append(removed, uid)
+		}
+		return nil
+	})
+	return
+}
+
+func (t *BoltDataStorage) Close() error {
+	return t.db.Close()
+}
+
+//removes the data and its expiry index
+func (t *BoltDataStorage) deleteTx(tx *bolt.Tx, uid string) error {
+	data := tx.Bucket(boltDataBucket)
+	b := data.Get([]byte(uid))
+	if b == nil {
+		return nil
+	}
+	if r, err := decodeBoltRecord(uid, b); err == nil && r.ExpiresAt != nil {
+		if err := tx.Bucket(boltExpiryBucket).Delete(boltExpiryKey(*r.ExpiresAt, uid)); err != nil {
+			return fmt.Errorf("can't remove the expiry index: %v", err)
+		}
+	}
+	if err := data.Delete([]byte(uid)); err != nil {
+		return fmt.Errorf("can't remove the data: %v", err)
+	}
+	return nil
+}
+
+func decodeBoltRecord(uid string, b []byte) (*Record, error) {
+	r, _, err := decodeRecord(uid, b)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse json from the database: %v", err)
+	}
+	return r, nil
+}
+
+//the expiry index key is the big-endian expiry time followed by the uid, so keys are ordered by the expiry time
+func boltExpiryKey(expiresAt time.Time, uid string) []byte {
+	k := make([]byte, 8, 8+len(uid))
+	binary.BigEndian.PutUint64(k, uint64(expiresAt.UnixNano()))
+	return append(k, uid...)
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"github.com/starshiptroopers/uidgenerator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the data is stored in the database file, the expired data is removed by Sweep using the expiry index
+func TestBoltDataStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ds, err := NewBoltDataStorage(filepath.Join(dir, "ftpdts.db"))
+	if err != nil {
+		t.Fatalf("can't open the storage: %v", err)
+	}
+	defer func() { _ = ds.Close() }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	uidForever, uidExpired, uidAlive := UIDGenerator.New(), UIDGenerator.New(), UIDGenerator.New()
+
+	expired, alive := time.Millisecond, time.Hour
+	for uid, ttl := range map[string]*time.Duration{uidForever: nil, uidExpired: &expired, uidAlive: &alive} {
+		if err := ds.Put(uid, map[string]interface{}{"S": uid}, ttl); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	//overwriting must replace the expiry index entry too
+	if err := ds.Put(uidAlive, map[string]interface{}{"S": uidAlive}, &alive); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	data, _, ttl, err := ds.Get(uidForever)
+	if err != nil || ttl != 0 {
+		t.Fatalf("zero ttl is expected for the data stored forever: %v, %v", ttl, err)
+	}
+	if d, ok := data.(map[string]interface{}); !ok || d["S"] != uidForever {
+		t.Errorf("wrong data has been read from the storage: %v", data)
+	}
+	if _, _, _, err := ds.Get(uidExpired); err != ErrExpired {
+		t.Errorf("ErrExpired is expected for the expired data, got: %v", err)
+	}
+
+	var passed []string
+	err = ds.PassRecords(func(r *Record) error {
+		passed = append(passed, r.UID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't read data: %v", err)
+	}
+	if len(passed) != 2 {
+		t.Errorf("the expired data shouldn't be passed: %v", passed)
+	}
+
+	removed, err := ds.Sweep()
+	if err != nil {
+		t.Fatalf("can't sweep the storage: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != uidExpired {
+		t.Errorf("only expired data should be removed: %v", removed)
+	}
+
+	if err := ds.Delete(uidAlive); err != nil {
+		t.Fatalf("can't delete data: %v", err)
+	}
+	if _, _, _, err := ds.Get(uidAlive); err == nil {
+		t.Errorf("the deleted data is still in the storage")
+	}
+	if removed, _ := ds.Sweep(); len(removed) != 0 {
+		t.Errorf("the expiry index of the deleted data still exists: %v", removed)
+	}
+}
+
+//the data is copied between the backends with its creation and expiry time
+func TestConvert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	fsDs := NewFsDataStorage(filepath.Join(dir, "data"), UIDGenerator)
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0700); err != nil {
+		t.Fatalf("can't create the data directory: %v", err)
+	}
+	boltDs, err := NewBoltDataStorage(filepath.Join(dir, "ftpdts.db"))
+	if err != nil {
+		t.Fatalf("can't open the storage: %v", err)
+	}
+	defer func() { _ = boltDs.Close() }()
+
+	uid1, uid2 := UIDGenerator.New(), UIDGenerator.New()
+	ttl := time.Hour
+	if err := fsDs.Put(uid1, "data1", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if err := fsDs.Put(uid2, "data2", &ttl); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+
+	n, err := Convert(fsDs, boltDs)
+	if err != nil || n != 2 {
+		t.Fatalf("can't convert the data: %d, %v", n, err)
+	}
+
+	src, err := fsDs.GetRecord(uid2)
+	if err != nil {
+		t.Fatalf("can't read the record: %v", err)
+	}
+	dst, err := boltDs.GetRecord(uid2)
+	if err != nil {
+		t.Fatalf("the record hasn't been converted: %v", err)
+	}
+	if dst.Data != "data2" || !dst.CreatedAt.Equal(src.CreatedAt) || dst.ExpiresAt == nil || !dst.ExpiresAt.Equal(*src.ExpiresAt) {
+		t.Errorf("the record has been converted with wrong fields: %+v", dst)
+	}
+	if _, _, ttl, err := boltDs.Get(uid1); err != nil || ttl != 0 {
+		t.Errorf("the data stored forever has been converted wrong: %v, %v", ttl, err)
+	}
+}
@@ -4,7 +4,7 @@
 
 //the storage that combines memory and persistent storage
 //saves data into the persistent and memory storage
-//returns data from memory storage
+//returns data from memory storage, the data missed in the memory storage is read from the persistent storage and cached
 package storage
 
 import (
@@ -19,34 +19,104 @@ type Storage interface {
 	Put(uid string, payload interface{}, ttl *time.Duration) error
 }
 
+//the storage which can remove the data
+type deleter interface {
+	Delete(uid string) error
+}
+
+//the memory storage which evicts the data stored in the persistent storage too only if it can be read again
+type persistentCache interface {
+	PutPersistent(uid string, payload interface{}, ttl *time.Duration) error
+}
+
 type DataStorage struct {
-	mds Storage //memory storage
-	pds Storage //persistent storage
+	mds        Storage       //memory storage
+	pds        Storage       //persistent storage
+	PersistTTL bool          //store the data with ttl into the persistent storage too
+	DefaultTTL time.Duration //ttl of the data stored with nil ttl, used when PersistTTL is on
 }
 
 func NewDataStorage(memoryStorage Storage, fsStorage Storage) *DataStorage {
 	return &DataStorage{
-		memoryStorage,
-		fsStorage,
+		mds:        memoryStorage,
+		pds:        fsStorage,
+		DefaultTTL: time.Hour * 24,
 	}
 }
 
 //get data from the storage
+//the data is read from the persistent storage on a memory storage miss and is put into the memory storage with its remaining ttl
 func (d *DataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
-	return d.mds.Get(uid)
+	payload, createdAt, ttl, err = d.mds.Get(uid)
+	if err == nil {
+		return
+	}
+
+	payload, createdAt, ttl, err = d.pds.Get(uid)
+	if err != nil {
+		return
+	}
+	//the data is returned even if it can't be cached, it's read from the persistent storage again next time
+	_ = d.Cache(uid, payload, &ttl)
+	return
+}
+
+//put the data which is stored in the persistent storage into the memory storage only
+func (d *DataStorage) Cache(uid string, payload interface{}, ttl *time.Duration) error {
+	if c, ok := d.mds.(persistentCache); ok {
+		return c.PutPersistent(uid, payload, ttl)
+	}
+	return d.mds.Put(uid, payload, ttl)
 }
 
 //put data into the storage
 //data is stored into memory storage with Time-To-Live = ttl
-//data also will be stored into the persistent storage if ttl == ttlForever
+//data also will be stored into the persistent storage if ttl == ttlForever or PersistTTL is on
+//the persistent data too large for the memory storage isn't cached, ErrTooLarge is returned only if the data isn't persisted,
+//so nothing is stored then
 func (d *DataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	persisted := false
 	if ttl != nil && *ttl == ttlForever {
 		if err := d.pds.Put(uid, payload, nil); err != nil {
 			return fmt.Errorf("can't store data into the persistent storage: %v", err)
 		}
+		persisted = true
+	} else if d.PersistTTL && (ttl == nil || *ttl > 0) {
+		pttl := d.DefaultTTL
+		if ttl != nil {
+			pttl = *ttl
+		}
+		if err := d.pds.Put(uid, payload, &pttl); err != nil {
+			return fmt.Errorf("can't store data into the persistent storage: %v", err)
+		}
+		persisted = true
+	}
+	put := d.mds.Put
+	if persisted {
+		put = d.Cache
 	}
-	if err := d.mds.Put(uid, payload, ttl); err != nil {
+	if err := put(uid, payload, ttl); err == ErrTooLarge {
+		if persisted {
+			return nil
+		}
+		return err
+	} else if err != nil {
 		return fmt.Errorf("can't store data into the memory storage: %v", err)
 	}
 	return nil
 }
+
+//removes the data from the persistent and the memory storage
+func (d *DataStorage) Delete(uid string) error {
+	if pds, ok := d.pds.(deleter); ok {
+		if err := pds.Delete(uid); err != nil {
+			return fmt.Errorf("can't remove data from the persistent storage: %v", err)
+		}
+	}
+	if mds, ok := d.mds.(deleter); ok {
+		if err := mds.Delete(uid); err != nil {
+			return fmt.Errorf("can't remove data from the memory storage: %v", err)
+		}
+	}
+	return nil
+}
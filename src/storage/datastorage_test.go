@@ -39,6 +39,11 @@ func (s *fakeStorage) Put(uid string, payload interface{}, ttl *time.Duration) e
 	return nil
 }
 
+func (s *fakeStorage) Delete(uid string) error {
+	delete(s.data, uid)
+	return nil
+}
+
 func CheckMemoryStorageTest(storage *DataStorage, storageM *fakeStorage, storageP *fakeStorage) error {
 	const UID = "CHECK_MEMORY_TEST"
 
@@ -111,6 +116,28 @@ func CheckReturnedData(payload interface{}) error {
 	return nil
 }
 
+func CheckReadThrough(storage *DataStorage, storageM *fakeStorage, storageP *fakeStorage) error {
+	const UID = "CHECK_READ_THROUGH_TEST"
+
+	//the data has been put into the persistent storage after the start
+	if err := storageP.Put(UID, &tData, nil); err != nil {
+		return fmt.Errorf("error on Put: %v", err)
+	}
+
+	dI, _, _, err := storage.Get(UID)
+	if err != nil {
+		return fmt.Errorf("error on Get: %v", err)
+	}
+	if err = CheckReturnedData(dI); err != nil {
+		return err
+	}
+
+	if _, _, _, err := storageM.Get(UID); err != nil {
+		return fmt.Errorf("data hasn't been cached in the memory storage: %v", err)
+	}
+	return nil
+}
+
 func TestDataStorage(t *testing.T) {
 
 	storageM, storageP := NewFakeStorage(), NewFakeStorage()
@@ -127,4 +154,40 @@ func TestDataStorage(t *testing.T) {
 	if err := CheckPersistentStorageTest(ds, storageM, storageP); err != nil {
 		t.Errorf("Persistent storage test: %v", err)
 	}
+
+	if err := CheckReadThrough(ds, storageM, storageP); err != nil {
+		t.Errorf("Read-through test: %v", err)
+	}
+
+	if _, _, _, err := ds.Get("CHECK_MISSING_TEST"); err == nil {
+		t.Errorf("Missing data has been returned")
+	}
+
+	//the data is deleted from both storages
+	if err := ds.Delete("CHECK_PERSISTENT_TEST"); err != nil {
+		t.Errorf("Can't delete data: %v", err)
+	}
+	if _, _, _, err := ds.Get("CHECK_PERSISTENT_TEST"); err == nil {
+		t.Errorf("Deleted data has been returned")
+	}
+}
+
+//the data too large for the memory storage is stored only if it's persistent, it's read from the persistent storage then
+func TestDataStorageTooLarge(t *testing.T) {
+	storageP := NewFakeStorage()
+	ds := NewDataStorage(NewMemoryDataStorage(0, 10), storageP)
+
+	if err := ds.Put("large", "0123456789", nil); err != ErrTooLarge {
+		t.Errorf("ErrTooLarge is expected for the data stored only in the memory, got: %v", err)
+	}
+	if _, _, _, err := ds.Get("large"); err == nil {
+		t.Errorf("the data too large for the memory storage has been stored")
+	}
+
+	if err := ds.Put("persistent", "0123456789", &ttlForever); err != nil {
+		t.Fatalf("the persistent data too large for the memory storage hasn't been stored: %v", err)
+	}
+	if d, _, _, err := ds.Get("persistent"); err != nil || d != "0123456789" {
+		t.Errorf("wrong persistent data has been read: %v, %v", d, err)
+	}
 }
@@ -3,19 +3,37 @@
 // license that can be found in the LICENSE file.
 
 //a simple persistent data storage, store JSON data in separate files
+//the data is stored in the versioned envelope (see Record) together with its creation and expiry time
+//files are written atomically, corrupted files are moved into the .corrupt folder on Pass
+//
+//files can be spread over the shard folders named by the uid prefix, for example ab/cd/abcdXXXX with 2 levels of 2 chars,
+//files stored in the flat layout are still readable, Migrate moves them into their shard folders
+//
+//the data stored with ttl is also listed in the .expiry folder by its expiry time, so Sweep doesn't read all files
+//
+//files written before the envelope was introduced contain the bare JSON data stored forever, they are still readable:
+//the creation time is the file modification time. Migrate rewrites such files into the envelope
 package storage
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"ftpdts/src/fsatomic"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	corruptDir = ".corrupt"
+	expiryDir  = ".expiry"
+)
+
 type UIDValidator interface {
 	Validate(string) (string, error)
 }
@@ -23,106 +41,351 @@ type UIDValidator interface {
 type FsDataStorage struct {
 	path         string
 	uidValidator UIDValidator
+	Logger       *log.Logger //Where corrupted files are reported to (default to stderr)
+	ShardLevels  uint        //number of the shard folders levels, 0 - flat layout
+	ShardWidth   uint        //number of the uid chars used to name the shard folder
+}
+
+//the stored file can't be parsed
+type corruptError struct {
+	error
 }
 
 func NewFsDataStorage(path string, uid UIDValidator) *FsDataStorage {
 	return &FsDataStorage{
-		path,
-		uid,
+		path:         path,
+		uidValidator: uid,
+		Logger:       log.New(os.Stderr, "", log.LstdFlags),
+		ShardWidth:   2,
 	}
 }
 
 //returns the stored data by its UID
-//ttl always 0
-//createdAt - the time the file was created
+//ttl is the remaining time to live, 0 if the data is stored forever
 func (t *FsDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
-
-	fPath, err := t.secureFilePath(uid)
+	r, err := t.GetRecord(uid)
 	if err != nil {
 		return
 	}
+	return r.Data, r.CreatedAt, r.TTL(time.Now()), nil
+}
 
-	info, err := os.Stat(fPath)
-	if err != nil {
-		err = fmt.Errorf("can't stat the file: %v", err)
-		return
+//stores the data into the file with name = uid
+//the data is stored forever if ttl is nil or 0
+func (t *FsDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	r := &Record{
+		UID:       uid,
+		CreatedAt: time.Now(),
+		Data:      payload,
+	}
+	if ttl != nil && *ttl > 0 {
+		expiresAt := r.CreatedAt.Add(*ttl)
+		r.ExpiresAt = &expiresAt
 	}
-	createdAt = info.ModTime()
+	return t.PutRecord(r)
+}
 
-	f, err := os.OpenFile(fPath, os.O_RDONLY, os.ModePerm) // #nosec G304
+//returns the stored record by its UID, ErrExpired is returned for the expired record
+func (t *FsDataStorage) GetRecord(uid string) (*Record, error) {
+	fPath, err := t.locate(uid)
 	if err != nil {
-		err = fmt.Errorf("can't open the file: %v", err)
-		return
+		return nil, err
 	}
+	r, _, err := t.read(uid, fPath)
+	if err != nil {
+		return nil, err
+	}
+	if r.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return r, nil
+}
 
-	defer func() {
-		_ = f.Close()
-	}()
-
-	b := bytes.NewBuffer(make([]byte, 0))
-	_, err = b.ReadFrom(f)
+//stores the record into the file with name = record uid
+func (t *FsDataStorage) PutRecord(r *Record) error {
+	fPath, err := t.secureFilePath(r.UID)
 	if err != nil {
-		err = fmt.Errorf("can't read the file: %v", err)
-		return
+		return err
 	}
-	err = json.Unmarshal(b.Bytes(), &payload)
+
+	r.Version = RecordVersion
+	b, err := json.Marshal(r)
 	if err != nil {
-		err = fmt.Errorf("can't parse json from file: %v", err)
-		return
+		return fmt.Errorf("wrong json data: %v", err)
 	}
 
-	return
+	if err := os.MkdirAll(filepath.Dir(fPath), 0700); err != nil {
+		return fmt.Errorf("can't create the shard path: %v", err)
+	}
+	//the expiry entry is written first, the entry without the expiring data is dropped by Sweep
+	if err := t.addExpiry(r); err != nil {
+		return err
+	}
+	if err := fsatomic.WriteFile(fPath, b, 0600); err != nil {
+		return err
+	}
+
+	//the copy stored in the flat layout is outdated now
+	if flat, err := t.flatFilePath(r.UID); err == nil && flat != fPath {
+		return t.remove(flat)
+	}
+	return nil
 }
 
-//stores the data into the file with name = uid
-//ttl isn't supported and ignored here
-func (t *FsDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+//Pass all stored items and call a callback function, it's called on start
+//expired items are skipped, ttl is the remaining time to live
+//corrupted items are moved into the .corrupt folder, temporary files left after a crash are removed,
+//the data stored with ttl before the .expiry folder was introduced is added into it
+func (t *FsDataStorage) Pass(callback func(uid string, createdAt time.Time, ttl time.Duration, data interface{})) error {
+	return t.pass(true, func(r *Record, fPath string, legacy bool) error {
+		if err := t.addExpiry(r); err != nil {
+			return err
+		}
+		if now := time.Now(); !r.Expired(now) {
+			callback(r.UID, r.CreatedAt, r.TTL(now), r.Data)
+		}
+		return nil
+	})
+}
 
+//Pass all stored records except expired ones and call a callback function
+func (t *FsDataStorage) PassRecords(callback func(r *Record) error) error {
+	return t.pass(false, func(r *Record, fPath string, legacy bool) error {
+		if r.Expired(time.Now()) {
+			return nil
+		}
+		return callback(r)
+	})
+}
+
+//removes the data with uid from the storage
+func (t *FsDataStorage) Delete(uid string) error {
 	fPath, err := t.secureFilePath(uid)
 	if err != nil {
 		return err
 	}
+	if err := t.remove(fPath); err != nil {
+		return err
+	}
+	if flat, err := t.flatFilePath(uid); err == nil && flat != fPath {
+		return t.remove(flat)
+	}
+	return nil
+}
 
-	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm) // #nosec G304
-	if err != nil {
-		return fmt.Errorf("can't open the file: %v", err)
+//removes all expired data from the storage, returns uids of the removed data
+//only the entries of the .expiry folder which are due are read
+func (t *FsDataStorage) Sweep() (removed []string, err error) {
+	now := time.Now()
+	entries, err := ioutil.ReadDir(filepath.Join(t.path, expiryDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("can't read the expiry entries: %v", err)
 	}
+	//the entries are sorted by the expiry time
+	for _, entry := range entries {
+		uid, expiresAt, ok := parseExpiryEntry(entry.Name())
+		if !ok {
+			continue
+		}
+		if now.Before(expiresAt) {
+			break
+		}
+		//the data can be rewritten with another expiry time or deleted since the entry has been added
+		if r, fPath, err := t.record(uid); err == nil && r.Expired(now) {
+			if err := t.remove(fPath); err != nil {
+				return removed, err
+			}
+			removed = append(removed, uid)
+		}
+		if err := os.Remove(filepath.Join(t.path, expiryDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("can't remove the expiry entry: %v", err)
+		}
+	}
+	return removed, nil
+}
 
-	defer func() {
-		_ = f.Close()
-	}()
+//returns the stored record by its UID including the expired one, and the file it's stored in
+func (t *FsDataStorage) record(uid string) (*Record, string, error) {
+	fPath, err := t.locate(uid)
+	if err != nil {
+		return nil, "", err
+	}
+	r, _, err := t.read(uid, fPath)
+	return r, fPath, err
+}
 
-	b, err := json.Marshal(payload)
+//lists the record stored with ttl in the .expiry folder
+func (t *FsDataStorage) addExpiry(r *Record) error {
+	if r.ExpiresAt == nil {
+		return nil
+	}
+	dir := filepath.Join(t.path, expiryDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("can't create the expiry path: %v", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, expiryEntry(r.UID, *r.ExpiresAt)), os.O_CREATE|os.O_WRONLY, 0600) // #nosec G304
 	if err != nil {
-		return fmt.Errorf("wrong json data: %v", err)
+		return fmt.Errorf("can't add the expiry entry: %v", err)
 	}
+	return f.Close()
+}
 
-	_, err = f.Write(b)
+//the expiry entry is the empty file named by the expiry time and uid, so the entries are sorted by the expiry time
+func expiryEntry(uid string, expiresAt time.Time) string {
+	return fmt.Sprintf("%020d-%s", expiresAt.UnixNano(), uid)
+}
 
+func parseExpiryEntry(name string) (uid string, expiresAt time.Time, ok bool) {
+	parts := strings.SplitN(name, "-", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		return fmt.Errorf("can't write the data to file: %v", err)
+		return "", time.Time{}, false
 	}
+	return parts[1], time.Unix(0, ns), true
+}
 
-	return nil
+//rewrites the files stored in the legacy format into the envelope
+//and moves the files into their shard folders, returns the number of rewritten files
+func (t *FsDataStorage) Migrate() (migrated int, err error) {
+	err = t.pass(false, func(r *Record, fPath string, legacy bool) error {
+		target, err := t.secureFilePath(r.UID)
+		if err != nil {
+			return err
+		}
+		if !legacy && target == fPath {
+			return nil
+		}
+		if err := t.PutRecord(r); err != nil {
+			return fmt.Errorf("can't migrate the data with uid %s: %v", r.UID, err)
+		}
+		if target != fPath {
+			if err := t.remove(fPath); err != nil {
+				return fmt.Errorf("can't migrate the data with uid %s: %v", r.UID, err)
+			}
+		}
+		migrated++
+		return nil
+	})
+	return
 }
 
-//Pass all stored items and call a callback function
-func (t *FsDataStorage) Pass(callback func(uid string, createdAt time.Time, data interface{})) error {
-	files, err := ioutil.ReadDir(t.path)
+//walks through the storage folders, reads all stored records, including expired ones, and calls the callback function
+//the folders started with dot are skipped
+//corrupted files are moved into the .corrupt folder, the stale temporary files are removed if removeTmp is set,
+//the younger ones can be written by the process being upgraded
+func (t *FsDataStorage) pass(removeTmp bool, callback func(r *Record, fPath string, legacy bool) error) error {
+	root, err := filepath.Abs(t.path)
 	if err != nil {
 		return fmt.Errorf("can't read the path: %v", err)
 	}
 
-	for _, f := range files {
-		p, c, _, err := t.Get(f.Name())
+	return filepath.Walk(root, func(fPath string, info os.FileInfo, err error) error {
 		if err != nil {
-			continue
+			if fPath == root {
+				return fmt.Errorf("can't read the path: %v", err)
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if fPath != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fsatomic.IsTmpFile(info.Name()) {
+			if removeTmp && fsatomic.IsStaleTmpFile(info) {
+				_ = os.Remove(fPath)
+			}
+			return nil
+		}
+
+		r, legacy, err := t.read(info.Name(), fPath)
+		if _, ok := err.(corruptError); ok {
+			t.quarantine(fPath, err)
+			return nil
+		}
+		if err != nil {
+			return nil
 		}
-		callback(f.Name(), c, p)
+		return callback(r, fPath, legacy)
+	})
+}
+
+//reads the record from the file, the legacy file is converted into the record
+func (t *FsDataStorage) read(uid string, fPath string) (r *Record, legacy bool, err error) {
+	if u, err := t.uidValidator.Validate(uid); err != nil || u != uid {
+		return nil, false, errors.New("wrong uid")
+	}
+
+	b, err := ioutil.ReadFile(fPath) // #nosec G304
+	if err != nil {
+		err = fmt.Errorf("can't read the file: %v", err)
+		return
+	}
+
+	r, legacy, err = decodeRecord(uid, b)
+	if err != nil {
+		err = corruptError{fmt.Errorf("can't parse json from file: %v", err)}
+		return
+	}
+	if !legacy {
+		return
+	}
+
+	info, err := os.Stat(fPath)
+	if err != nil {
+		err = fmt.Errorf("can't stat the file: %v", err)
+		return
+	}
+	r.CreatedAt = info.ModTime()
+	return
+}
+
+//removes the file
+func (t *FsDataStorage) remove(fPath string) error {
+	if err := fsatomic.Remove(fPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove the file: %v", err)
 	}
 	return nil
 }
 
+//moves the corrupted file into the .corrupt folder
+func (t *FsDataStorage) quarantine(fPath string, reason error) {
+	qPath := filepath.Join(t.path, corruptDir, filepath.Base(fPath))
+
+	if err := os.MkdirAll(filepath.Dir(qPath), 0700); err != nil {
+		t.Logger.Printf("Can't create the quarantine path for the corrupted file %s: %v", fPath, err)
+		return
+	}
+	if err := os.Rename(fPath, qPath); err != nil {
+		t.Logger.Printf("Can't move the corrupted file %s to the quarantine: %v", fPath, err)
+		return
+	}
+	t.Logger.Printf("Corrupted file %s has been moved to %s: %v", fPath, qPath, reason)
+}
+
+//returns the path of the existing file with uid
+//the flat layout is checked if the file isn't found in its shard folder
+func (t *FsDataStorage) locate(uid string) (string, error) {
+	fPath, err := t.secureFilePath(uid)
+	if err != nil || t.ShardLevels == 0 {
+		return fPath, err
+	}
+	if _, err := os.Stat(fPath); err == nil {
+		return fPath, nil
+	}
+	if flat, err := t.flatFilePath(uid); err == nil {
+		if _, err := os.Stat(flat); err == nil {
+			return flat, nil
+		}
+	}
+	return fPath, nil
+}
+
+//returns the file path of uid in the configured layout
 func (t *FsDataStorage) secureFilePath(uid string) (path string, err error) {
 	u, err := t.uidValidator.Validate(uid)
 	if err != nil || u != uid {
@@ -130,9 +393,51 @@ func (t *FsDataStorage) secureFilePath(uid string) (path string, err error) {
 		return
 	}
 
+	shard, err := t.shard(u)
+	if err != nil {
+		return
+	}
+
+	path, err = filepath.Abs(t.path + string(filepath.Separator) + shard + u)
+	if err != nil {
+		err = errors.New("wrong path")
+	}
+	return
+}
+
+//returns the file path of uid in the flat layout
+func (t *FsDataStorage) flatFilePath(uid string) (path string, err error) {
+	u, err := t.uidValidator.Validate(uid)
+	if err != nil || u != uid {
+		err = errors.New("wrong uid")
+		return
+	}
+
 	path, err = filepath.Abs(t.path + string(filepath.Separator) + u)
 	if err != nil {
 		err = errors.New("wrong path")
 	}
 	return
 }
+
+//returns the shard folders path of uid ended with the separator, for example ab/cd/
+func (t *FsDataStorage) shard(uid string) (string, error) {
+	levels, width := int(t.ShardLevels), int(t.ShardWidth)
+	if levels == 0 || width == 0 {
+		return "", nil
+	}
+	if len(uid) < levels*width {
+		return "", errors.New("wrong uid: too short for the shard layout")
+	}
+
+	var b strings.Builder
+	for i := 0; i < levels; i++ {
+		s := uid[i*width : (i+1)*width]
+		if strings.ContainsAny(s, `/\.`) {
+			return "", errors.New("wrong uid: can't be used as the shard folder name")
+		}
+		b.WriteString(s)
+		b.WriteRune(filepath.Separator)
+	}
+	return b.String(), nil
+}
@@ -2,9 +2,12 @@ package storage
 
 import (
 	"errors"
+	"ftpdts/src/fsatomic"
 	"github.com/starshiptroopers/uidgenerator"
 	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -71,7 +74,7 @@ func TestFsDataStorage(t *testing.T) {
 
 	//check data loading
 	var uid1ok, uid2ok bool
-	err = ds.Pass(func(uid string, createdAt time.Time, data interface{}) {
+	err = ds.Pass(func(uid string, createdAt time.Time, ttl time.Duration, data interface{}) {
 		if uid != uid1 {
 			uid1ok = true
 		} else if uid != uid2 {
@@ -93,3 +96,232 @@ func TestFsDataStorage(t *testing.T) {
 		t.Errorf("not all data received")
 	}
 }
+
+//the data stored with ttl expires and is removed by Sweep
+func TestFsDataStorageTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	ds := NewFsDataStorage(dir, UIDGenerator)
+	uidForever, uidExpired, uidAlive := UIDGenerator.New(), UIDGenerator.New(), UIDGenerator.New()
+
+	expired, alive := time.Millisecond, time.Hour
+	for uid, ttl := range map[string]*time.Duration{uidForever: nil, uidExpired: &expired, uidAlive: &alive} {
+		if err := ds.Put(uid, "data", ttl); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	if _, _, _, err := ds.Get(uidExpired); err != ErrExpired {
+		t.Errorf("ErrExpired is expected for the expired data, got: %v", err)
+	}
+
+	_, _, ttl, err := ds.Get(uidAlive)
+	if err != nil || ttl <= 0 || ttl > alive {
+		t.Errorf("wrong ttl of the data: %v, %v", ttl, err)
+	}
+
+	_, _, ttl, err = ds.Get(uidForever)
+	if err != nil || ttl != 0 {
+		t.Errorf("zero ttl is expected for the data stored forever: %v, %v", ttl, err)
+	}
+
+	//the expired data rewritten without ttl is kept
+	uidRewritten := UIDGenerator.New()
+	if err := ds.Put(uidRewritten, "data", &expired); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if err := ds.Put(uidRewritten, "data", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+
+	//the temporary file of the write in progress is kept by the sweep
+	tmpFile := filepath.Join(dir, fsatomic.TmpFilePrefix+uidAlive+"-1")
+	if err := ioutil.WriteFile(tmpFile, []byte(`"data"`), 0600); err != nil {
+		t.Fatalf("can't write the temporary file: %v", err)
+	}
+
+	removed, err := ds.Sweep()
+	if err != nil {
+		t.Fatalf("can't sweep the storage: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != uidExpired {
+		t.Errorf("only expired data should be removed: %v", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, uidExpired)); !os.IsNotExist(err) {
+		t.Errorf("the expired data file still exists")
+	}
+	if _, _, _, err := ds.Get(uidRewritten); err != nil {
+		t.Errorf("the data rewritten without ttl has been removed: %v", err)
+	}
+	if _, err := os.Stat(tmpFile); err != nil {
+		t.Errorf("the temporary file has been removed by the sweep: %v", err)
+	}
+	//only the entry of the alive data is left
+	if entries, err := ioutil.ReadDir(filepath.Join(dir, expiryDir)); err != nil || len(entries) != 1 {
+		t.Errorf("wrong expiry entries are left: %d, %v", len(entries), err)
+	}
+}
+
+//corrupted files are moved into the quarantine, temporary files are removed
+func TestFsDataStorageCorrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	ds := NewFsDataStorage(dir, UIDGenerator)
+	ds.Logger = log.New(ioutil.Discard, "", 0)
+	uidGood, uidCorrupted := UIDGenerator.New(), UIDGenerator.New()
+
+	if err := ds.Put(uidGood, "data", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	//truncated json is left after a crash in the middle of a write
+	if err := ioutil.WriteFile(filepath.Join(dir, uidCorrupted), []byte(`{"S":`), 0600); err != nil {
+		t.Fatalf("can't write the corrupted file: %v", err)
+	}
+	//the stale temporary file is left by a crashed process, the young one can be written by the process being upgraded
+	tmpFile, youngTmpFile := filepath.Join(dir, fsatomic.TmpFilePrefix+uidGood+"-1"), filepath.Join(dir, fsatomic.TmpFilePrefix+uidGood+"-2")
+	for _, f := range []string{tmpFile, youngTmpFile} {
+		if err := ioutil.WriteFile(f, []byte(`"data"`), 0600); err != nil {
+			t.Fatalf("can't write the temporary file: %v", err)
+		}
+	}
+	stale := time.Now().Add(-fsatomic.StaleTmpFileAge * 2)
+	if err := os.Chtimes(tmpFile, stale, stale); err != nil {
+		t.Fatalf("can't change the temporary file time: %v", err)
+	}
+
+	var passed []string
+	err = ds.Pass(func(uid string, createdAt time.Time, ttl time.Duration, data interface{}) {
+		passed = append(passed, uid)
+	})
+	if err != nil {
+		t.Fatalf("can't read data: %v", err)
+	}
+
+	if len(passed) != 1 || passed[0] != uidGood {
+		t.Errorf("only the good data should be passed: %v", passed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, corruptDir, uidCorrupted)); err != nil {
+		t.Errorf("the corrupted file hasn't been moved to the quarantine: %v", err)
+	}
+	if _, err := os.Stat(tmpFile); !os.IsNotExist(err) {
+		t.Errorf("the temporary file hasn't been removed")
+	}
+	if _, err := os.Stat(youngTmpFile); err != nil {
+		t.Errorf("the young temporary file has been removed: %v", err)
+	}
+}
+
+//the bare JSON data files are readable and migrated into the envelope
+func TestFsDataStorageMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	ds := NewFsDataStorage(dir, UIDGenerator)
+	uidLegacy, uidCurrent := UIDGenerator.New(), UIDGenerator.New()
+
+	//the bare data looks like the envelope, but the uid doesn't match
+	legacy := `{"version":1,"uid":"other","data":"legacy"}`
+	if err := ioutil.WriteFile(filepath.Join(dir, uidLegacy), []byte(legacy), 0600); err != nil {
+		t.Fatalf("can't write the legacy file: %v", err)
+	}
+	createdAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	_ = os.Chtimes(filepath.Join(dir, uidLegacy), createdAt, createdAt)
+
+	if err := ds.Put(uidCurrent, "current", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+
+	check := func() {
+		d, c, _, err := ds.Get(uidLegacy)
+		if err != nil {
+			t.Fatalf("can't read the legacy data: %v", err)
+		}
+		m, ok := d.(map[string]interface{})
+		if !ok || m["data"] != "legacy" || !c.Equal(createdAt) {
+			t.Errorf("wrong legacy data has been read: %v, %v", d, c)
+		}
+	}
+	check()
+
+	migrated, err := ds.Migrate()
+	if err != nil || migrated != 1 {
+		t.Fatalf("only the legacy file should be migrated: %d, %v", migrated, err)
+	}
+	check()
+
+	r, err := ds.GetRecord(uidLegacy)
+	if err != nil || r.Version != RecordVersion || r.UID != uidLegacy {
+		t.Errorf("the legacy file hasn't been rewritten into the envelope: %+v, %v", r, err)
+	}
+}
+
+//the data is stored into the shard folders, the flat layout is readable and migrated
+func TestFsDataStorageShards(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	flat := NewFsDataStorage(dir, UIDGenerator)
+	sharded := NewFsDataStorage(dir, UIDGenerator)
+	sharded.ShardLevels = 2
+	uidFlat, uidSharded := UIDGenerator.New(), UIDGenerator.New()
+	shardPath := func(uid string) string {
+		return filepath.Join(dir, uid[0:2], uid[2:4], uid)
+	}
+
+	if err := flat.Put(uidFlat, "flat", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if err := sharded.Put(uidSharded, "sharded", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if _, err := os.Stat(shardPath(uidSharded)); err != nil {
+		t.Errorf("the data hasn't been stored into the shard folder: %v", err)
+	}
+
+	if d, _, _, err := sharded.Get(uidFlat); err != nil || d != "flat" {
+		t.Errorf("the data stored in the flat layout isn't readable: %v, %v", d, err)
+	}
+
+	var passed int
+	err = sharded.Pass(func(uid string, createdAt time.Time, ttl time.Duration, data interface{}) {
+		passed++
+	})
+	if err != nil || passed != 2 {
+		t.Errorf("all data should be passed through the shard folders: %d, %v", passed, err)
+	}
+
+	migrated, err := sharded.Migrate()
+	if err != nil || migrated != 1 {
+		t.Fatalf("only the flat data should be migrated: %d, %v", migrated, err)
+	}
+	if _, err := os.Stat(shardPath(uidFlat)); err != nil {
+		t.Errorf("the data hasn't been moved into the shard folder: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, uidFlat)); !os.IsNotExist(err) {
+		t.Errorf("the data still exists in the flat layout")
+	}
+}
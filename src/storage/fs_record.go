@@ -0,0 +1,71 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/json"
+	"time"
+)
+
+//the current version of the persistent file format
+const RecordVersion = 1
+
+//Record is the envelope the data is stored in the persistent file with
+type Record struct {
+	Version   int               `json:"version"`
+	UID       string            `json:"uid"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"` //nil if the data is stored forever
+	Meta      map[string]string `json:"meta,omitempty"`      //any additional information, for example owner or template
+	Data      interface{}       `json:"data"`
+}
+
+//returns the remaining time to live, 0 if the data is stored forever
+func (r *Record) TTL(now time.Time) time.Duration {
+	if r.ExpiresAt == nil {
+		return 0
+	}
+	return r.ExpiresAt.Sub(now)
+}
+
+//returns true if the data is expired
+func (r *Record) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+type rawRecord struct {
+	Version   int               `json:"version"`
+	UID       string            `json:"uid"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt *time.Time        `json:"expiresAt"`
+	Meta      map[string]string `json:"meta"`
+	Data      *json.RawMessage  `json:"data"`
+}
+
+//decodes the file content stored with uid
+//legacy is true if the content is the bare JSON data stored before the envelope was introduced
+func decodeRecord(uid string, b []byte) (r *Record, legacy bool, err error) {
+	var raw rawRecord
+	//the bare data can't be distinguished by the version field only, so the uid and the data are checked too
+	if json.Unmarshal(b, &raw) == nil && raw.Version > 0 && raw.UID == uid && raw.Data != nil {
+		r = &Record{
+			Version:   raw.Version,
+			UID:       raw.UID,
+			CreatedAt: raw.CreatedAt,
+			ExpiresAt: raw.ExpiresAt,
+			Meta:      raw.Meta,
+		}
+		if err = json.Unmarshal(*raw.Data, &r.Data); err != nil {
+			return nil, false, err
+		}
+		return r, false, nil
+	}
+
+	r = &Record{Version: 0, UID: uid}
+	if err = json.Unmarshal(b, &r.Data); err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"ftpdts/src/clock"
+	"log"
+	"sync"
+	"time"
+)
+
+//MemoryDataStorage is the data cache in the process memory
+//the number and the size of cached items can be bounded, the least recently used items are evicted when the bound is reached
+//items stored with PutPersistent are evicted only if they can be read again from the backing persistent storage (Backed is on)
+//expired items are removed on access, by Sweep and by the background sweep started with SweepEvery
+type MemoryDataStorage struct {
+	mu         sync.Mutex
+	items      map[string]*list.Element
+	lru        *list.List //front is the most recently used item
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	evictions  uint64
+	evicted    uint64        //bytes
+	stopSweep  chan struct{} //closed to stop the background sweep
+	DefaultTTL time.Duration //ttl of the data stored with nil ttl
+	Backed     bool          //items stored with PutPersistent are in the persistent storage too, so they can be evicted
+	Logger     *log.Logger   //evictions are logged if it's set
+	Clock      clock.Clock   //the source of the current time the items expire by
+	//called with the uid of the expired item when it's removed, the items stored with PutPersistent are expired by the persistent storage
+	Expired func(uid string)
+}
+
+//the data is larger than maxBytes of the cache
+var ErrTooLarge = errors.New("the data is too large for the cache")
+
+type memoryItem struct {
+	uid        string
+	createdAt  time.Time
+	ttl        time.Duration
+	expires    time.Time //zero if the data is stored forever
+	payload    interface{}
+	size       int64
+	persistent bool
+}
+
+//MemoryStats is the memory cache usage
+type MemoryStats struct {
+	Entries      int
+	Bytes        int64
+	Evictions    uint64
+	EvictedBytes uint64
+}
+
+//maxEntries is the maximum number of the cached items, maxBytes is the maximum size of the cached data, 0 - unlimited
+//the data size is the length of its JSON representation
+func NewMemoryDataStorage(maxEntries int, maxBytes int64) *MemoryDataStorage {
+	return &MemoryDataStorage{
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		DefaultTTL: time.Hour * 24,
+		Clock:      clock.System,
+	}
+}
+
+//returns the cached data by its UID, ttl is the time to live the data has been stored with
+func (t *MemoryDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	var expired []*memoryItem
+	defer func() { t.expired(expired) }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.items[uid]
+	if !ok {
+		err = errors.New("uid not found")
+		return
+	}
+	item := e.Value.(*memoryItem)
+	if item.expired(t.Clock.Now()) {
+		t.remove(e)
+		expired = append(expired, item)
+		err = errors.New("uid not found")
+		return
+	}
+	t.lru.MoveToFront(e)
+	return item.payload, item.createdAt, item.ttl, nil
+}
+
+//stores the data with uid, DefaultTTL is used if ttl is nil, the data is stored forever if ttl is 0
+func (t *MemoryDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	return t.put(uid, payload, ttl, false)
+}
+
+//stores the data which is stored in the persistent storage too
+func (t *MemoryDataStorage) PutPersistent(uid string, payload interface{}, ttl *time.Duration) error {
+	return t.put(uid, payload, ttl, true)
+}
+
+//removes the data with uid from the cache
+func (t *MemoryDataStorage) Delete(uid string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e, ok := t.items[uid]; ok {
+		t.remove(e)
+	}
+	return nil
+}
+
+//returns the number of the cached items
+func (t *MemoryDataStorage) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lru.Len()
+}
+
+//returns the cache usage and the eviction counters
+func (t *MemoryDataStorage) Stats() MemoryStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return MemoryStats{
+		Entries:      t.lru.Len(),
+		Bytes:        t.bytes,
+		Evictions:    t.evictions,
+		EvictedBytes: t.evicted,
+	}
+}
+
+//returns the cache metrics
+func (t *MemoryDataStorage) Metrics() map[string]uint64 {
+	s := t.Stats()
+	return map[string]uint64{
+		"ftpdts_cache_entries":         uint64(s.Entries),
+		"ftpdts_cache_bytes":           uint64(s.Bytes),
+		"ftpdts_cache_evictions_total": s.Evictions,
+		"ftpdts_cache_evicted_bytes":   s.EvictedBytes,
+	}
+}
+
+func (t *MemoryDataStorage) put(uid string, payload interface{}, ttl *time.Duration, persistent bool) error {
+	if ttl == nil {
+		ttl = &t.DefaultTTL
+	}
+	if *ttl < 0 {
+		return errors.New("wrong ttl")
+	}
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return errors.New("wrong json data")
+	}
+	item := &memoryItem{
+		uid:        uid,
+		createdAt:  t.Clock.Now(),
+		ttl:        *ttl,
+		payload:    payload,
+		size:       int64(len(b)),
+		persistent: persistent,
+	}
+	if *ttl > 0 {
+		item.expires = item.createdAt.Add(*ttl)
+	}
+	if t.maxBytes > 0 && item.size > t.maxBytes {
+		return ErrTooLarge
+	}
+
+	var expired []*memoryItem
+	defer func() { t.expired(expired) }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e, ok := t.items[uid]; ok {
+		t.remove(e)
+	}
+	t.items[uid] = t.lru.PushFront(item)
+	t.bytes += item.size
+	expired = t.evict()
+	return nil
+}
+
+//removes the expired items, returns the number of the removed ones
+func (t *MemoryDataStorage) Sweep() int {
+	var expired []*memoryItem
+	defer func() { t.expired(expired) }()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.Clock.Now()
+	for e := t.lru.Back(); e != nil; {
+		prev := e.Prev()
+		if item := e.Value.(*memoryItem); item.expired(now) {
+			t.remove(e)
+			expired = append(expired, item)
+		}
+		e = prev
+	}
+	return len(expired)
+}
+
+//removes the expired items every interval in the background until the storage is closed
+//the cache can be swept more often than the persistent storage, so the expired data doesn't stay in the memory
+func (t *MemoryDataStorage) SweepEvery(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopSweep != nil {
+		close(t.stopSweep)
+	}
+	stop := make(chan struct{})
+	t.stopSweep = stop
+
+	go func() {
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-tk.C:
+				t.Sweep()
+			}
+		}
+	}()
+}
+
+//stops the background sweep
+func (t *MemoryDataStorage) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopSweep != nil {
+		close(t.stopSweep)
+		t.stopSweep = nil
+	}
+	return nil
+}
+
+//removes the least recently used items until the cache fits the bounds
+//expired items are removed first, then the items stored only in the memory,
+//persistent items are evicted the last and only if the cache is backed by the persistent storage
+//returns the removed expired items
+func (t *MemoryDataStorage) evict() (expired []*memoryItem) {
+	var cnt, size int64
+	now := t.Clock.Now()
+	for e := t.lru.Back(); e != nil && t.full(); {
+		prev := e.Prev()
+		if item := e.Value.(*memoryItem); item.expired(now) {
+			t.remove(e)
+			expired = append(expired, item)
+		}
+		e = prev
+	}
+	//the items stored only in the memory are evicted before the persistent ones, which can be read again
+	for _, persistent := range []bool{false, true} {
+		if persistent && !t.Backed {
+			break
+		}
+		for e := t.lru.Back(); e != nil && t.full(); {
+			prev := e.Prev()
+			//the just stored item is at the front, it's never evicted
+			if item := e.Value.(*memoryItem); e != t.lru.Front() && item.persistent == persistent {
+				t.remove(e)
+				cnt++
+				size += item.size
+			}
+			e = prev
+		}
+	}
+	if cnt == 0 {
+		if t.full() && t.Logger != nil {
+			t.Logger.Printf("The memory cache is over its bounds, there are no items to evict")
+		}
+		return
+	}
+	t.evictions += uint64(cnt)
+	t.evicted += uint64(size)
+	if t.Logger != nil {
+		t.Logger.Printf("%d items (%d bytes) has been evicted from the memory cache", cnt, size)
+	}
+	return
+}
+
+//calls the Expired callback, it's called without the lock held
+func (t *MemoryDataStorage) expired(items []*memoryItem) {
+	if t.Expired == nil {
+		return
+	}
+	for _, item := range items {
+		if !item.persistent {
+			t.Expired(item.uid)
+		}
+	}
+}
+
+func (item *memoryItem) expired(now time.Time) bool {
+	return !item.expires.IsZero() && !now.Before(item.expires)
+}
+
+func (t *MemoryDataStorage) full() bool {
+	return (t.maxEntries > 0 && t.lru.Len() > t.maxEntries) || (t.maxBytes > 0 && t.bytes > t.maxBytes)
+}
+
+func (t *MemoryDataStorage) remove(e *list.Element) {
+	item := e.Value.(*memoryItem)
+	t.lru.Remove(e)
+	t.bytes -= item.size
+	delete(t.items, item.uid)
+}
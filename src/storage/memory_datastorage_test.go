@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"testing"
+	"time"
+)
+
+//the least recently used items are evicted when the cache is full, the expired items aren't returned
+func TestMemoryDataStorage(t *testing.T) {
+	ds := NewMemoryDataStorage(2, 0)
+
+	forever, expired := time.Duration(0), time.Millisecond
+	for _, uid := range []string{"uid1", "uid2"} {
+		if err := ds.Put(uid, uid, &forever); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	//uid1 becomes the most recently used, so uid2 is evicted
+	if _, _, _, err := ds.Get("uid1"); err != nil {
+		t.Fatalf("can't get data from the storage: %v", err)
+	}
+	if err := ds.Put("uid3", "uid3", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if _, _, _, err := ds.Get("uid2"); err == nil {
+		t.Errorf("the least recently used data hasn't been evicted")
+	}
+	if ds.Len() != 2 {
+		t.Errorf("wrong number of the cached items: %d", ds.Len())
+	}
+
+	payload, _, ttl, err := ds.Get("uid3")
+	if err != nil || payload != "uid3" || ttl != ds.DefaultTTL {
+		t.Errorf("wrong data has been read from the storage: %v, %v, %v", payload, ttl, err)
+	}
+
+	if err := ds.Put("uid1", "uid1", &expired); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if _, _, _, err := ds.Get("uid1"); err == nil {
+		t.Errorf("the expired data has been returned")
+	}
+	if ds.Len() != 1 {
+		t.Errorf("the expired data hasn't been removed: %d", ds.Len())
+	}
+}
+
+//the expired items are reported when they are removed by Get or Sweep, the persistent ones aren't
+func TestMemoryDataStorageExpired(t *testing.T) {
+	ds := NewMemoryDataStorage(0, 0)
+	var expired []string
+	ds.Expired = func(uid string) {
+		expired = append(expired, uid)
+		//the callback is called without the lock held
+		_ = ds.Len()
+	}
+
+	ttl := time.Millisecond
+	for _, uid := range []string{"uid1", "uid2"} {
+		if err := ds.Put(uid, uid, &ttl); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	if err := ds.PutPersistent("persistent", "persistent", &ttl); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if err := ds.Put("uid3", "uid3", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	if _, _, _, err := ds.Get("uid1"); err == nil {
+		t.Errorf("the expired data has been returned")
+	}
+	if n := ds.Sweep(); n != 2 || ds.Len() != 1 {
+		t.Errorf("wrong number of the removed items: %d, %d items are left", n, ds.Len())
+	}
+	if len(expired) != 2 || expired[0] != "uid1" || expired[1] != "uid2" {
+		t.Errorf("wrong expired items: %v", expired)
+	}
+}
+
+//the expired items of the unbounded cache are removed by the background sweep without access to them
+func TestMemoryDataStorageSweepEvery(t *testing.T) {
+	ds := NewMemoryDataStorage(0, 0)
+	expired := make(chan string, 1)
+	ds.Expired = func(uid string) { expired <- uid }
+	ds.SweepEvery(time.Millisecond * 10)
+	defer func() { _ = ds.Close() }()
+
+	ttl := time.Millisecond
+	if err := ds.Put("uid1", "uid1", &ttl); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	select {
+	case uid := <-expired:
+		if uid != "uid1" || ds.Len() != 0 {
+			t.Errorf("wrong expired item: %s, %d items are left", uid, ds.Len())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the expired data hasn't been swept")
+	}
+}
+
+//the size of the cached data is bounded, the persistent items are evicted only if the cache is backed
+func TestMemoryDataStorageBytes(t *testing.T) {
+	ds := NewMemoryDataStorage(0, 30)
+
+	//every item takes 12 bytes: "0123456789" with the quotes
+	if err := ds.PutPersistent("persistent", "0123456789", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	for _, uid := range []string{"uid1", "uid2", "uid3"} {
+		if err := ds.Put(uid, "0123456789", nil); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	if _, _, _, err := ds.Get("persistent"); err != nil {
+		t.Errorf("the persistent data has been evicted without the backing storage")
+	}
+	for uid, cached := range map[string]bool{"uid1": false, "uid2": false, "uid3": true} {
+		if _, _, _, err := ds.Get(uid); (err == nil) != cached {
+			t.Errorf("wrong eviction of %s: %v", uid, err)
+		}
+	}
+	if s := ds.Stats(); s.Entries != 2 || s.Bytes != 24 || s.Evictions != 2 || s.EvictedBytes != 24 {
+		t.Errorf("wrong cache stats: %+v", s)
+	}
+
+	ds.Backed = true
+	if _, _, _, err := ds.Get("uid3"); err != nil {
+		t.Fatalf("can't get data from the storage: %v", err)
+	}
+	//the data stored only in the memory is evicted first, though the persistent data is used less recently
+	if err := ds.Put("uid4", "0123456789", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if _, _, _, err := ds.Get("uid3"); err == nil {
+		t.Errorf("the data stored only in the memory hasn't been evicted before the persistent data")
+	}
+	for _, uid := range []string{"persistent2", "persistent3"} {
+		if err := ds.PutPersistent(uid, "0123456789", nil); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	if _, _, _, err := ds.Get("uid4"); err == nil {
+		t.Errorf("the data stored only in the memory hasn't been evicted before the persistent data")
+	}
+	if _, _, _, err := ds.Get("persistent"); err == nil {
+		t.Errorf("the least recently used persistent data hasn't been evicted from the backed cache")
+	}
+	if _, _, _, err := ds.Get("persistent2"); err != nil {
+		t.Errorf("the recently used persistent data has been evicted: %v", err)
+	}
+
+	if err := ds.Put("large", "012345678901234567890123456789", nil); err == nil {
+		t.Errorf("the data larger than the cache has been stored")
+	}
+	if m := ds.Metrics(); m["ftpdts_cache_evictions_total"] != 5 {
+		t.Errorf("wrong cache metrics: %v", m)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"time"
+)
+
+//PersistentStorage is the storage the data survives restarts in
+//implemented by FsDataStorage, BoltDataStorage and SQLDataStorage
+type PersistentStorage interface {
+	Storage
+	GetRecord(uid string) (*Record, error)
+	PutRecord(r *Record) error
+	Pass(callback func(uid string, createdAt time.Time, ttl time.Duration, data interface{})) error
+	PassRecords(callback func(r *Record) error) error
+	Delete(uid string) error
+	Sweep() (removed []string, err error)
+}
+
+//copies all not expired records from one persistent storage into another, returns the number of copied records
+//records keep their creation and expiry time
+func Convert(from PersistentStorage, to PersistentStorage) (converted int, err error) {
+	err = from.PassRecords(func(r *Record) error {
+		if err := to.PutRecord(r); err != nil {
+			return fmt.Errorf("can't convert the data with uid %s: %v", r.UID, err)
+		}
+		converted++
+		return nil
+	})
+	return
+}
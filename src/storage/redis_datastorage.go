@@ -0,0 +1,113 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"time"
+)
+
+//RedisDataStorage is the data cache in the Redis (or Redis protocol compatible) server
+//it's shared by several ftpdts instances, so the data posted to one instance is served by others
+//the data expires with the native redis key ttl
+type RedisDataStorage struct {
+	client     *redis.Client
+	prefix     string
+	DefaultTTL time.Duration //ttl of the data stored with nil ttl
+	Timeout    time.Duration //timeout of the redis commands
+}
+
+type redisRecord struct {
+	CreatedAt time.Time     `json:"createdAt"`
+	TTL       time.Duration `json:"ttl"`
+	Data      interface{}   `json:"data"`
+}
+
+//prefix is prepended to the uid to make the redis key, so the redis database can be shared with other applications
+func NewRedisDataStorage(opts *redis.Options, prefix string) *RedisDataStorage {
+	return &RedisDataStorage{
+		client:     redis.NewClient(opts),
+		prefix:     prefix,
+		DefaultTTL: time.Hour * 24,
+		Timeout:    time.Second * 5,
+	}
+}
+
+//checks the connection to the redis server
+func (t *RedisDataStorage) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	if err := t.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("can't connect to the redis server: %v", err)
+	}
+	return nil
+}
+
+//returns the stored data by its UID, ttl is the time to live the data has been stored with
+func (t *RedisDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+
+	b, err := t.client.Get(ctx, t.prefix+uid).Bytes()
+	if err == redis.Nil {
+		err = errors.New("uid not found")
+		return
+	}
+	if err != nil {
+		err = fmt.Errorf("can't read the data from redis: %v", err)
+		return
+	}
+
+	var r redisRecord
+	if err = json.Unmarshal(b, &r); err != nil {
+		err = fmt.Errorf("can't parse json from redis: %v", err)
+		return
+	}
+	return r.Data, r.CreatedAt, r.TTL, nil
+}
+
+//stores the data with uid, DefaultTTL is used if ttl is nil, the data is stored forever if ttl is 0
+func (t *RedisDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	if ttl == nil {
+		ttl = &t.DefaultTTL
+	}
+	if *ttl < 0 {
+		return errors.New("wrong ttl")
+	}
+
+	b, err := json.Marshal(&redisRecord{
+		CreatedAt: time.Now(),
+		TTL:       *ttl,
+		Data:      payload,
+	})
+	if err != nil {
+		return fmt.Errorf("wrong json data: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	if err := t.client.Set(ctx, t.prefix+uid, b, *ttl).Err(); err != nil {
+		return fmt.Errorf("can't store the data into redis: %v", err)
+	}
+	return nil
+}
+
+//removes the data with uid from the storage
+func (t *RedisDataStorage) Delete(uid string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), t.Timeout)
+	defer cancel()
+	if err := t.client.Del(ctx, t.prefix+uid).Err(); err != nil {
+		return fmt.Errorf("can't remove the data from redis: %v", err)
+	}
+	return nil
+}
+
+func (t *RedisDataStorage) Close() error {
+	return t.client.Close()
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+//the data is stored with the native key ttl and is visible to every client of the redis server
+func TestRedisDataStorage(t *testing.T) {
+	srv := miniredis.RunT(t)
+
+	ds := NewRedisDataStorage(&redis.Options{Addr: srv.Addr()}, "ftpdts:")
+	defer func() { _ = ds.Close() }()
+	if err := ds.Ping(); err != nil {
+		t.Fatalf("can't connect to the redis server: %v", err)
+	}
+	//another replica connected to the same server
+	replica := NewRedisDataStorage(&redis.Options{Addr: srv.Addr()}, "ftpdts:")
+	defer func() { _ = replica.Close() }()
+
+	ttl, forever := time.Minute, time.Duration(0)
+	if err := ds.Put("uid1", map[string]interface{}{"S": "test"}, &ttl); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if err := ds.Put("uid2", "forever", &forever); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+	if err := ds.Put("uid3", "default", nil); err != nil {
+		t.Fatalf("can't put data into the storage: %v", err)
+	}
+
+	data, _, dttl, err := replica.Get("uid1")
+	if err != nil {
+		t.Fatalf("the data isn't shared between replicas: %v", err)
+	}
+	if d, ok := data.(map[string]interface{}); !ok || d["S"] != "test" || dttl != ttl {
+		t.Errorf("wrong data has been read from the storage: %v, %v", data, dttl)
+	}
+
+	if srv.TTL("ftpdts:uid1") != ttl || srv.TTL("ftpdts:uid2") != 0 || srv.TTL("ftpdts:uid3") != ds.DefaultTTL {
+		t.Errorf("wrong native key ttl: %v, %v, %v", srv.TTL("ftpdts:uid1"), srv.TTL("ftpdts:uid2"), srv.TTL("ftpdts:uid3"))
+	}
+
+	srv.FastForward(ttl)
+	if _, _, _, err := replica.Get("uid1"); err == nil {
+		t.Errorf("the expired data is still in the storage")
+	}
+	if _, _, _, err := replica.Get("uid2"); err != nil {
+		t.Errorf("the data stored forever has expired: %v", err)
+	}
+
+	if err := ds.Delete("uid2"); err != nil {
+		t.Fatalf("can't delete data: %v", err)
+	}
+	if _, _, _, err := replica.Get("uid2"); err == nil {
+		t.Errorf("the deleted data is still in the storage")
+	}
+}
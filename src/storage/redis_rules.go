@@ -0,0 +1,250 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"time"
+)
+
+//checks the rules of KEYS[1] at ARGV[1] unix milliseconds and counts the download if ARGV[2] is 1
+//returns 0 if the download is allowed, the negative code of the reason otherwise, see redisRulesErrors
+var redisAcquire = redis.NewScript(`
+local r = redis.call('HMGET', KEYS[1], 'maxDownloads', 'downloads', 'notBefore', 'expiresAt')
+if not r[1] then
+	return 0
+end
+local now = tonumber(ARGV[1])
+if now < tonumber(r[3]) then
+	return -1
+end
+local expiresAt = tonumber(r[4])
+if expiresAt ~= 0 and now >= expiresAt then
+	return -2
+end
+local max = tonumber(r[1])
+if max ~= 0 and tonumber(r[2]) >= max then
+	return -3
+end
+if ARGV[2] == '1' then
+	redis.call('HINCRBY', KEYS[1], 'downloads', 1)
+end
+return 0
+`)
+
+//marks the first download of KEYS[1] as notified, the new hash gets ARGV[1] milliseconds ttl if it's positive
+//returns 1 for the first download, 0 otherwise
+var redisMarkDownloaded = redis.NewScript(`
+local created = redis.call('EXISTS', KEYS[1]) == 0
+if redis.call('HSETNX', KEYS[1], 'notified', 1) == 0 then
+	return 0
+end
+local ttl = tonumber(ARGV[1])
+if created and ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+var redisRulesErrors = map[int64]error{
+	-1: ErrNotAvailableYet,
+	-2: ErrExpired,
+	-3: ErrDownloadsExceeded,
+}
+
+//RedisRulesStorage keeps the download rules in the Redis server shared by several ftpdts instances,
+//so the download limits and the time window are enforced by all of them, the downloads are counted atomically
+//the rules are stored in the hash with the native key ttl, the persistent rules with the expiry time are listed in the sorted set for Sweep
+type RedisRulesStorage struct {
+	client     *redis.Client
+	prefix     string
+	DefaultTTL time.Duration //rules lifetime when the ttl isn't defined
+	Timeout    time.Duration //timeout of the redis commands
+}
+
+//prefix is prepended to the redis keys, the same prefix as RedisDataStorage uses can be given
+func NewRedisRulesStorage(opts *redis.Options, prefix string) *RedisRulesStorage {
+	return &RedisRulesStorage{
+		client:     redis.NewClient(opts),
+		prefix:     prefix,
+		DefaultTTL: time.Hour * 24,
+		Timeout:    time.Second * 5,
+	}
+}
+
+//attach the rules to uid
+//the ttl has the same meaning as for DataStorage.Put, the rules are persistent if ttl == ttlForever
+func (s *RedisRulesStorage) Set(uid string, r Rules, ttl *time.Duration) error {
+	if ttl == nil {
+		ttl = &s.DefaultTTL
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+
+	key := s.key(uid)
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, key)
+		p.HSet(ctx, key,
+			"maxDownloads", r.MaxDownloads,
+			"downloads", r.Downloads,
+			"notBefore", unixMilli(r.NotBefore),
+			"expiresAt", unixMilli(r.ExpiresAt),
+		)
+		p.ZRem(ctx, s.expiryKey(), uid)
+		if *ttl != ttlForever {
+			p.Expire(ctx, key, *ttl)
+		} else if !r.ExpiresAt.IsZero() {
+			p.ZAdd(ctx, s.expiryKey(), redis.Z{Score: float64(unixMilli(r.ExpiresAt)), Member: uid})
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't store the rules into redis: %v", err)
+	}
+	return nil
+}
+
+//returns the rules attached to uid, ok is false if there are no rules or they can't be read
+func (s *RedisRulesStorage) Get(uid string) (r Rules, ok bool) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	fields, err := s.client.HGetAll(ctx, s.key(uid)).Result()
+	if err != nil || len(fields) == 0 {
+		return
+	}
+	maxDownloads, _ := strconv.ParseUint(fields["maxDownloads"], 10, 32)
+	downloads, _ := strconv.ParseUint(fields["downloads"], 10, 32)
+	notBefore, _ := strconv.ParseInt(fields["notBefore"], 10, 64)
+	expiresAt, _ := strconv.ParseInt(fields["expiresAt"], 10, 64)
+	return Rules{
+		MaxDownloads: uint(maxDownloads),
+		Downloads:    uint(downloads),
+		NotBefore:    fromUnixMilli(notBefore),
+		ExpiresAt:    fromUnixMilli(expiresAt),
+	}, true
+}
+
+//checks the data with uid can be downloaded
+func (s *RedisRulesStorage) Check(uid string) error {
+	return s.acquire(uid, false)
+}
+
+//checks the data with uid can be downloaded and counts the download
+func (s *RedisRulesStorage) Acquire(uid string) error {
+	return s.acquire(uid, true)
+}
+
+func (s *RedisRulesStorage) acquire(uid string, count bool) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	arg := "0"
+	if count {
+		arg = "1"
+	}
+	code, err := redisAcquire.Run(ctx, s.client, []string{s.key(uid)}, unixMilli(time.Now()), arg).Int64()
+	if err != nil {
+		return fmt.Errorf("can't check the rules in redis: %v", err)
+	}
+	return redisRulesErrors[code]
+}
+
+//marks the first download of the data with uid as notified, returns true only for the first one of all instances
+//the mark is kept with the rules, the data without rules gets the empty rules with ttl as by Set
+func (s *RedisRulesStorage) MarkDownloaded(uid string, ttl *time.Duration) (first bool, err error) {
+	if ttl == nil {
+		ttl = &s.DefaultTTL
+	}
+	ctx, cancel := s.context()
+	defer cancel()
+
+	n, err := redisMarkDownloaded.Run(ctx, s.client, []string{s.key(uid)}, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, fmt.Errorf("can't mark the download in redis: %v", err)
+	}
+	return n == 1, nil
+}
+
+//removes the rules attached to uid
+func (s *RedisRulesStorage) Delete(uid string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Del(ctx, s.key(uid))
+		p.ZRem(ctx, s.expiryKey(), uid)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("can't remove the rules from redis: %v", err)
+	}
+	return nil
+}
+
+//returns uids of the persistent rules expired by ExpiresAt, the data of them isn't available anymore and can be removed
+//every uid is returned to one instance only, the rules are kept for DefaultTTL, because the data can be still in the cache
+func (s *RedisRulesStorage) Sweep() (expired []string, err error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	uids, err := s.client.ZRangeByScore(ctx, s.expiryKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(unixMilli(time.Now()), 10),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("can't read the expired rules from redis: %v", err)
+	}
+	for _, uid := range uids {
+		n, err := s.client.ZRem(ctx, s.expiryKey(), uid).Result()
+		if err != nil {
+			return expired, fmt.Errorf("can't remove the expired rules from redis: %v", err)
+		}
+		//another instance has swept the rules
+		if n == 0 {
+			continue
+		}
+		if err := s.client.Expire(ctx, s.key(uid), s.DefaultTTL).Err(); err != nil {
+			return expired, fmt.Errorf("can't remove the expired rules from redis: %v", err)
+		}
+		expired = append(expired, uid)
+	}
+	return expired, nil
+}
+
+func (s *RedisRulesStorage) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisRulesStorage) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.Timeout)
+}
+
+func (s *RedisRulesStorage) key(uid string) string {
+	return s.prefix + "rules:" + uid
+}
+
+//the sorted set of the persistent rules by their expiry time
+func (s *RedisRulesStorage) expiryKey() string {
+	return s.prefix + "rules-expiry"
+}
+
+//returns unix milliseconds of the time, 0 for the zero time
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
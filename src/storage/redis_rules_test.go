@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+//the rules set by one replica are enforced by another, the downloads are counted together
+func TestRedisRulesStorage(t *testing.T) {
+	srv := miniredis.RunT(t)
+	rs := NewRedisRulesStorage(&redis.Options{Addr: srv.Addr()}, "ftpdts:")
+	defer func() { _ = rs.Close() }()
+	replica := NewRedisRulesStorage(&redis.Options{Addr: srv.Addr()}, "ftpdts:")
+	defer func() { _ = replica.Close() }()
+
+	if err := replica.Acquire("unknown"); err != nil {
+		t.Errorf("data without rules should be downloadable: %v", err)
+	}
+
+	ttl := time.Minute
+	if err := rs.Set("burn", Rules{MaxDownloads: 1}, &ttl); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+	if err := replica.Acquire("burn"); err != nil {
+		t.Errorf("the first download should be allowed: %v", err)
+	}
+	if err := rs.Acquire("burn"); err != ErrDownloadsExceeded {
+		t.Errorf("ErrDownloadsExceeded is expected on another replica, got: %v", err)
+	}
+	if r, ok := rs.Get("burn"); !ok || r.MaxDownloads != 1 || r.Downloads != 1 {
+		t.Errorf("wrong rules have been read: %+v, %v", r, ok)
+	}
+	if srv.TTL("ftpdts:rules:burn") != ttl {
+		t.Errorf("wrong native key ttl of the rules: %v", srv.TTL("ftpdts:rules:burn"))
+	}
+
+	notBefore, expiresAt := time.Now().Add(time.Hour), time.Now().Add(-time.Second)
+	_ = rs.Set("early", Rules{NotBefore: notBefore}, nil)
+	_ = rs.Set("late", Rules{ExpiresAt: expiresAt}, &ttlForever)
+	if err := replica.Check("early"); err != ErrNotAvailableYet {
+		t.Errorf("ErrNotAvailableYet is expected before notBefore, got: %v", err)
+	}
+	if err := replica.Check("late"); err != ErrExpired {
+		t.Errorf("ErrExpired is expected after expiresAt, got: %v", err)
+	}
+	if r, _ := replica.Get("early"); !r.NotBefore.Equal(notBefore.Truncate(time.Millisecond)) {
+		t.Errorf("wrong notBefore has been read: %v", r.NotBefore)
+	}
+
+	//the expired persistent rules are reported to one replica only
+	expired, err := rs.Sweep()
+	if err != nil || len(expired) != 1 || expired[0] != "late" {
+		t.Errorf("wrong expired rules: %v, %v", expired, err)
+	}
+	if expired, err := replica.Sweep(); err != nil || len(expired) != 0 {
+		t.Errorf("the expired rules have been reported twice: %v, %v", expired, err)
+	}
+	if err := replica.Check("late"); err != ErrExpired {
+		t.Errorf("the swept rules should hide the data, got: %v", err)
+	}
+
+	//the first download is marked once for all replicas, the mark of the data without rules expires with the data
+	if first, err := rs.MarkDownloaded("burn", nil); err != nil || !first {
+		t.Errorf("the first download hasn't been marked: %v, %v", first, err)
+	}
+	if first, err := replica.MarkDownloaded("burn", nil); err != nil || first {
+		t.Errorf("the download has been marked as the first twice: %v, %v", first, err)
+	}
+	if first, err := replica.MarkDownloaded("norules", &ttl); err != nil || !first {
+		t.Errorf("the first download of the data without rules hasn't been marked: %v, %v", first, err)
+	}
+	if srv.TTL("ftpdts:rules:norules") != ttl || srv.TTL("ftpdts:rules:burn") != ttl {
+		t.Errorf("wrong native key ttl of the mark: %v, %v", srv.TTL("ftpdts:rules:norules"), srv.TTL("ftpdts:rules:burn"))
+	}
+	if r, ok := rs.Get("burn"); !ok || r.MaxDownloads != 1 || r.Downloads != 1 {
+		t.Errorf("the rules have been changed by the mark: %+v, %v", r, ok)
+	}
+	if err := replica.Acquire("norules"); err != nil {
+		t.Errorf("the data with the mark only should be downloadable: %v", err)
+	}
+
+	if err := replica.Delete("burn"); err != nil {
+		t.Fatalf("can't delete the rules: %v", err)
+	}
+	if _, ok := rs.Get("burn"); ok {
+		t.Errorf("the deleted rules have been returned")
+	}
+}
@@ -0,0 +1,313 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftpdts/src/fsatomic"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDownloadsExceeded = errors.New("download limit exceeded")
+	ErrNotAvailableYet   = errors.New("not available yet")
+	ErrExpired           = errors.New("expired")
+)
+
+//Rules are the download rules attached to the stored data
+type Rules struct {
+	MaxDownloads uint      `json:"maxDownloads"` //the data can be downloaded at most MaxDownloads times, 0 - unlimited
+	Downloads    uint      `json:"downloads"`    //the number of downloads done
+	NotBefore    time.Time `json:"notBefore"`    //the data can't be downloaded before this time, zero - no limit
+	ExpiresAt    time.Time `json:"expiresAt"`    //the data can't be downloaded after this time, zero - no limit
+}
+
+//returns true if there are no limits in the rules
+func (r Rules) Empty() bool {
+	return r.MaxDownloads == 0 && r.NotBefore.IsZero() && r.ExpiresAt.IsZero()
+}
+
+//returns true if the rules don't allow to download the data anymore
+func (r Rules) Expired(now time.Time) bool {
+	return !r.ExpiresAt.IsZero() && !now.Before(r.ExpiresAt)
+}
+
+type rulesRecord struct {
+	Rules
+	Notified   bool `json:"notified,omitempty"` //the first download of the data has been notified
+	persistent bool
+	expires    time.Time //zero - kept until restart
+}
+
+//RulesStorage keeps the download rules in the memory
+//rules of the persistent data are also stored into the files at path, so the download counters survive restarts
+type RulesStorage struct {
+	mu           sync.Mutex
+	path         string
+	uidValidator UIDValidator
+	rules        map[string]*rulesRecord
+	DefaultTTL   time.Duration //rules lifetime when the ttl isn't defined
+}
+
+func NewRulesStorage(path string, uid UIDValidator) *RulesStorage {
+	return &RulesStorage{
+		path:         path,
+		uidValidator: uid,
+		rules:        make(map[string]*rulesRecord),
+		DefaultTTL:   time.Hour * 24,
+	}
+}
+
+//attach the rules to uid
+//the ttl has the same meaning as for DataStorage.Put, the rules are persistent if ttl == ttlForever
+func (s *RulesStorage) Set(uid string, r Rules, ttl *time.Duration) error {
+	rec := s.newRecord(r, ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec.persistent {
+		if err := s.save(uid, rec); err != nil {
+			return err
+		}
+	}
+	s.rules[uid] = rec
+	return nil
+}
+
+//returns the rules attached to uid, ok is false if there are no rules
+func (s *RulesStorage) Get(uid string) (r Rules, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rec := s.get(uid)
+	if rec == nil {
+		return
+	}
+	return rec.Rules, true
+}
+
+//checks the data with uid can be downloaded
+func (s *RulesStorage) Check(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return check(s.get(uid))
+}
+
+//checks the data with uid can be downloaded and counts the download
+func (s *RulesStorage) Acquire(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//the record of the data without rules keeps the mark of the first download only
+	rec := s.get(uid)
+	if err := check(rec); err != nil || rec == nil || rec.Empty() {
+		return err
+	}
+	rec.Downloads++
+	if rec.persistent {
+		if err := s.save(uid, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//marks the first download of the data with uid as notified, returns true only for the first one
+//the mark is kept with the rules, the data without rules gets the empty rules with ttl as by Set
+func (s *RulesStorage) MarkDownloaded(uid string, ttl *time.Duration) (first bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec := s.get(uid)
+	if rec == nil {
+		rec = s.newRecord(Rules{}, ttl)
+	}
+	if rec.Notified {
+		return false, nil
+	}
+	rec.Notified = true
+	if rec.persistent {
+		if err := s.save(uid, rec); err != nil {
+			rec.Notified = false
+			return false, err
+		}
+	}
+	s.rules[uid] = rec
+	return true, nil
+}
+
+//removes the rules attached to uid
+func (s *RulesStorage) Delete(uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.rules[uid]
+	if !ok {
+		return nil
+	}
+	if rec.persistent {
+		fPath, err := s.secureFilePath(uid)
+		if err != nil {
+			return err
+		}
+		if err := fsatomic.Remove(fPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't remove the rules file: %v", err)
+		}
+	}
+	delete(s.rules, uid)
+	return nil
+}
+
+//Load the persistent rules from the files, the persistent rules loaded before are replaced
+//so the rules are loaded again when another process has changed the files, as the process being upgraded does
+func (s *RulesStorage) Load() error {
+	files, err := ioutil.ReadDir(s.path)
+	if os.IsNotExist(err) {
+		files, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't read the path: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for uid, rec := range s.rules {
+		if rec.persistent {
+			delete(s.rules, uid)
+		}
+	}
+	for _, f := range files {
+		if fsatomic.IsTmpFile(f.Name()) {
+			if fsatomic.IsStaleTmpFile(f) {
+				_ = os.Remove(filepath.Join(s.path, f.Name()))
+			}
+			continue
+		}
+		fPath, err := s.secureFilePath(f.Name())
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadFile(fPath) // #nosec G304
+		if err != nil {
+			continue
+		}
+		rec := &rulesRecord{persistent: true}
+		if err := json.Unmarshal(b, rec); err != nil {
+			continue
+		}
+		s.rules[f.Name()] = rec
+	}
+	return nil
+}
+
+//removes the expired rules
+//returns uids of the persistent rules expired by ExpiresAt, the data of them isn't available anymore and can be removed
+//such rules are removed from the files only and kept in the memory, because the data can be still in the memory cache
+func (s *RulesStorage) Sweep() (expired []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for uid, rec := range s.rules {
+		if !rec.persistent {
+			_ = s.get(uid)
+			continue
+		}
+		if !rec.Expired(now) {
+			continue
+		}
+		fPath, err := s.secureFilePath(uid)
+		if err != nil {
+			continue
+		}
+		if err := fsatomic.Remove(fPath); err != nil && !os.IsNotExist(err) {
+			return expired, fmt.Errorf("can't remove the rules file: %v", err)
+		}
+		rec.persistent, rec.expires = false, time.Time{}
+		expired = append(expired, uid)
+	}
+	return expired, nil
+}
+
+//the rules record stored with ttl
+func (s *RulesStorage) newRecord(r Rules, ttl *time.Duration) *rulesRecord {
+	rec := &rulesRecord{Rules: r}
+	if ttl != nil && *ttl == ttlForever {
+		rec.persistent = true
+	} else if ttl != nil {
+		rec.expires = time.Now().Add(*ttl)
+	} else {
+		rec.expires = time.Now().Add(s.DefaultTTL)
+	}
+	return rec
+}
+
+func check(rec *rulesRecord) error {
+	if rec == nil {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(rec.NotBefore) {
+		return ErrNotAvailableYet
+	}
+	if rec.Expired(now) {
+		return ErrExpired
+	}
+	if rec.MaxDownloads != 0 && rec.Downloads >= rec.MaxDownloads {
+		return ErrDownloadsExceeded
+	}
+	return nil
+}
+
+//returns the rules, expired rules are removed
+func (s *RulesStorage) get(uid string) *rulesRecord {
+	rec, ok := s.rules[uid]
+	if !ok {
+		return nil
+	}
+	if !rec.persistent && !rec.expires.IsZero() && time.Now().After(rec.expires) {
+		delete(s.rules, uid)
+		return nil
+	}
+	return rec
+}
+
+func (s *RulesStorage) save(uid string, rec *rulesRecord) error {
+	fPath, err := s.secureFilePath(uid)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("wrong rules data: %v", err)
+	}
+
+	if err := os.MkdirAll(s.path, 0700); err != nil {
+		return fmt.Errorf("can't create the rules path: %v", err)
+	}
+
+	return fsatomic.WriteFile(fPath, b, 0600)
+}
+
+func (s *RulesStorage) secureFilePath(uid string) (path string, err error) {
+	u, err := s.uidValidator.Validate(uid)
+	if err != nil || u != uid {
+		err = errors.New("wrong uid")
+		return
+	}
+
+	path, err = filepath.Abs(s.path + string(filepath.Separator) + u)
+	if err != nil {
+		err = errors.New("wrong path")
+	}
+	return
+}
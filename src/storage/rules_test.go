@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"github.com/starshiptroopers/uidgenerator"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRulesStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(
+		&uidgenerator.Cfg{
+			Alfa:      "1234567890abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+			Format:    "XXXXXXXXXXXXXXXXXXXXXXXXXXXXXXXX",
+			Validator: "[0-9a-zA-Z]{32}",
+		},
+	)
+
+	rs := NewRulesStorage(dir, UIDGenerator)
+	uidMemory := UIDGenerator.New()
+	uidPersistent := UIDGenerator.New()
+
+	if err := rs.Acquire(UIDGenerator.New()); err != nil {
+		t.Errorf("data without rules should be downloadable: %v", err)
+	}
+
+	if err := rs.Set(uidMemory, Rules{MaxDownloads: 1}, nil); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+	if err := rs.Set(uidPersistent, Rules{MaxDownloads: 2}, &ttlForever); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+
+	if err := rs.Acquire(uidMemory); err != nil {
+		t.Errorf("the first download should be allowed: %v", err)
+	}
+	if err := rs.Check(uidMemory); err != ErrDownloadsExceeded {
+		t.Errorf("ErrDownloadsExceeded is expected after the last download, got: %v", err)
+	}
+	if err := rs.Acquire(uidPersistent); err != nil {
+		t.Errorf("the first download should be allowed: %v", err)
+	}
+
+	//only persistent rules survive the restart
+	rs = NewRulesStorage(dir, UIDGenerator)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("can't load the rules: %v", err)
+	}
+
+	if _, ok := rs.Get(uidMemory); ok {
+		t.Errorf("memory rules have been loaded from the persistent storage")
+	}
+
+	r, ok := rs.Get(uidPersistent)
+	if !ok || r.MaxDownloads != 2 || r.Downloads != 1 {
+		t.Errorf("wrong persistent rules have been loaded: %+v", r)
+	}
+	if err := rs.Acquire(uidPersistent); err != nil {
+		t.Errorf("the second download should be allowed: %v", err)
+	}
+	if err := rs.Acquire(uidPersistent); err != ErrDownloadsExceeded {
+		t.Errorf("ErrDownloadsExceeded is expected after the last download, got: %v", err)
+	}
+
+	//the deleted rules are removed from the files too
+	if err := rs.Delete(uidPersistent); err != nil {
+		t.Fatalf("can't delete the rules: %v", err)
+	}
+	if _, ok := rs.Get(uidPersistent); ok {
+		t.Errorf("the deleted rules have been returned")
+	}
+	rs = NewRulesStorage(dir, UIDGenerator)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("can't load the rules: %v", err)
+	}
+	if _, ok := rs.Get(uidPersistent); ok {
+		t.Errorf("the deleted rules have been loaded")
+	}
+}
+
+//the first download is marked once, the mark of the persistent data survives the restart
+func TestRulesMarkDownloaded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	rs := NewRulesStorage(dir, UIDGenerator)
+	uidRules, uidPersistent, uidMemory := UIDGenerator.New(), UIDGenerator.New(), UIDGenerator.New()
+	if err := rs.Set(uidRules, Rules{MaxDownloads: 2}, &ttlForever); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+
+	for _, uid := range []string{uidRules, uidPersistent, uidMemory} {
+		ttl := map[string]*time.Duration{uidRules: nil, uidPersistent: &ttlForever, uidMemory: nil}[uid]
+		for i := 0; i < 2; i++ {
+			if first, err := rs.MarkDownloaded(uid, ttl); err != nil || first != (i == 0) {
+				t.Errorf("wrong mark of the download %d of %s: %v, %v", i, uid, first, err)
+			}
+		}
+	}
+	if r, ok := rs.Get(uidRules); !ok || r.MaxDownloads != 2 {
+		t.Errorf("the rules have been changed by the mark: %+v", r)
+	}
+	if err := rs.Acquire(uidPersistent); err != nil {
+		t.Errorf("the data with the mark only should be downloadable: %v", err)
+	}
+	if r, _ := rs.Get(uidPersistent); !r.Empty() || r.Downloads != 0 {
+		t.Errorf("the downloads of the data without rules have been counted: %+v", r)
+	}
+
+	rs = NewRulesStorage(dir, UIDGenerator)
+	if err := rs.Load(); err != nil {
+		t.Fatalf("can't load the rules: %v", err)
+	}
+	for uid, first := range map[string]bool{uidRules: false, uidPersistent: false, uidMemory: true} {
+		if f, err := rs.MarkDownloaded(uid, nil); err != nil || f != first {
+			t.Errorf("wrong mark of %s after the restart: %v, %v", uid, f, err)
+		}
+	}
+	if r, ok := rs.Get(uidRules); !ok || r.MaxDownloads != 2 {
+		t.Errorf("the rules haven't been loaded with the mark: %+v", r)
+	}
+}
+
+func TestRulesWindow(t *testing.T) {
+	UIDGenerator := uidgenerator.New(nil)
+	rs := NewRulesStorage("", UIDGenerator)
+	uidEarly, uidLate, uidActive := UIDGenerator.New(), UIDGenerator.New(), UIDGenerator.New()
+
+	for uid, r := range map[string]Rules{
+		uidEarly:  {NotBefore: time.Now().Add(time.Hour)},
+		uidLate:   {ExpiresAt: time.Now().Add(-time.Second)},
+		uidActive: {NotBefore: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(time.Hour)},
+	} {
+		if err := rs.Set(uid, r, nil); err != nil {
+			t.Fatalf("can't set the rules: %v", err)
+		}
+	}
+
+	if err := rs.Check(uidEarly); err != ErrNotAvailableYet {
+		t.Errorf("ErrNotAvailableYet is expected before notBefore, got: %v", err)
+	}
+	if err := rs.Check(uidLate); err != ErrExpired {
+		t.Errorf("ErrExpired is expected after expiresAt, got: %v", err)
+	}
+	if err := rs.Acquire(uidActive); err != nil {
+		t.Errorf("the data should be available inside its window: %v", err)
+	}
+}
+
+func TestRulesSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	UIDGenerator := uidgenerator.New(nil)
+	rs := NewRulesStorage(dir, UIDGenerator)
+	uidExpired, uidAlive := UIDGenerator.New(), UIDGenerator.New()
+
+	if err := rs.Set(uidExpired, Rules{ExpiresAt: time.Now().Add(-time.Second)}, &ttlForever); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+	if err := rs.Set(uidAlive, Rules{ExpiresAt: time.Now().Add(time.Hour)}, &ttlForever); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+
+	expired, err := rs.Sweep()
+	if err != nil {
+		t.Fatalf("can't sweep the rules: %v", err)
+	}
+	if len(expired) != 1 || expired[0] != uidExpired {
+		t.Errorf("only expired rules should be swept: %v", expired)
+	}
+
+	//swept rules still hide the data until restart
+	if err := rs.Check(uidExpired); err != ErrExpired {
+		t.Errorf("ErrExpired is expected for the swept rules, got: %v", err)
+	}
+
+	rs = NewRulesStorage(dir, UIDGenerator)
+	_ = rs.Load()
+	if _, ok := rs.Get(uidExpired); ok {
+		t.Errorf("swept rules have been loaded from the persistent storage")
+	}
+	if _, ok := rs.Get(uidAlive); !ok {
+		t.Errorf("alive rules haven't been loaded from the persistent storage")
+	}
+}
+
+//the process being upgraded counts the downloads into the same files, the new process loads them again when it exits
+func TestRulesReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	ug := uidgenerator.New(nil)
+	old, upgraded := NewRulesStorage(dir, ug), NewRulesStorage(dir, ug)
+	uidCounted, uidDeleted, uidMemory := ug.New(), ug.New(), ug.New()
+	for _, uid := range []string{uidCounted, uidDeleted} {
+		if err := old.Set(uid, Rules{MaxDownloads: 1}, &ttlForever); err != nil {
+			t.Fatalf("can't set the rules: %v", err)
+		}
+	}
+	if err := upgraded.Load(); err != nil {
+		t.Fatalf("can't load the rules: %v", err)
+	}
+	if err := upgraded.Set(uidMemory, Rules{MaxDownloads: 1}, nil); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+
+	if err := old.Acquire(uidCounted); err != nil {
+		t.Fatalf("the download should be allowed: %v", err)
+	}
+	if err := old.Delete(uidDeleted); err != nil {
+		t.Fatalf("can't delete the rules: %v", err)
+	}
+	if err := upgraded.Load(); err != nil {
+		t.Fatalf("can't reload the rules: %v", err)
+	}
+	if err := upgraded.Check(uidCounted); err != ErrDownloadsExceeded {
+		t.Errorf("the download counted by another process hasn't been reloaded: %v", err)
+	}
+	if _, ok := upgraded.Get(uidDeleted); ok {
+		t.Errorf("the rules deleted by another process have been kept")
+	}
+	if _, ok := upgraded.Get(uidMemory); !ok {
+		t.Errorf("the rules kept in the memory have been dropped by the reload")
+	}
+}
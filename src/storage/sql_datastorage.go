@@ -0,0 +1,332 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	_ "github.com/lib/pq"  //postgres driver
+	_ "modernc.org/sqlite" //sqlite driver, doesn't require cgo
+	"strconv"
+	"strings"
+	"time"
+)
+
+//supported database drivers
+const (
+	SQLDriverSqlite   = "sqlite"
+	SQLDriverPostgres = "postgres"
+)
+
+//schema migrations, applied in order, the index of the migration + 1 is the schema version
+//times are stored as unix nanoseconds, so the same schema is used for all drivers
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS ftpdts_data (
+		uid VARCHAR(255) NOT NULL PRIMARY KEY,
+		created_at BIGINT NOT NULL,
+		expires_at BIGINT,
+		meta TEXT,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS ftpdts_data_created_at ON ftpdts_data (created_at)`,
+	`CREATE INDEX IF NOT EXISTS ftpdts_data_expires_at ON ftpdts_data (expires_at)`,
+	`CREATE TABLE IF NOT EXISTS ftpdts_rules (
+		uid VARCHAR(255) NOT NULL PRIMARY KEY,
+		max_downloads BIGINT NOT NULL,
+		downloads BIGINT NOT NULL,
+		not_before BIGINT NOT NULL,
+		expires_at BIGINT NOT NULL,
+		kept_until BIGINT,
+		notified INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS ftpdts_rules_expires_at ON ftpdts_rules (expires_at)`,
+}
+
+//the time in milliseconds the sqlite connection waits for the database locked by another connection
+const sqliteBusyTimeout = 5000
+
+//the key of the postgres advisory lock the schema is migrated under
+const sqlMigrationLock = 7270034
+
+//SQLDataStorage is the persistent data storage in the SQL database, SQLite or Postgres
+//it allows several ftpdts instances to share the same data
+//records are stored in the same envelope fields as FsDataStorage uses (see Record)
+type SQLDataStorage struct {
+	db     *sql.DB
+	driver string
+}
+
+func NewSQLDataStorage(driver string, dsn string) (*SQLDataStorage, error) {
+	if driver != SQLDriverSqlite && driver != SQLDriverPostgres {
+		return nil, fmt.Errorf("unsupported database driver: %s", driver)
+	}
+	if driver == SQLDriverSqlite && !strings.Contains(dsn, "busy_timeout") {
+		//the instances sharing the database file wait for the lock of each other instead of failing with SQLITE_BUSY
+		dsn += sqliteQuerySeparator(dsn) + "_pragma=busy_timeout(" + strconv.Itoa(sqliteBusyTimeout) + ")"
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("can't open the database: %v", err)
+	}
+	if driver == SQLDriverSqlite {
+		//sqlite allows one writer only, a single connection prevents "database is locked" errors
+		db.SetMaxOpenConns(1)
+	}
+
+	t := &SQLDataStorage{db: db, driver: driver}
+	if err := t.migrate(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("can't migrate the database schema: %v", err)
+	}
+	return t, nil
+}
+
+//returns the stored data by its UID
+//ttl is the remaining time to live, 0 if the data is stored forever
+func (t *SQLDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	r, err := t.GetRecord(uid)
+	if err != nil {
+		return
+	}
+	return r.Data, r.CreatedAt, r.TTL(time.Now()), nil
+}
+
+//stores the data with uid, the data is stored forever if ttl is nil or 0
+func (t *SQLDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	r := &Record{
+		UID:       uid,
+		CreatedAt: time.Now(),
+		Data:      payload,
+	}
+	if ttl != nil && *ttl > 0 {
+		expiresAt := r.CreatedAt.Add(*ttl)
+		r.ExpiresAt = &expiresAt
+	}
+	return t.PutRecord(r)
+}
+
+//returns the stored record by its UID, ErrExpired is returned for the expired record
+func (t *SQLDataStorage) GetRecord(uid string) (*Record, error) {
+	row := t.db.QueryRow(t.query(`SELECT uid, created_at, expires_at, meta, data FROM ftpdts_data WHERE uid = ?`), uid)
+	r, err := scanSQLRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("uid not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Expired(time.Now()) {
+		return nil, ErrExpired
+	}
+	return r, nil
+}
+
+//stores the record with the record uid
+func (t *SQLDataStorage) PutRecord(r *Record) error {
+	if r.UID == "" {
+		return errors.New("wrong uid")
+	}
+	r.Version = RecordVersion
+
+	data, err := json.Marshal(r.Data)
+	if err != nil {
+		return fmt.Errorf("wrong json data: %v", err)
+	}
+	var meta sql.NullString
+	if len(r.Meta) > 0 {
+		b, err := json.Marshal(r.Meta)
+		if err != nil {
+			return fmt.Errorf("wrong json meta: %v", err)
+		}
+		meta = sql.NullString{String: string(b), Valid: true}
+	}
+	var expiresAt sql.NullInt64
+	if r.ExpiresAt != nil {
+		expiresAt = sql.NullInt64{Int64: r.ExpiresAt.UnixNano(), Valid: true}
+	}
+
+	_, err = t.db.Exec(t.query(`INSERT INTO ftpdts_data (uid, created_at, expires_at, meta, data) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (uid) DO UPDATE SET created_at = excluded.created_at, expires_at = excluded.expires_at, meta = excluded.meta, data = excluded.data`),
+		r.UID, r.CreatedAt.UnixNano(), expiresAt, meta, string(data))
+	if err != nil {
+		return fmt.Errorf("can't store the data: %v", err)
+	}
+	return nil
+}
+
+//Pass all stored items and call a callback function
+//expired items are skipped, ttl is the remaining time to live
+func (t *SQLDataStorage) Pass(callback func(uid string, createdAt time.Time, ttl time.Duration, data interface{})) error {
+	return t.PassRecords(func(r *Record) error {
+		callback(r.UID, r.CreatedAt, r.TTL(time.Now()), r.Data)
+		return nil
+	})
+}
+
+//Pass all stored records except expired ones in the order of creation and call a callback function
+func (t *SQLDataStorage) PassRecords(callback func(r *Record) error) error {
+	rows, err := t.db.Query(t.query(`SELECT uid, created_at, expires_at, meta, data FROM ftpdts_data
+		WHERE expires_at IS NULL OR expires_at > ? ORDER BY created_at`), time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("can't read the data: %v", err)
+	}
+	//records are read before the callbacks are called, so the callback can use the storage with a single connection
+	var records []*Record
+	for rows.Next() {
+		r, err := scanSQLRecord(rows)
+		if err != nil {
+			_ = rows.Close()
+			return err
+		}
+		records = append(records, r)
+	}
+	if err := rows.Close(); err != nil {
+		return fmt.Errorf("can't read the data: %v", err)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("can't read the data: %v", err)
+	}
+
+	for _, r := range records {
+		if err := callback(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removes the data with uid from the storage
+func (t *SQLDataStorage) Delete(uid string) error {
+	if _, err := t.db.Exec(t.query(`DELETE FROM ftpdts_data WHERE uid = ?`), uid); err != nil {
+		return fmt.Errorf("can't remove the data: %v", err)
+	}
+	return nil
+}
+
+//removes all expired data from the storage, returns uids of the removed data
+func (t *SQLDataStorage) Sweep() (removed []string, err error) {
+	rows, err := t.db.Query(t.query(`DELETE FROM ftpdts_data WHERE expires_at IS NOT NULL AND expires_at <= ? RETURNING uid`), time.Now().UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("can't remove the expired data: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return removed, fmt.Errorf("can't remove the expired data: %v", err)
+		}
+		removed = append(removed, uid)
+	}
+	return removed, rows.Err()
+}
+
+func (t *SQLDataStorage) Close() error {
+	return t.db.Close()
+}
+
+//applies the schema migrations which haven't been applied yet
+//the migrations are applied in one transaction, the instances started together on postgres take the advisory lock one by one,
+//so the schema version row is seeded and the migrations are applied once
+func (t *SQLDataStorage) migrate() (err error) {
+	tx, err := t.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	if t.driver == SQLDriverPostgres {
+		if _, err = tx.Exec(t.query(`SELECT pg_advisory_xact_lock(?)`), sqlMigrationLock); err != nil {
+			return fmt.Errorf("can't lock the schema: %v", err)
+		}
+	}
+	if _, err = tx.Exec(`CREATE TABLE IF NOT EXISTS ftpdts_schema (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`INSERT INTO ftpdts_schema (version) SELECT 0 WHERE NOT EXISTS (SELECT 1 FROM ftpdts_schema)`); err != nil {
+		return err
+	}
+	var version int
+	if err = tx.QueryRow(`SELECT version FROM ftpdts_schema`).Scan(&version); err != nil {
+		return err
+	}
+
+	for v := version; v < len(sqlMigrations); v++ {
+		if _, err = tx.Exec(sqlMigrations[v]); err != nil {
+			return fmt.Errorf("migration %d: %v", v+1, err)
+		}
+		if _, err = tx.Exec(t.query(`UPDATE ftpdts_schema SET version = ?`), v+1); err != nil {
+			return fmt.Errorf("migration %d: %v", v+1, err)
+		}
+	}
+	return tx.Commit()
+}
+
+//rewrites ? placeholders into the $N form for postgres
+func (t *SQLDataStorage) query(q string) string {
+	if t.driver != SQLDriverPostgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLRecord(s sqlScanner) (*Record, error) {
+	var (
+		createdAt int64
+		expiresAt sql.NullInt64
+		meta      sql.NullString
+		data      string
+	)
+	r := &Record{Version: RecordVersion}
+	if err := s.Scan(&r.UID, &createdAt, &expiresAt, &meta, &data); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("can't read the data: %v", err)
+	}
+	r.CreatedAt = time.Unix(0, createdAt)
+	if expiresAt.Valid {
+		e := time.Unix(0, expiresAt.Int64)
+		r.ExpiresAt = &e
+	}
+	if meta.Valid {
+		if err := json.Unmarshal([]byte(meta.String), &r.Meta); err != nil {
+			return nil, fmt.Errorf("can't parse json meta from the database: %v", err)
+		}
+	}
+	if err := json.Unmarshal([]byte(data), &r.Data); err != nil {
+		return nil, fmt.Errorf("can't parse json from the database: %v", err)
+	}
+	return r, nil
+}
+
+//returns the separator of the next sqlite dsn query parameter
+func sqliteQuerySeparator(dsn string) string {
+	if strings.Contains(dsn, "?") {
+		return "&"
+	}
+	return "?"
+}
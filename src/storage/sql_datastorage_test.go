@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"github.com/starshiptroopers/uidgenerator"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the data is stored in the in-process SQLite database, the schema survives reopening
+func TestSQLDataStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	dsn := filepath.Join(dir, "ftpdts.sqlite")
+	ds, err := NewSQLDataStorage(SQLDriverSqlite, dsn)
+	if err != nil {
+		t.Fatalf("can't open the storage: %v", err)
+	}
+
+	UIDGenerator := uidgenerator.New(nil)
+	uidForever, uidExpired, uidAlive := UIDGenerator.New(), UIDGenerator.New(), UIDGenerator.New()
+
+	expired, alive := time.Millisecond, time.Hour
+	for _, uid := range []string{uidForever, uidExpired, uidAlive} {
+		ttl := map[string]*time.Duration{uidForever: nil, uidExpired: &expired, uidAlive: &alive}[uid]
+		if err := ds.Put(uid, map[string]interface{}{"S": uid}, ttl); err != nil {
+			t.Fatalf("can't put data into the storage: %v", err)
+		}
+	}
+	err = ds.PutRecord(&Record{UID: uidAlive, CreatedAt: time.Now(), Meta: map[string]string{"template": "default"}, Data: "replaced"})
+	if err != nil {
+		t.Fatalf("can't replace the record: %v", err)
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	//reopening must not apply the migrations again
+	if err := ds.Close(); err != nil {
+		t.Fatalf("can't close the storage: %v", err)
+	}
+	ds, err = NewSQLDataStorage(SQLDriverSqlite, dsn)
+	if err != nil {
+		t.Fatalf("can't reopen the storage: %v", err)
+	}
+	defer func() { _ = ds.Close() }()
+
+	data, _, ttl, err := ds.Get(uidForever)
+	if err != nil || ttl != 0 {
+		t.Fatalf("zero ttl is expected for the data stored forever: %v, %v", ttl, err)
+	}
+	if d, ok := data.(map[string]interface{}); !ok || d["S"] != uidForever {
+		t.Errorf("wrong data has been read from the storage: %v", data)
+	}
+	if _, _, _, err := ds.Get(uidExpired); err != ErrExpired {
+		t.Errorf("ErrExpired is expected for the expired data, got: %v", err)
+	}
+	r, err := ds.GetRecord(uidAlive)
+	if err != nil || r.Data != "replaced" || r.ExpiresAt != nil || r.Meta["template"] != "default" {
+		t.Errorf("the record hasn't been replaced: %+v, %v", r, err)
+	}
+
+	var passed []string
+	err = ds.PassRecords(func(r *Record) error {
+		passed = append(passed, r.UID)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't read data: %v", err)
+	}
+	if len(passed) != 2 || passed[0] != uidForever || passed[1] != uidAlive {
+		t.Errorf("not expired data should be passed in the order of creation: %v", passed)
+	}
+
+	removed, err := ds.Sweep()
+	if err != nil {
+		t.Fatalf("can't sweep the storage: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != uidExpired {
+		t.Errorf("only expired data should be removed: %v", removed)
+	}
+
+	if err := ds.Delete(uidAlive); err != nil {
+		t.Fatalf("can't delete data: %v", err)
+	}
+	if _, _, _, err := ds.Get(uidAlive); err == nil {
+		t.Errorf("the deleted data is still in the storage")
+	}
+}
+
+//the schema version is seeded once, reopening doesn't add the version rows
+func TestSQLDataStorageSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	dsn := filepath.Join(dir, "ftpdts.sqlite")
+	for i := 0; i < 2; i++ {
+		ds, err := NewSQLDataStorage(SQLDriverSqlite, dsn)
+		if err != nil {
+			t.Fatalf("can't open the storage: %v", err)
+		}
+		var rows, version int
+		if err := ds.db.QueryRow(`SELECT COUNT(*), MAX(version) FROM ftpdts_schema`).Scan(&rows, &version); err != nil {
+			t.Fatalf("can't read the schema version: %v", err)
+		}
+		if rows != 1 || version != len(sqlMigrations) {
+			t.Errorf("wrong schema rows: %d rows, version %d", rows, version)
+		}
+		_ = ds.Close()
+	}
+}
+
+func TestSQLDataStorageQuery(t *testing.T) {
+	pg := &SQLDataStorage{driver: SQLDriverPostgres}
+	if q := pg.query(`SELECT data FROM ftpdts_data WHERE uid = ? AND expires_at > ?`); q != `SELECT data FROM ftpdts_data WHERE uid = $1 AND expires_at > $2` {
+		t.Errorf("wrong postgres query: %s", q)
+	}
+	if _, err := NewSQLDataStorage("mysql", ""); err == nil {
+		t.Errorf("unsupported driver should be rejected")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+//SQLRulesStorage keeps the download rules in the database of SQLDataStorage, so the ftpdts instances sharing the database
+//enforce the same download limits and the time window without the redis cache, the downloads are counted atomically
+//kept_until is the end of the rules lifetime in unix nanoseconds, NULL for the persistent rules, the zero times are stored as 0
+type SQLRulesStorage struct {
+	db         *sql.DB
+	query      func(q string) string
+	DefaultTTL time.Duration //rules lifetime when the ttl isn't defined
+}
+
+//the rules storage shares the database connection with ds, it's closed with ds
+func NewSQLRulesStorage(ds *SQLDataStorage) *SQLRulesStorage {
+	return &SQLRulesStorage{
+		db:         ds.db,
+		query:      ds.query,
+		DefaultTTL: time.Hour * 24,
+	}
+}
+
+//attach the rules to uid
+//the ttl has the same meaning as for DataStorage.Put, the rules are persistent if ttl == ttlForever
+func (s *SQLRulesStorage) Set(uid string, r Rules, ttl *time.Duration) error {
+	_, err := s.db.Exec(s.query(`INSERT INTO ftpdts_rules (uid, max_downloads, downloads, not_before, expires_at, kept_until, notified)
+		VALUES (?, ?, ?, ?, ?, ?, 0)
+		ON CONFLICT (uid) DO UPDATE SET max_downloads = excluded.max_downloads, downloads = excluded.downloads,
+			not_before = excluded.not_before, expires_at = excluded.expires_at, kept_until = excluded.kept_until, notified = 0`),
+		uid, int64(r.MaxDownloads), int64(r.Downloads), unixNano(r.NotBefore), unixNano(r.ExpiresAt), s.keptUntil(ttl))
+	if err != nil {
+		return fmt.Errorf("can't store the rules into the database: %v", err)
+	}
+	return nil
+}
+
+//returns the rules attached to uid, ok is false if there are no rules or they can't be read
+func (s *SQLRulesStorage) Get(uid string) (r Rules, ok bool) {
+	var maxDownloads, downloads, notBefore, expiresAt int64
+	err := s.db.QueryRow(s.query(`SELECT max_downloads, downloads, not_before, expires_at FROM ftpdts_rules
+		WHERE uid = ? AND (kept_until IS NULL OR kept_until > ?)`), uid, time.Now().UnixNano()).
+		Scan(&maxDownloads, &downloads, &notBefore, &expiresAt)
+	if err != nil {
+		return
+	}
+	return Rules{
+		MaxDownloads: uint(maxDownloads),
+		Downloads:    uint(downloads),
+		NotBefore:    fromUnixNano(notBefore),
+		ExpiresAt:    fromUnixNano(expiresAt),
+	}, true
+}
+
+//checks the data with uid can be downloaded
+func (s *SQLRulesStorage) Check(uid string) error {
+	r, ok := s.Get(uid)
+	if !ok {
+		return nil
+	}
+	return check(&rulesRecord{Rules: r})
+}
+
+//checks the data with uid can be downloaded and counts the download
+//the download is counted by the conditional update, so the instances sharing the database can't exceed the limit together
+func (s *SQLRulesStorage) Acquire(uid string) error {
+	now := time.Now().UnixNano()
+	res, err := s.db.Exec(s.query(`UPDATE ftpdts_rules SET downloads = downloads + 1
+		WHERE uid = ? AND (kept_until IS NULL OR kept_until > ?)
+			AND (max_downloads <> 0 OR not_before <> 0 OR expires_at <> 0)
+			AND (max_downloads = 0 OR downloads < max_downloads)
+			AND not_before <= ? AND (expires_at = 0 OR expires_at > ?)`), uid, now, now, now)
+	if err != nil {
+		return fmt.Errorf("can't count the download in the database: %v", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("can't count the download in the database: %v", err)
+	} else if n == 1 {
+		return nil
+	}
+	//there are no rules or the rules don't allow the download, the reason is read
+	return s.Check(uid)
+}
+
+//marks the first download of the data with uid as notified, returns true only for the first one of all instances
+//the mark is kept with the rules, the data without rules gets the empty rules with ttl as by Set
+func (s *SQLRulesStorage) MarkDownloaded(uid string, ttl *time.Duration) (first bool, err error) {
+	now := time.Now().UnixNano()
+	res, err := s.db.Exec(s.query(`UPDATE ftpdts_rules SET notified = 1
+		WHERE uid = ? AND notified = 0 AND (kept_until IS NULL OR kept_until > ?)`), uid, now)
+	if err != nil {
+		return false, fmt.Errorf("can't mark the download in the database: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("can't mark the download in the database: %v", err)
+	}
+	if n == 1 {
+		return true, nil
+	}
+
+	//the expired rules are replaced by the mark, the rules left are already marked
+	if _, err := s.db.Exec(s.query(`DELETE FROM ftpdts_rules WHERE uid = ? AND kept_until IS NOT NULL AND kept_until <= ?`), uid, now); err != nil {
+		return false, fmt.Errorf("can't mark the download in the database: %v", err)
+	}
+	res, err = s.db.Exec(s.query(`INSERT INTO ftpdts_rules (uid, max_downloads, downloads, not_before, expires_at, kept_until, notified)
+		VALUES (?, 0, 0, 0, 0, ?, 1) ON CONFLICT (uid) DO NOTHING`), uid, s.keptUntil(ttl))
+	if err != nil {
+		return false, fmt.Errorf("can't mark the download in the database: %v", err)
+	}
+	if n, err = res.RowsAffected(); err != nil {
+		return false, fmt.Errorf("can't mark the download in the database: %v", err)
+	}
+	return n == 1, nil
+}
+
+//removes the rules attached to uid
+func (s *SQLRulesStorage) Delete(uid string) error {
+	if _, err := s.db.Exec(s.query(`DELETE FROM ftpdts_rules WHERE uid = ?`), uid); err != nil {
+		return fmt.Errorf("can't remove the rules from the database: %v", err)
+	}
+	return nil
+}
+
+//removes the rules which lifetime is over
+//returns uids of the persistent rules expired by ExpiresAt, the data of them isn't available anymore and can be removed
+//every uid is returned to one instance only, the rules are kept for DefaultTTL, because the data can be still in the cache
+func (s *SQLRulesStorage) Sweep() (expired []string, err error) {
+	now := time.Now()
+	if _, err := s.db.Exec(s.query(`DELETE FROM ftpdts_rules WHERE kept_until IS NOT NULL AND kept_until <= ?`), now.UnixNano()); err != nil {
+		return nil, fmt.Errorf("can't remove the expired rules from the database: %v", err)
+	}
+	rows, err := s.db.Query(s.query(`UPDATE ftpdts_rules SET kept_until = ?
+		WHERE kept_until IS NULL AND expires_at <> 0 AND expires_at <= ? RETURNING uid`), now.Add(s.DefaultTTL).UnixNano(), now.UnixNano())
+	if err != nil {
+		return nil, fmt.Errorf("can't read the expired rules from the database: %v", err)
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var uid string
+		if err := rows.Scan(&uid); err != nil {
+			return expired, fmt.Errorf("can't read the expired rules from the database: %v", err)
+		}
+		expired = append(expired, uid)
+	}
+	return expired, rows.Err()
+}
+
+//the end of the rules lifetime stored with ttl, nil for the persistent rules
+func (s *SQLRulesStorage) keptUntil(ttl *time.Duration) interface{} {
+	if ttl == nil {
+		ttl = &s.DefaultTTL
+	}
+	if *ttl == ttlForever {
+		return nil
+	}
+	return time.Now().Add(*ttl).UnixNano()
+}
+
+//returns unix nanoseconds of the time, 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
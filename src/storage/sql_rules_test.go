@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//the rules set by one replica sharing the database are enforced by another, the downloads are counted together
+func TestSQLRulesStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	dsn := filepath.Join(dir, "ftpdts.sqlite")
+	ds, err := NewSQLDataStorage(SQLDriverSqlite, dsn)
+	if err != nil {
+		t.Fatalf("can't open the storage: %v", err)
+	}
+	defer func() { _ = ds.Close() }()
+	replicaDs, err := NewSQLDataStorage(SQLDriverSqlite, dsn)
+	if err != nil {
+		t.Fatalf("can't open the storage: %v", err)
+	}
+	defer func() { _ = replicaDs.Close() }()
+	rs, replica := NewSQLRulesStorage(ds), NewSQLRulesStorage(replicaDs)
+
+	if err := replica.Acquire("unknown"); err != nil {
+		t.Errorf("data without rules should be downloadable: %v", err)
+	}
+
+	ttl := time.Minute
+	if err := rs.Set("burn", Rules{MaxDownloads: 1}, &ttl); err != nil {
+		t.Fatalf("can't set the rules: %v", err)
+	}
+	if err := replica.Acquire("burn"); err != nil {
+		t.Errorf("the first download should be allowed: %v", err)
+	}
+	if err := rs.Acquire("burn"); err != ErrDownloadsExceeded {
+		t.Errorf("ErrDownloadsExceeded is expected on another replica, got: %v", err)
+	}
+	if r, ok := rs.Get("burn"); !ok || r.MaxDownloads != 1 || r.Downloads != 1 {
+		t.Errorf("wrong rules have been read: %+v, %v", r, ok)
+	}
+
+	notBefore, expiresAt := time.Now().Add(time.Hour), time.Now().Add(-time.Second)
+	_ = rs.Set("early", Rules{NotBefore: notBefore}, nil)
+	_ = rs.Set("late", Rules{ExpiresAt: expiresAt}, &ttlForever)
+	if err := replica.Acquire("early"); err != ErrNotAvailableYet {
+		t.Errorf("ErrNotAvailableYet is expected before notBefore, got: %v", err)
+	}
+	if err := replica.Check("late"); err != ErrExpired {
+		t.Errorf("ErrExpired is expected after expiresAt, got: %v", err)
+	}
+	if r, _ := replica.Get("early"); !r.NotBefore.Equal(notBefore) {
+		t.Errorf("wrong notBefore has been read: %v", r.NotBefore)
+	}
+
+	//the rules which lifetime is over are gone
+	short := time.Millisecond
+	_ = rs.Set("short", Rules{MaxDownloads: 1}, &short)
+	time.Sleep(time.Millisecond * 10)
+	if _, ok := replica.Get("short"); ok {
+		t.Errorf("the rules have been returned after their ttl")
+	}
+
+	//the expired persistent rules are reported to one replica only
+	expired, err := rs.Sweep()
+	if err != nil || len(expired) != 1 || expired[0] != "late" {
+		t.Errorf("wrong expired rules: %v, %v", expired, err)
+	}
+	if expired, err := replica.Sweep(); err != nil || len(expired) != 0 {
+		t.Errorf("the expired rules have been reported twice: %v, %v", expired, err)
+	}
+	if err := replica.Check("late"); err != ErrExpired {
+		t.Errorf("the swept rules should hide the data, got: %v", err)
+	}
+
+	//the first download is marked once for all replicas
+	if first, err := rs.MarkDownloaded("burn", nil); err != nil || !first {
+		t.Errorf("the first download hasn't been marked: %v, %v", first, err)
+	}
+	if first, err := replica.MarkDownloaded("burn", nil); err != nil || first {
+		t.Errorf("the download has been marked as the first twice: %v, %v", first, err)
+	}
+	if first, err := replica.MarkDownloaded("norules", &ttl); err != nil || !first {
+		t.Errorf("the first download of the data without rules hasn't been marked: %v, %v", first, err)
+	}
+	if first, err := rs.MarkDownloaded("norules", &ttl); err != nil || first {
+		t.Errorf("the download of the data without rules has been marked as the first twice: %v, %v", first, err)
+	}
+	if first, err := rs.MarkDownloaded("short", &ttl); err != nil || !first {
+		t.Errorf("the mark hasn't replaced the rules which lifetime is over: %v, %v", first, err)
+	}
+	if r, ok := rs.Get("burn"); !ok || r.MaxDownloads != 1 || r.Downloads != 1 {
+		t.Errorf("the rules have been changed by the mark: %+v, %v", r, ok)
+	}
+	if err := replica.Acquire("norules"); err != nil {
+		t.Errorf("the data with the mark only should be downloadable: %v", err)
+	}
+	if r, _ := rs.Get("norules"); r.Downloads != 0 {
+		t.Errorf("the download of the data with the mark only has been counted: %+v", r)
+	}
+
+	if err := replica.Delete("burn"); err != nil {
+		t.Fatalf("can't delete the rules: %v", err)
+	}
+	if _, ok := rs.Get("burn"); ok {
+		t.Errorf("the deleted rules have been returned")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ftpdts/src/fsatomic"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrQueueFull = errors.New("the webhook queue is full")
+
+//the extension of the queued event files
+const eventExt = ".json"
+
+//Queue is the bounded queue of the events kept in the files of the folder, so the events survive restarts
+//the file names are ordered as the events have been pushed
+type Queue struct {
+	mu    sync.Mutex
+	path  string
+	size  int
+	names []string //the queued event files, the oldest first
+	seq   uint64
+}
+
+//opens the queue in the path folder, the events queued before are kept, size is the maximum number of the queued events
+func NewQueue(path string, size int) (*Queue, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, fmt.Errorf("can't create the webhook queue folder: %v", err)
+	}
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the webhook queue folder: %v", err)
+	}
+	q := &Queue{path: path, size: size}
+	for _, f := range files {
+		switch {
+		case fsatomic.IsTmpFile(f.Name()):
+			//the event hasn't been pushed completely, the young file can be written by the process being upgraded
+			if fsatomic.IsStaleTmpFile(f) {
+				_ = os.Remove(filepath.Join(path, f.Name()))
+			}
+		case filepath.Ext(f.Name()) == eventExt:
+			q.names = append(q.names, f.Name())
+		}
+	}
+	sort.Strings(q.names)
+	return q, nil
+}
+
+//appends the event to the queue, returns ErrQueueFull if the queue is full
+func (q *Queue) Push(e Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("can't encode the event: %v", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 && len(q.names) >= q.size {
+		return ErrQueueFull
+	}
+	q.seq++
+	name := fmt.Sprintf("%020d-%06d%s", time.Now().UnixNano(), q.seq%1000000, eventExt)
+
+	//the half written events aren't read, the queued one is on the disk
+	if err := fsatomic.WriteFile(filepath.Join(q.path, name), b, 0600); err != nil {
+		return fmt.Errorf("can't write the event: %v", err)
+	}
+	q.names = append(q.names, name)
+	return nil
+}
+
+//returns the oldest event, ok is false if the queue is empty
+//the event stays in the queue until it's removed with the returned id
+func (q *Queue) Peek() (id string, e Event, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.names) == 0 {
+		return "", Event{}, false, nil
+	}
+	id = q.names[0]
+	b, err := ioutil.ReadFile(filepath.Join(q.path, id))
+	if err == nil {
+		err = json.Unmarshal(b, &e)
+	}
+	if err != nil {
+		//the broken event can't be sent, it's dropped
+		q.names = q.names[1:]
+		_ = os.Remove(filepath.Join(q.path, id))
+		return "", Event{}, false, fmt.Errorf("the broken event %s has been dropped: %v", id, err)
+	}
+	return id, e, true, nil
+}
+
+//removes the event returned by Peek
+func (q *Queue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, name := range q.names {
+		if name == id {
+			q.names = append(q.names[:i], q.names[i+1:]...)
+			break
+		}
+	}
+	if err := os.Remove(filepath.Join(q.path, id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove the event: %v", err)
+	}
+	return nil
+}
+
+//returns the number of the queued events
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.names)
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//outgoing webhooks of the data lifecycle events: the events are queued on the disk and posted to the url as the signed JSON
+//with retries and the exponential backoff
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//the event types
+const (
+	Created    = "created"    //the data has been posted
+	Downloaded = "downloaded" //the file of the data has been downloaded the first time
+	Expired    = "expired"    //the data has expired
+	Deleted    = "deleted"    //the data has been deleted
+)
+
+//the headers of the webhook request
+const (
+	EventHeader     = "X-Ftpdts-Event"
+	DeliveryHeader  = "X-Ftpdts-Delivery"
+	TimestampHeader = "X-Ftpdts-Timestamp"
+	//hex HMAC-SHA256 of the secret over the timestamp header value, the dot and the body: sha256=<hex>
+	SignatureHeader = "X-Ftpdts-Signature"
+)
+
+//Event is the data lifecycle event, it's the body of the webhook request
+type Event struct {
+	ID       string    `json:"id"` //unique id of the event, the receiver can use it to skip the repeated deliveries
+	Type     string    `json:"type"`
+	UID      string    `json:"uid"`
+	Time     time.Time `json:"time"`
+	Template string    `json:"template,omitempty"` //the template of the downloaded file
+	ClientIP string    `json:"clientIP,omitempty"` //the client which has downloaded the file
+}
+
+//Sender posts the queued events to the url one by one in the order they are queued
+//the event which can't be delivered is retried with the exponential backoff, it's dropped after MaxAttempts
+type Sender struct {
+	url    string
+	secret []byte
+	queue  *Queue
+	client *http.Client
+
+	Events      map[string]bool //the event types to send, all if nil
+	MaxAttempts int             //0 - retried until it's delivered
+	Backoff     time.Duration   //the delay before the first retry, it's doubled for every next one
+	MaxBackoff  time.Duration   //the maximum delay between the retries
+	Logger      *log.Logger     //delivery failures are logged if it's set
+
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewSender(url string, secret string, queue *Queue) *Sender {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Sender{
+		url:         url,
+		secret:      []byte(secret),
+		queue:       queue,
+		client:      &http.Client{Timeout: time.Second * 10},
+		MaxAttempts: 10,
+		Backoff:     time.Second,
+		MaxBackoff:  time.Minute * 5,
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+//sets the timeout of the webhook request
+func (s *Sender) SetTimeout(timeout time.Duration) {
+	s.client.Timeout = timeout
+}
+
+//queues the event, the id and the time are set if they are empty
+//the event isn't queued if its type isn't enabled
+func (s *Sender) Notify(e Event) {
+	if s.Events != nil && !s.Events[e.Type] {
+		return
+	}
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := s.queue.Push(e); err != nil {
+		s.logf("Can't queue the webhook event %s of uid %s: %v", e.Type, e.UID, err)
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+//starts the delivery of the queued events
+func (s *Sender) Start() {
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		s.run()
+	}()
+}
+
+//stops the delivery, the events which haven't been delivered stay in the queue
+func (s *Sender) Close() error {
+	s.cancel()
+	if s.done != nil {
+		<-s.done
+	}
+	return nil
+}
+
+func (s *Sender) run() {
+	attempts := 0
+	for {
+		id, e, ok, err := s.queue.Peek()
+		if err != nil {
+			s.logf("%v", err)
+			continue
+		}
+		if !ok {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.ctx.Done():
+				return
+			}
+		}
+
+		err = s.send(e)
+		if err != nil && s.ctx.Err() != nil {
+			//the sender is closed, the event is sent after the restart
+			return
+		}
+		if err == nil || (s.MaxAttempts > 0 && attempts+1 >= s.MaxAttempts) {
+			if err != nil {
+				s.logf("The webhook event %s of uid %s has been dropped after %d attempts: %v", e.Type, e.UID, attempts+1, err)
+			}
+			if err := s.queue.Remove(id); err != nil {
+				s.logf("%v", err)
+			}
+			attempts = 0
+			continue
+		}
+
+		delay := s.backoff(attempts)
+		attempts++
+		s.logf("Can't send the webhook event %s of uid %s, retrying in %v: %v", e.Type, e.UID, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//returns the delay before the retry after the attempts failed ones
+func (s *Sender) backoff(attempts int) time.Duration {
+	d := s.Backoff
+	for i := 0; i < attempts && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	return d
+}
+
+//posts the event, the response status other than 2xx is the failure
+func (s *Sender) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, e.Type)
+	req.Header.Set(DeliveryHeader, e.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(s.secret, timestamp, body))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", res.Status)
+	}
+	return nil
+}
+
+//returns the hex HMAC-SHA256 signature of the webhook request, the receiver checks it the same way
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Sender) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
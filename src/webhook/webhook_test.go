@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"encoding/json"
+	"ftpdts/src/fsatomic"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//receiver is the webhook endpoint which fails the first requests
+type receiver struct {
+	mu       sync.Mutex
+	secret   []byte
+	failures int
+	events   []Event
+	requests int
+	received chan Event
+}
+
+func newReceiver(secret string, failures int) *receiver {
+	return &receiver{secret: []byte(secret), failures: failures, received: make(chan Event, 100)}
+}
+
+func (r *receiver) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.requests <= r.failures {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Header.Get(SignatureHeader) != "sha256="+Sign(r.secret, req.Header.Get(TimestampHeader), body) {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil || req.Header.Get(EventHeader) != e.Type || req.Header.Get(DeliveryHeader) != e.ID {
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, e)
+	r.received <- e
+}
+
+func (r *receiver) wait(t *testing.T) Event {
+	select {
+	case e := <-r.received:
+		return e
+	case <-time.After(time.Second * 5):
+		t.Fatalf("the event hasn't been delivered")
+	}
+	return Event{}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "testing")
+	if err != nil {
+		t.Fatalf("can't create temporay directory for testing, %v", err)
+	}
+	return dir
+}
+
+func TestQueue(t *testing.T) {
+	dir := tempDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	q, err := NewQueue(dir, 2)
+	if err != nil {
+		t.Fatalf("can't create the queue: %v", err)
+	}
+	for _, uid := range []string{"uid1", "uid2"} {
+		if err := q.Push(Event{ID: uid, UID: uid}); err != nil {
+			t.Fatalf("can't push the event: %v", err)
+		}
+	}
+	if err := q.Push(Event{ID: "uid3"}); err != ErrQueueFull {
+		t.Errorf("the event has been pushed into the full queue: %v", err)
+	}
+
+	//the events survive reopening, the event being pushed isn't read, it's removed when it's stale
+	staleTmp, youngTmp := filepath.Join(dir, fsatomic.TmpFilePrefix+"1.json-1"), filepath.Join(dir, fsatomic.TmpFilePrefix+"2.json-2")
+	for _, f := range []string{staleTmp, youngTmp} {
+		if err := ioutil.WriteFile(f, []byte("{"), 0600); err != nil {
+			t.Fatalf("can't write the file: %v", err)
+		}
+	}
+	stale := time.Now().Add(-fsatomic.StaleTmpFileAge * 2)
+	if err := os.Chtimes(staleTmp, stale, stale); err != nil {
+		t.Fatalf("can't change the file time: %v", err)
+	}
+	if q, err = NewQueue(dir, 2); err != nil {
+		t.Fatalf("can't open the queue: %v", err)
+	}
+	if q.Len() != 2 {
+		t.Fatalf("wrong number of the events: %d", q.Len())
+	}
+	if _, err := os.Stat(staleTmp); !os.IsNotExist(err) {
+		t.Errorf("the stale temporary file hasn't been removed")
+	}
+	if _, err := os.Stat(youngTmp); err != nil {
+		t.Errorf("the young temporary file has been removed: %v", err)
+	}
+	_ = os.Remove(youngTmp)
+	for _, uid := range []string{"uid1", "uid2"} {
+		id, e, ok, err := q.Peek()
+		if err != nil || !ok || e.UID != uid {
+			t.Fatalf("wrong event: %v, %v, %v", e, ok, err)
+		}
+		if err := q.Remove(id); err != nil {
+			t.Fatalf("can't remove the event: %v", err)
+		}
+	}
+	if _, _, ok, _ := q.Peek(); ok {
+		t.Errorf("the event has been returned from the empty queue")
+	}
+
+	//the broken event is dropped
+	if err := ioutil.WriteFile(dir+"/0-broken.json", []byte("{"), 0600); err != nil {
+		t.Fatalf("can't write the file: %v", err)
+	}
+	if q, err = NewQueue(dir, 2); err != nil {
+		t.Fatalf("can't open the queue: %v", err)
+	}
+	if _, _, ok, err := q.Peek(); ok || err == nil {
+		t.Errorf("the broken event has been returned")
+	}
+	if q.Len() != 0 {
+		t.Errorf("the broken event hasn't been dropped")
+	}
+}
+
+func TestSender(t *testing.T) {
+	dir := tempDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	r := newReceiver("secret", 2)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	q, err := NewQueue(dir, 10)
+	if err != nil {
+		t.Fatalf("can't create the queue: %v", err)
+	}
+	s := NewSender(ts.URL, "secret", q)
+	s.Backoff, s.MaxBackoff = time.Millisecond*10, time.Millisecond*20
+	s.Events = map[string]bool{Created: true, Deleted: true}
+	s.Start()
+	defer func() { _ = s.Close() }()
+
+	//the disabled event isn't sent
+	s.Notify(Event{Type: Downloaded, UID: "uid0"})
+	//the event is retried until it's delivered
+	s.Notify(Event{Type: Created, UID: "uid1"})
+	s.Notify(Event{Type: Deleted, UID: "uid1"})
+
+	for _, typ := range []string{Created, Deleted} {
+		e := r.wait(t)
+		if e.Type != typ || e.UID != "uid1" || e.ID == "" || e.Time.IsZero() {
+			t.Errorf("wrong event: %v", e)
+		}
+	}
+	r.mu.Lock()
+	if r.requests != 4 {
+		t.Errorf("wrong number of the requests: %d", r.requests)
+	}
+	r.mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	if q.Len() != 0 {
+		t.Errorf("the delivered events are kept in the queue: %d", q.Len())
+	}
+}
+
+func TestSenderDrop(t *testing.T) {
+	dir := tempDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	r := newReceiver("secret", 3)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	q, err := NewQueue(dir, 10)
+	if err != nil {
+		t.Fatalf("can't create the queue: %v", err)
+	}
+	s := NewSender(ts.URL, "secret", q)
+	s.Backoff, s.MaxBackoff, s.MaxAttempts = time.Millisecond, time.Millisecond, 3
+	s.Start()
+	defer func() { _ = s.Close() }()
+
+	//the first event is dropped after 3 attempts, the next one is delivered
+	s.Notify(Event{Type: Created, UID: "uid1"})
+	s.Notify(Event{Type: Created, UID: "uid2"})
+	if e := r.wait(t); e.UID != "uid2" {
+		t.Errorf("wrong event: %v", e)
+	}
+}
+
+func TestSenderRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	q, err := NewQueue(dir, 10)
+	if err != nil {
+		t.Fatalf("can't create the queue: %v", err)
+	}
+	//the webhook is unreachable, the event stays in the queue
+	s := NewSender("http://127.0.0.1:1/", "secret", q)
+	s.Start()
+	s.Notify(Event{Type: Expired, UID: "uid1"})
+	time.Sleep(time.Millisecond * 50)
+	_ = s.Close()
+	if q.Len() != 1 {
+		t.Fatalf("the event hasn't been kept: %d", q.Len())
+	}
+
+	r := newReceiver("secret", 0)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	if q, err = NewQueue(dir, 10); err != nil {
+		t.Fatalf("can't open the queue: %v", err)
+	}
+	s = NewSender(ts.URL, "secret", q)
+	s.Start()
+	defer func() { _ = s.Close() }()
+	if e := r.wait(t); e.Type != Expired || e.UID != "uid1" {
+		t.Errorf("wrong event: %v", e)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	s := NewSender("", "", nil)
+	s.Backoff, s.MaxBackoff = time.Second, time.Second*5
+	for attempts, d := range []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 5, time.Second * 5} {
+		if b := s.backoff(attempts); b != d {
+			t.Errorf("wrong backoff after %d attempts: %v", attempts, b)
+		}
+	}
+}
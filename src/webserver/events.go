@@ -0,0 +1,100 @@
+// Copyright 2021 The Starship Troopers Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"ftpdts/src/eventbus"
+	"io"
+	"net/http"
+	"time"
+)
+
+//the comment is sent to the idle event stream with this interval, so the proxies don't close it
+var eventsHeartbeat = 15 * time.Second
+
+//the event telling the stream client how many events haven't fit its buffer
+const droppedEvent = "dropped"
+
+//streams the activity events as server-sent events, the events can be filtered by uid and template
+//requires a known API key, the uids of the events are enough to download the files
+func (s *WebServer) eventsRequest(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !s.current().apiKeys[req.Header.Get(apiKeyHeader)] {
+		s.unauthorized(res)
+		return
+	}
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		http.Error(res, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := s.events.Subscribe(eventbus.Filter{UID: req.FormValue("uid"), Template: req.FormValue("template")})
+	defer sub.Close()
+
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	s.logger.Printf("Event stream has been opened by %s", clientIP(req))
+	defer s.logger.Printf("Event stream of %s has been closed", clientIP(req))
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		var err error
+		select {
+		case <-req.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-heartbeat.C:
+			_, err = io.WriteString(res, ": ping\n\n")
+		case e, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			//the ids of the events are sequential, so the client can also see where the events have been lost
+			if n := sub.Dropped(); n > 0 {
+				err = writeEvent(res, droppedEvent, 0, map[string]uint64{"dropped": n})
+			}
+			if err == nil {
+				err = writeEvent(res, e.Type, e.ID, e)
+			}
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+//publishes the event of the web api to the bus if it's set
+func (s *WebServer) publish(e eventbus.Event) {
+	if s.events != nil {
+		s.events.Publish(e)
+	}
+}
+
+//writes the server-sent event with the json data, the id is omitted if it's 0
+func writeEvent(w io.Writer, event string, id uint64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if id > 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
@@ -8,13 +8,22 @@ package webserver
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"ftpdts/src/eventbus"
+	"ftpdts/src/storage"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,24 +34,68 @@ type Response struct {
 
 type DataGetResponse struct {
 	Response
-	Data      interface{} `json:"data"`
-	CreatedAt time.Time   `json:"createdAt"`
-	TTL       uint        `json:"ttl"`
+	Data         interface{} `json:"data"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	TTL          uint        `json:"ttl"`
+	MaxDownloads uint        `json:"maxDownloads,omitempty"`
+	Downloads    uint        `json:"downloads"`
+	NotBefore    *time.Time  `json:"notBefore,omitempty"`
+	ExpiresAt    *time.Time  `json:"expiresAt,omitempty"`
 }
 
 type DataPostResponse struct {
 	Response
-	UID string `json:"uid"`
+	UID  string `json:"uid"`
+	File string `json:"file,omitempty"` //signed ftp file path, if the links are signed
 }
 
-var errNFound = Response{10, "Not found"}
+type DataLinkResponse struct {
+	Response
+	UID       string     `json:"uid"`
+	File      string     `json:"file"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type DataStatsResponse struct {
+	Response
+	UID         string     `json:"uid"`
+	Downloads   uint       `json:"downloads"`
+	FirstAccess *time.Time `json:"firstAccess"`
+	LastAccess  *time.Time `json:"lastAccess"`
+}
+
+var (
+	errNFound       = Response{10, "Not found"}
+	errRateLimited  = Response{11, "Too many requests"}
+	errQuota        = Response{12, "Daily quota exceeded"}
+	errUnauthorized = Response{13, "Unknown API key"}
+	errNotReady     = Response{14, "Service is shutting down"}
+	errTooLarge     = Response{15, "Data is too large"}
+)
+
+//header the client passes its API key in
+const apiKeyHeader = "X-API-Key"
 
 //webserver options
 type Opts struct {
 	Port           uint
 	Host           string
 	MaxRequestBody int64
-	DataStorage    DataStorage //data storage
+	DataStorage    DataStorage   //data storage
+	RulesStorage   RulesStorage  //download rules storage
+	AuditStorage   AuditStorage  //download audit trail storage, the stats endpoint is disabled if nil
+	Metrics        []Metrics     //sources of the metrics endpoint, the endpoint is disabled if empty
+	APIKeys        []string      //known API keys, requests with other keys are rejected
+	IPLimiter      Limiter       //rate limit of the requests without API key by client IP, unlimited if nil
+	KeyLimiter     Limiter       //rate limit of the requests by API key, unlimited if nil
+	KeyQuota       Limiter       //daily quota of the datasets created by API key, unlimited if nil
+	AuthRead       bool          //the data, stats and link endpoints require a known API key
+	Signer         Signer        //signs the ftp file names, the link endpoint is disabled if nil
+	LinkTTL        time.Duration //ttl of the signed file names returned with the posted data, 0 - never expire
+	DefaultTTL     time.Duration //ttl of the data posted without ttl, the data storage default is used if 0
+	TLSCert        string        //certificate file, the server is started with https if it's set
+	TLSKey         string        //private key file of the certificate
+	Events         EventBus      //the created and deleted data is published to the bus, the event stream endpoint is disabled if nil
 	UIDGenerator   UID
 	Logger         *log.Logger //Where log will be written to (default to stdout)
 }
@@ -50,6 +103,38 @@ type Opts struct {
 type DataStorage interface {
 	Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error)
 	Put(uid string, payload interface{}, ttl *time.Duration) error
+	Delete(uid string) error
+}
+
+type RulesStorage interface {
+	Get(uid string) (r storage.Rules, ok bool)
+	Set(uid string, r storage.Rules, ttl *time.Duration) error
+	Delete(uid string) error
+}
+
+//EventBus passes the activity events of the web api and the ftp server
+type EventBus interface {
+	Publish(e eventbus.Event)
+	Subscribe(filter eventbus.Filter) *eventbus.Subscription
+}
+
+type AuditStorage interface {
+	Stats(uid string) (downloads uint, firstAccess time.Time, lastAccess time.Time, err error)
+}
+
+//Limiter allows or denies the request of the client identified by the key
+type Limiter interface {
+	Allow(key string) (ok bool, retryAfter time.Duration)
+}
+
+//Signer returns the signed ftp file path
+type Signer interface {
+	FileName(uid string, template string, expiresAt time.Time) string
+}
+
+//Metrics is a source of the counters and gauges exposed by the metrics endpoint
+type Metrics interface {
+	Metrics() map[string]uint64
 }
 
 //UID validator
@@ -62,34 +147,176 @@ type UID interface {
 type WebServer struct {
 	logger         *log.Logger
 	ds             DataStorage
+	rs             RulesStorage
+	as             AuditStorage
+	metrics        []Metrics
+	signer         Signer
+	events         EventBus
+	linkTTL        time.Duration
 	port           uint
 	maxRequestBody int64
 	uidGenerator   UID
 	server         *http.Server
+	tlsCert        string
+	tlsKey         string
+	ready          int32
+	stopping       chan struct{} //closed on shutdown, the event streams are finished
+	stopOnce       sync.Once
+
+	mu       sync.RWMutex
+	settings settings
+	cert     *tls.Certificate
+}
+
+//the settings which can be changed while the server is running
+type settings struct {
+	apiKeys    map[string]bool
+	authRead   bool
+	ipLimiter  Limiter
+	keyLimiter Limiter
+	keyQuota   Limiter
+	defaultTTL time.Duration
 }
 
 func New(o Opts) *WebServer {
 	var mux http.ServeMux
 
 	s := &WebServer{
-		o.Logger,
-		o.DataStorage,
-		o.Port,
-		o.MaxRequestBody,
-		o.UIDGenerator,
-		&http.Server{
+		logger:         o.Logger,
+		ds:             o.DataStorage,
+		rs:             o.RulesStorage,
+		as:             o.AuditStorage,
+		metrics:        o.Metrics,
+		signer:         o.Signer,
+		events:         o.Events,
+		linkTTL:        o.LinkTTL,
+		port:           o.Port,
+		maxRequestBody: o.MaxRequestBody,
+		uidGenerator:   o.UIDGenerator,
+		server: &http.Server{
 			Addr:    fmt.Sprintf("%s:%d", o.Host, o.Port),
 			Handler: &mux,
 		},
+		tlsCert:  o.TLSCert,
+		tlsKey:   o.TLSKey,
+		stopping: make(chan struct{}),
+	}
+	s.SetAPIKeys(o.APIKeys, o.AuthRead)
+	s.SetLimiters(o.IPLimiter, o.KeyLimiter, o.KeyQuota)
+	s.SetDefaultTTL(o.DefaultTTL)
+	s.SetReady(true)
+
+	mux.HandleFunc("/ready", s.readyRequest)
+	mux.HandleFunc("/data", s.limit(s.dataRequest))
+	if o.AuditStorage != nil {
+		mux.HandleFunc("/data/stats", s.limit(s.auth(s.dataStatsRequest)))
+	}
+	if o.Signer != nil {
+		mux.HandleFunc("/data/link", s.limit(s.auth(s.dataLinkRequest)))
+	}
+	if len(o.Metrics) > 0 {
+		mux.HandleFunc("/metrics", s.metricsRequest)
+	}
+	if o.Events != nil {
+		mux.HandleFunc("/events", s.limit(s.eventsRequest))
 	}
-	mux.HandleFunc("/data", s.dataRequest)
 
 	return s
 }
 
 func (s *WebServer) Run() error {
-	s.logger.Printf("WEB server has been started at %s", s.server.Addr)
-	return s.server.ListenAndServe()
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+//serves the requests accepted by the listener, the listener is closed on shutdown
+//the https certificate is loaded if it hasn't been loaded before
+func (s *WebServer) Serve(l net.Listener) error {
+	if s.tlsCert != "" {
+		if cert, _ := s.certificate(nil); cert == nil {
+			if err := s.LoadCertificate(s.tlsCert, s.tlsKey); err != nil {
+				_ = l.Close()
+				return err
+			}
+		}
+		s.server.TLSConfig = &tls.Config{GetCertificate: s.certificate}
+		s.logger.Printf("WEB server has been started at %s with https", l.Addr())
+		return s.server.ServeTLS(l, "", "")
+	}
+	s.logger.Printf("WEB server has been started at %s", l.Addr())
+	return s.server.Serve(l)
+}
+
+//replaces the known API keys, authRead is the same as Opts.AuthRead
+func (s *WebServer) SetAPIKeys(keys []string, authRead bool) {
+	apiKeys := make(map[string]bool)
+	for _, k := range keys {
+		apiKeys[k] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.apiKeys, s.settings.authRead = apiKeys, authRead
+}
+
+//replaces the rate limiters and the daily quota, nil means unlimited
+func (s *WebServer) SetLimiters(ipLimiter Limiter, keyLimiter Limiter, keyQuota Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.ipLimiter, s.settings.keyLimiter, s.settings.keyQuota = ipLimiter, keyLimiter, keyQuota
+}
+
+//the readiness endpoint fails if the server isn't ready, so the load balancer stops sending the requests to it
+func (s *WebServer) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+func (s *WebServer) readyRequest(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "application/json")
+	if atomic.LoadInt32(&s.ready) != 1 {
+		res.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = res.Write(s.jsonResponse(errNotReady))
+		return
+	}
+	_, _ = res.Write(s.jsonResponse(Response{0, "OK"}))
+}
+
+//changes the ttl of the data posted without ttl
+func (s *WebServer) SetDefaultTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings.defaultTTL = ttl
+}
+
+//loads the certificate served by https, the new connections get it, the open ones are kept
+func (s *WebServer) LoadCertificate(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load the tls certificate: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = &cert
+	return nil
+}
+
+func (s *WebServer) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, nil
+}
+
+//returns the current settings
+func (s *WebServer) current() settings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings
 }
 
 func (s *WebServer) dataRequest(res http.ResponseWriter, req *http.Request) {
@@ -107,6 +334,8 @@ func (s *WebServer) dataRequest(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		settings := s.current()
+
 		var ttl *time.Duration
 		v, err := strconv.Atoi(req.FormValue("ttl"))
 		if err == nil {
@@ -114,20 +343,121 @@ func (s *WebServer) dataRequest(res http.ResponseWriter, req *http.Request) {
 			ttl = &d
 		}
 
-		//store data
+		var rules storage.Rules
+		if v := req.FormValue("maxDownloads"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				http.Error(res, "wrong maxDownloads value", http.StatusBadRequest)
+				return
+			}
+			rules.MaxDownloads = uint(n)
+		}
+
+		if rules.NotBefore, err = formTime(req, "notBefore"); err != nil {
+			http.Error(res, "wrong notBefore value", http.StatusBadRequest)
+			return
+		}
+
+		if rules.ExpiresAt, err = formTime(req, "expiresAt"); err != nil {
+			http.Error(res, "wrong expiresAt value", http.StatusBadRequest)
+			return
+		}
+
+		if !rules.ExpiresAt.IsZero() {
+			if rules.Expired(time.Now()) || !rules.NotBefore.Before(rules.ExpiresAt) {
+				http.Error(res, "wrong expiresAt value", http.StatusBadRequest)
+				return
+			}
+			//the memory cache keeps the data until it expires
+			if ttl == nil {
+				d := time.Until(rules.ExpiresAt)
+				ttl = &d
+			}
+		}
+		if ttl == nil && settings.defaultTTL > 0 {
+			ttl = &settings.defaultTTL
+		}
+
+		if key := req.Header.Get(apiKeyHeader); key != "" && settings.keyQuota != nil {
+			if ok, retryAfter := settings.keyQuota.Allow(key); !ok {
+				s.logger.Printf("Daily quota of the API key %s... has been exceeded", keyPrefix(key))
+				s.tooManyRequests(res, errQuota, retryAfter)
+				return
+			}
+		}
+
 		uid := s.uidGenerator.New()
+
+		//rules are stored first, so the data is never exposed without them
+		if !rules.Empty() {
+			if err = s.rs.Set(uid, rules, ttl); err != nil {
+				s.logger.Printf("Can't store rules into the rules storage: %v", err)
+				http.Error(res, "Internal error", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		//store data
 		err = s.ds.Put(uid, d, ttl)
+		if err == storage.ErrTooLarge {
+			s.logger.Printf("Data is too large for the memory storage")
+			if !rules.Empty() {
+				_ = s.rs.Delete(uid)
+			}
+			res.WriteHeader(http.StatusRequestEntityTooLarge)
+			_, _ = res.Write(s.jsonResponse(errTooLarge))
+			return
+		}
 		if err != nil {
 			s.logger.Printf("Can't store data into the datastorage: %v", err)
 			http.Error(res, "Internal error", http.StatusInternalServerError)
 			return
 		}
-		_, _ = res.Write(s.jsonResponse(DataPostResponse{Response{0, "OK"}, uid}))
+		r := DataPostResponse{Response: Response{0, "OK"}, UID: uid}
+		if s.signer != nil {
+			r.File = s.signer.FileName(uid, "", s.linkExpiresAt())
+		}
+		_, _ = res.Write(s.jsonResponse(r))
 		s.logger.Printf("New data has been stored into the storage with uid %s", uid)
+		s.publish(eventbus.Event{Type: eventbus.Created, UID: uid})
+		return
+	}
+
+	//the data can be deleted with a known API key only
+	if req.Method == http.MethodDelete {
+		if !s.current().apiKeys[req.Header.Get(apiKeyHeader)] {
+			s.unauthorized(res)
+			return
+		}
+		uid := req.FormValue("uid")
+		if uid == "" {
+			_, _ = res.Write(s.jsonResponse(errNFound))
+			return
+		}
+		if _, _, _, err := s.ds.Get(uid); err != nil {
+			_, _ = res.Write(s.jsonResponse(errNFound))
+			return
+		}
+
+		if err := s.ds.Delete(uid); err != nil {
+			s.logger.Printf("Can't delete data with uid %s: %v", uid, err)
+			http.Error(res, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := s.rs.Delete(uid); err != nil {
+			s.logger.Printf("Can't delete the rules of uid %s: %v", uid, err)
+		}
+		_, _ = res.Write(s.jsonResponse(Response{0, "OK"}))
+		s.logger.Printf("Data with uid %s has been deleted", uid)
+		s.publish(eventbus.Event{Type: eventbus.Deleted, UID: uid})
 		return
 	}
 
 	if req.Method == http.MethodGet {
+		if !s.authorized(req) {
+			s.unauthorized(res)
+			return
+		}
 		uid := req.FormValue("uid")
 		if uid == "" {
 			_, _ = res.Write(s.jsonResponse(errNFound))
@@ -139,8 +469,32 @@ func (s *WebServer) dataRequest(res http.ResponseWriter, req *http.Request) {
 			_, _ = res.Write(s.jsonResponse(errNFound))
 			return
 		}
+		//the persistent data is kept after expiresAt until the sweep, but it isn't served anymore
+		rules, ok := s.rs.Get(uid)
+		if ok && rules.Expired(time.Now()) {
+			_, _ = res.Write(s.jsonResponse(errNFound))
+			return
+		}
 
-		_, _ = res.Write(s.jsonResponse(DataGetResponse{Response{0, "OK"}, d, c, uint(ttl / time.Second)}))
+		r := DataGetResponse{Response: Response{0, "OK"}, Data: d, CreatedAt: c, TTL: uint(ttl / time.Second)}
+		if ok {
+			r.MaxDownloads, r.Downloads = rules.MaxDownloads, rules.Downloads
+			if !rules.NotBefore.IsZero() {
+				r.NotBefore = &rules.NotBefore
+			}
+			if !rules.ExpiresAt.IsZero() {
+				r.ExpiresAt = &rules.ExpiresAt
+			}
+		}
+		//the rules count the downloads of the limited data only, the audit trail counts all of them as the stats endpoint does
+		if s.as != nil {
+			if downloads, _, _, err := s.as.Stats(uid); err != nil {
+				s.logger.Printf("Can't get the download stats for uid %s: %v", uid, err)
+			} else {
+				r.Downloads = downloads
+			}
+		}
+		_, _ = res.Write(s.jsonResponse(r))
 		s.logger.Printf("Data with uid %s has been presented", uid)
 		return
 	}
@@ -148,10 +502,187 @@ func (s *WebServer) dataRequest(res http.ResponseWriter, req *http.Request) {
 	http.Error(res, "Bad request", http.StatusBadRequest)
 }
 
-func (s *WebServer) Shutdown() {
-	ctx := context.Background()
+func (s *WebServer) dataStatsRequest(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Set("Content-Type", "application/json")
+	if req.Method != http.MethodGet {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	uid := req.FormValue("uid")
+	if uid == "" {
+		_, _ = res.Write(s.jsonResponse(errNFound))
+		return
+	}
+
+	downloads, first, last, err := s.as.Stats(uid)
+	if err != nil {
+		s.logger.Printf("Can't get the download stats for uid %s: %v", uid, err)
+		http.Error(res, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	r := DataStatsResponse{Response: Response{0, "OK"}, UID: uid, Downloads: downloads}
+	if downloads > 0 {
+		r.FirstAccess, r.LastAccess = &first, &last
+	}
+	_, _ = res.Write(s.jsonResponse(r))
+}
+
+//returns the signed ftp file path of the data
+func (s *WebServer) dataLinkRequest(res http.ResponseWriter, req *http.Request) {
+
+	res.Header().Set("Content-Type", "application/json")
+	if req.Method != http.MethodGet {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	uid := req.FormValue("uid")
+	if uid == "" {
+		_, _ = res.Write(s.jsonResponse(errNFound))
+		return
+	}
+	if _, _, _, err := s.ds.Get(uid); err != nil {
+		_, _ = res.Write(s.jsonResponse(errNFound))
+		return
+	}
+
+	template := req.FormValue("template")
+	if strings.ContainsAny(template, "/\\.") {
+		http.Error(res, "wrong template value", http.StatusBadRequest)
+		return
+	}
+
+	expiresAt := s.linkExpiresAt()
+	if v := req.FormValue("ttl"); v != "" {
+		ttl, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(res, "wrong ttl value", http.StatusBadRequest)
+			return
+		}
+		expiresAt = time.Time{}
+		if ttl > 0 {
+			expiresAt = time.Now().Add(time.Second * time.Duration(ttl))
+		}
+	}
+
+	r := DataLinkResponse{Response: Response{0, "OK"}, UID: uid, File: s.signer.FileName(uid, template, expiresAt)}
+	if !expiresAt.IsZero() {
+		r.ExpiresAt = &expiresAt
+	}
+	_, _ = res.Write(s.jsonResponse(r))
+}
+
+//returns the expiry time of the signed file names, zero if they never expire
+func (s *WebServer) linkExpiresAt() time.Time {
+	if s.linkTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.linkTTL)
+}
+
+//rejects the request without the known API key if the read endpoints require it
+func (s *WebServer) auth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !s.authorized(req) {
+			s.unauthorized(res)
+			return
+		}
+		handler(res, req)
+	}
+}
+
+func (s *WebServer) authorized(req *http.Request) bool {
+	settings := s.current()
+	return !settings.authRead || settings.apiKeys[req.Header.Get(apiKeyHeader)]
+}
+
+func (s *WebServer) unauthorized(res http.ResponseWriter) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(http.StatusUnauthorized)
+	_, _ = res.Write(s.jsonResponse(errUnauthorized))
+}
+
+//checks the API key and the rate limits before the request is handled
+//the requests with the API key are limited by the key, others by the client IP
+func (s *WebServer) limit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		settings := s.current()
+		limiter, key := settings.ipLimiter, clientIP(req)
+		if k := req.Header.Get(apiKeyHeader); k != "" {
+			if !settings.apiKeys[k] {
+				s.unauthorized(res)
+				return
+			}
+			limiter, key = settings.keyLimiter, k
+		}
+		if limiter != nil {
+			if ok, retryAfter := limiter.Allow(key); !ok {
+				s.tooManyRequests(res, errRateLimited, retryAfter)
+				return
+			}
+		}
+		handler(res, req)
+	}
+}
+
+func (s *WebServer) tooManyRequests(res http.ResponseWriter, r Response, retryAfter time.Duration) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retryAfter.Seconds())), 10))
+	res.WriteHeader(http.StatusTooManyRequests)
+	_, _ = res.Write(s.jsonResponse(r))
+}
+
+//returns the client IP without the port
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+//returns the beginning of the API key, so the key isn't exposed in the log
+func keyPrefix(key string) string {
+	if len(key) > 4 {
+		return key[:4]
+	}
+	return key
+}
+
+//writes the metrics in the prometheus text format
+func (s *WebServer) metricsRequest(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	metrics := make(map[string]uint64)
+	for _, m := range s.metrics {
+		for name, value := range m.Metrics() {
+			metrics[name] = value
+		}
+	}
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		_, _ = fmt.Fprintf(res, "%s %d\n", name, metrics[name])
+	}
+}
+
+//stops accepting the new connections and waits for the requests in progress until ctx is done
+func (s *WebServer) Shutdown(ctx context.Context) error {
 	s.logger.Printf("Shutting down the web server")
-	_ = s.server.Shutdown(ctx)
+	s.SetReady(false)
+	s.stopOnce.Do(func() { close(s.stopping) })
+	return s.server.Shutdown(ctx)
 }
 
 func (s *WebServer) jsonResponse(d interface{}) []byte {
@@ -163,6 +694,15 @@ func (s *WebServer) jsonResponse(d interface{}) []byte {
 	return b
 }
 
+//parse the RFC 3339 time form value, returns zero time if the value is empty
+func formTime(req *http.Request, key string) (t time.Time, err error) {
+	v := req.FormValue(key)
+	if v == "" {
+		return
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
 func (s *WebServer) readBody(req *http.Request) ([]byte, error) {
 	b := bytes.NewBuffer(make([]byte, 0))
 	if req.ContentLength > s.maxRequestBody {
@@ -0,0 +1,244 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"ftpdts/src/ratelimit"
+	"ftpdts/src/storage"
+	"github.com/starshiptroopers/uidgenerator"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeDataStorage struct {
+	data map[string]interface{}
+}
+
+func (s *fakeDataStorage) Get(uid string) (payload interface{}, createdAt time.Time, ttl time.Duration, err error) {
+	payload, ok := s.data[uid]
+	if !ok {
+		err = errors.New("uid not found")
+	}
+	return
+}
+
+func (s *fakeDataStorage) Put(uid string, payload interface{}, ttl *time.Duration) error {
+	s.data[uid] = payload
+	return nil
+}
+
+func (s *fakeDataStorage) Delete(uid string) error {
+	delete(s.data, uid)
+	return nil
+}
+
+type fakeRulesStorage struct {
+	rules map[string]storage.Rules
+}
+
+func (s *fakeRulesStorage) Get(uid string) (storage.Rules, bool) {
+	r, ok := s.rules[uid]
+	return r, ok
+}
+
+func (s *fakeRulesStorage) Set(uid string, r storage.Rules, ttl *time.Duration) error {
+	s.rules[uid] = r
+	return nil
+}
+
+func (s *fakeRulesStorage) Delete(uid string) error {
+	delete(s.rules, uid)
+	return nil
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+//creates the web server with the memory storages, the options are changed by opts
+func newTestWebServer(opts ...func(o *Opts)) (*WebServer, *fakeRulesStorage) {
+	rs := &fakeRulesStorage{make(map[string]storage.Rules)}
+	o := Opts{
+		MaxRequestBody: 1024,
+		DataStorage:    &fakeDataStorage{make(map[string]interface{})},
+		RulesStorage:   rs,
+		UIDGenerator:   uidgenerator.New(nil),
+		Logger:         log.New(ioutil.Discard, "", 0),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return New(o), rs
+}
+
+//sends the request to the web server and decodes the response body
+func serve(t *testing.T, s *WebServer, method string, url string, body string, header http.Header) (*httptest.ResponseRecorder, DataPostResponse) {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.RemoteAddr = "10.0.0.1:1000"
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, values := range header {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	res := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(res, req)
+
+	var r DataPostResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &r); err != nil {
+		t.Fatalf("wrong response %d: %s", res.Code, res.Body.String())
+	}
+	return res, r
+}
+
+//the persistent data isn't served after its expiry time
+func TestDataExpired(t *testing.T) {
+	s, rs := newTestWebServer()
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	_, r := serve(t, s, http.MethodPost, "/data?ttl=0&expiresAt="+expiresAt, `{"Title": "Test"}`, nil)
+	if r.Code != 0 {
+		t.Fatalf("the data hasn't been posted: %+v", r)
+	}
+
+	if _, got := serve(t, s, http.MethodGet, "/data?uid="+r.UID, "", nil); got.Code != 0 {
+		t.Errorf("the data hasn't been served before its expiry time: %+v", got)
+	}
+	rules := rs.rules[r.UID]
+	rules.ExpiresAt = time.Now().Add(-time.Second)
+	rs.rules[r.UID] = rules
+	if _, got := serve(t, s, http.MethodGet, "/data?uid="+r.UID, "", nil); got.Code != errNFound.Code {
+		t.Errorf("the expired data has been served: %+v", got)
+	}
+}
+
+type fakeAuditStorage struct {
+	downloads map[string]uint
+}
+
+func (s *fakeAuditStorage) Stats(uid string) (downloads uint, firstAccess time.Time, lastAccess time.Time, err error) {
+	return s.downloads[uid], time.Now(), time.Now(), nil
+}
+
+//the data and the stats endpoints report the same number of downloads for the data with and without rules
+func TestDataDownloads(t *testing.T) {
+	as := &fakeAuditStorage{make(map[string]uint)}
+	s, _ := newTestWebServer(func(o *Opts) {
+		o.AuditStorage = as
+	})
+	for _, query := range []string{"", "maxDownloads=5"} {
+		_, r := serve(t, s, http.MethodPost, "/data?"+query, `{"Title": "Test"}`, nil)
+		if r.Code != 0 {
+			t.Fatalf("the data hasn't been posted: %+v", r)
+		}
+		as.downloads[r.UID] = 2
+
+		res, _ := serve(t, s, http.MethodGet, "/data?uid="+r.UID, "", nil)
+		var data DataGetResponse
+		if err := json.Unmarshal(res.Body.Bytes(), &data); err != nil || data.Downloads != 2 {
+			t.Errorf("wrong downloads of the data posted with %q: %d, %v", query, data.Downloads, err)
+		}
+		res, _ = serve(t, s, http.MethodGet, "/data/stats?uid="+r.UID, "", nil)
+		var stats DataStatsResponse
+		if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil || stats.Downloads != data.Downloads {
+			t.Errorf("the stats downloads differ from the data ones: %d, %v", stats.Downloads, err)
+		}
+	}
+}
+
+//the data too large for the memory cache is rejected with 413, its rules aren't kept
+func TestDataTooLarge(t *testing.T) {
+	s, rs := newTestWebServer(func(o *Opts) {
+		o.DataStorage = storage.NewDataStorage(storage.NewMemoryDataStorage(0, 10), &fakeDataStorage{make(map[string]interface{})})
+	})
+	res, r := serve(t, s, http.MethodPost, "/data?maxDownloads=1", `{"Title": "Test"}`, nil)
+	if res.Code != http.StatusRequestEntityTooLarge || r.Code != errTooLarge.Code {
+		t.Errorf("wrong response to the data too large for the cache: %d, %+v", res.Code, r)
+	}
+	if len(rs.rules) != 0 {
+		t.Errorf("the rules of the rejected data have been kept: %v", rs.rules)
+	}
+
+	if _, r := serve(t, s, http.MethodPost, "/data?ttl=0", `{"Title": "Test"}`, nil); r.Code != 0 {
+		t.Errorf("the persistent data too large for the cache hasn't been stored: %+v", r)
+	}
+}
+
+//the requests over the rate limit are rejected with 429 and the time to retry after
+func TestRateLimit(t *testing.T) {
+	clock := &fakeClock{time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)}
+	s, _ := newTestWebServer(func(o *Opts) {
+		o.IPLimiter = ratelimit.NewLimiter(0.5, 1, clock)
+	})
+
+	if res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, nil); res.Code != http.StatusOK || r.Code != 0 {
+		t.Fatalf("the request within the rate limit has been rejected: %d, %+v", res.Code, r)
+	}
+	res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, nil)
+	if res.Code != http.StatusTooManyRequests || r.Code != errRateLimited.Code {
+		t.Errorf("the request over the rate limit hasn't been rejected: %d, %+v", res.Code, r)
+	}
+	if ra := res.Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("wrong Retry-After header: %q", ra)
+	}
+
+	clock.now = clock.now.Add(time.Second * 2)
+	if res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, nil); res.Code != http.StatusOK || r.Code != 0 {
+		t.Errorf("the request after Retry-After has been rejected: %d, %+v", res.Code, r)
+	}
+}
+
+//the requests with an unknown API key are rejected before the rate limits are applied
+func TestUnknownAPIKey(t *testing.T) {
+	s, _ := newTestWebServer(func(o *Opts) {
+		o.APIKeys = []string{"key1"}
+	})
+
+	res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, http.Header{apiKeyHeader: {"unknown"}})
+	if res.Code != http.StatusUnauthorized || r.Code != errUnauthorized.Code {
+		t.Errorf("the request with an unknown API key hasn't been rejected: %d, %+v", res.Code, r)
+	}
+	if res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, http.Header{apiKeyHeader: {"key1"}}); res.Code != http.StatusOK || r.Code != 0 {
+		t.Errorf("the request with the known API key has been rejected: %d, %+v", res.Code, r)
+	}
+}
+
+//the datasets created with the API key are limited by the daily quota, the quota is reset at midnight UTC
+func TestQuota(t *testing.T) {
+	clock := &fakeClock{time.Date(2021, 3, 1, 23, 0, 0, 0, time.UTC)}
+	s, _ := newTestWebServer(func(o *Opts) {
+		o.APIKeys = []string{"key1"}
+		o.KeyQuota = ratelimit.NewQuota(1, clock)
+	})
+	key := http.Header{apiKeyHeader: {"key1"}}
+
+	if res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, key); res.Code != http.StatusOK || r.Code != 0 {
+		t.Fatalf("the dataset within the quota has been rejected: %d, %+v", res.Code, r)
+	}
+	res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, key)
+	if res.Code != http.StatusTooManyRequests || r.Code != errQuota.Code {
+		t.Errorf("the dataset over the quota hasn't been rejected: %d, %+v", res.Code, r)
+	}
+	if ra := res.Header().Get("Retry-After"); ra != "3600" {
+		t.Errorf("wrong Retry-After header: %q", ra)
+	}
+	//the data is read without the quota
+	if res, _ := serve(t, s, http.MethodGet, "/data?uid=unknown", "", key); res.Code == http.StatusTooManyRequests {
+		t.Errorf("the data request has been limited by the quota")
+	}
+
+	clock.now = clock.now.Add(time.Hour)
+	if res, r := serve(t, s, http.MethodPost, "/data", `{"Title": "Test"}`, key); res.Code != http.StatusOK || r.Code != 0 {
+		t.Errorf("the quota hasn't been reset on the next day: %d, %+v", res.Code, r)
+	}
+}